@@ -0,0 +1,1125 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON API under /api/v1. Lists are wrapped as {"data": [...], "meta": {...}},
+// single objects are returned as is and errors as {"error": {"code", "message"}}.
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+const (
+	apiDefaultPerPage = 50
+	apiMaxPerPage     = 500
+	apiMaxBody        = 1 << 20
+)
+
+// apiScopes lists the permissions an API caller can hold
+var apiScopes = []string{
+	"users:read", "users:write",
+	"departments:read", "departments:write",
+	"activities:read", "activities:write",
+	"entries:read", "entries:write",
+	"clock:write", "status:read", "reports:read",
+	"projects:read",
+}
+
+// apiPrincipal is the authenticated caller of an API request
+type apiPrincipal struct {
+	Name    string
+	Role    string
+	UserID  int             // DB user, 0 for CSV users and service tokens
+	Scopes  map[string]bool // nil: permissions follow the role
+	Service bool            // service token, not bound to a user
+}
+
+func (p apiPrincipal) isAdmin() bool {
+	return strings.EqualFold(p.Role, "admin")
+}
+
+func (p apiPrincipal) can(scope string) bool {
+	if p.Scopes != nil {
+		return p.Scopes[scope]
+	}
+	if p.isAdmin() {
+		return true
+	}
+	switch scope {
+	case "clock:write", "status:read", "activities:read", "departments:read", "projects:read":
+		return true
+	}
+	return false
+}
+
+type apiCtxKey int
+
+const principalKey apiCtxKey = 0
+
+func principalFrom(r *http.Request) apiPrincipal {
+	p, _ := r.Context().Value(principalKey).(apiPrincipal)
+	return p
+}
+
+// sessionPrincipal builds the caller from the regular login session
+func sessionPrincipal(r *http.Request) (apiPrincipal, bool) {
+	session, _ := store.Get(r, "session")
+	username, _ := session.Values["username"].(string)
+	if username == "" {
+		return apiPrincipal{}, false
+	}
+	role, _ := session.Values["role"].(string)
+	uid, _ := session.Values["db_user_id"].(int)
+	return apiPrincipal{Name: username, Role: role, UserID: uid}, true
+}
+
+// apiAuth requires an authenticated caller holding scope, either by API
+// token (Authorization: Bearer) or by login session
+func apiAuth(scope string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if raw, ok := bearerToken(r); ok {
+			if p, ok := authenticateBearer(w, r, raw, scope); ok {
+				h(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+			}
+			return
+		}
+		p, ok := sessionPrincipal(r)
+		if !ok {
+			apiError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+			return
+		}
+		if !p.can(scope) {
+			apiError(w, http.StatusForbidden, "forbidden", "missing permission "+scope)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+//---------------------------------------------------------------------
+// Response helpers
+//---------------------------------------------------------------------
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiMeta struct {
+	Page    int `json:"page"`
+	PerPage int `json:"perPage"`
+	Total   int `json:"total"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]apiErrorBody{"error": {Code: code, Message: message}})
+}
+
+// writeList paginates items with ?page= and ?per_page=
+func writeList[T any](w http.ResponseWriter, r *http.Request, items []T) {
+	page := atoiDefault(r.URL.Query().Get("page"), 1)
+	perPage := atoiDefault(r.URL.Query().Get("per_page"), apiDefaultPerPage)
+	if page < 1 || perPage < 1 || perPage > apiMaxPerPage {
+		apiError(w, http.StatusBadRequest, "invalid_pagination", fmt.Sprintf("page must be >= 1 and per_page between 1 and %d", apiMaxPerPage))
+		return
+	}
+	start := min((page-1)*perPage, len(items))
+	end := min(start+perPage, len(items))
+	data := items[start:end]
+	if data == nil {
+		data = []T{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"data": data, "meta": apiMeta{Page: page, PerPage: perPage, Total: len(items)}})
+}
+
+// decodeJSON reads a JSON request body into v; it answers the request itself on failure
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		apiError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be application/json")
+		return false
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return false
+	}
+	return true
+}
+
+// apiStoreError maps a failed write to 409 for constraint violations and 500 otherwise
+func apiStoreError(w http.ResponseWriter, err error) {
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "unique") || strings.Contains(msg, "duplicate") || strings.Contains(msg, "already exists") {
+		apiError(w, http.StatusConflict, "conflict", err.Error())
+		return
+	}
+	apiError(w, http.StatusInternalServerError, "internal_error", err.Error())
+}
+
+func apiCreated(w http.ResponseWriter, location string, v any) {
+	w.Header().Set("Location", location)
+	writeJSON(w, http.StatusCreated, v)
+}
+
+// parseAPITime accepts RFC 3339 and the formats used by the HTML forms
+func parseAPITime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q, use RFC 3339", s)
+}
+
+//---------------------------------------------------------------------
+// Resources
+//---------------------------------------------------------------------
+
+type apiUser struct {
+	ID                   int    `json:"id"`
+	Name                 string `json:"name"`
+	Email                string `json:"email"`
+	Role                 string `json:"role"`
+	Position             string `json:"position"`
+	DepartmentID         int    `json:"departmentId"`
+	Stampkey             string `json:"stampkey"`
+	Active               bool   `json:"active"`
+	AutoCheckoutMidnight bool   `json:"autoCheckoutMidnight"`
+}
+
+func toAPIUser(u User) apiUser {
+	return apiUser{ID: u.ID, Name: u.Name, Email: u.Email, Role: u.Role, Position: u.Position, DepartmentID: u.DepartmentID,
+		Stampkey: u.Stampkey, Active: u.Active != 0, AutoCheckoutMidnight: u.AutoCheckoutMidnight != 0}
+}
+
+// apiUserInput is used for create (name and email required) and partial update
+type apiUserInput struct {
+	Name                 *string `json:"name"`
+	Email                *string `json:"email"`
+	Password             *string `json:"password"`
+	Role                 *string `json:"role"`
+	Position             *string `json:"position"`
+	DepartmentID         *int    `json:"departmentId"`
+	Stampkey             *string `json:"stampkey"`
+	Active               *bool   `json:"active"`
+	AutoCheckoutMidnight *bool   `json:"autoCheckoutMidnight"`
+}
+
+type apiDepartment struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func toAPIDepartment(d Department) apiDepartment {
+	return apiDepartment{ID: d.ID, Name: d.Name}
+}
+
+type apiActivity struct {
+	ID      int    `json:"id"`
+	Status  string `json:"status"`
+	Work    bool   `json:"work"`
+	Comment string `json:"comment"`
+	Code    string `json:"code"`
+	// CommentRequired: interactive stamping needs a comment
+	CommentRequired bool `json:"commentRequired"`
+	Billable        bool `json:"billable"`
+}
+
+func toAPIActivity(a Activity) apiActivity {
+	return apiActivity{ID: a.ID, Status: a.Status, Work: a.Work != 0, Comment: a.Comment, Code: a.Code, CommentRequired: a.CommentRequired, Billable: a.Billable}
+}
+
+type apiActivityInput struct {
+	Status  *string `json:"status"`
+	Work    *bool   `json:"work"`
+	Comment *string `json:"comment"`
+	Code    *string `json:"code"`
+
+	CommentRequired *bool `json:"commentRequired"`
+	Billable        *bool `json:"billable"`
+}
+
+// apiEntry mirrors EntryDetail so it can be converted directly
+type apiEntry struct {
+	ID         int     `json:"id"`
+	UserID     int     `json:"userId"`
+	UserName   string  `json:"userName"`
+	Department string  `json:"department"`
+	ActivityID int     `json:"activityId"`
+	Activity   string  `json:"activity"`
+	Date       string  `json:"date"`
+	Start      string  `json:"start"`
+	End        string  `json:"end,omitempty"`
+	Duration   float64 `json:"durationHours,omitempty"`
+	Comment    string  `json:"comment"`
+	ProjectID  int     `json:"projectId,omitempty"`
+	Project    string  `json:"project,omitempty"`
+	TaskID     int     `json:"taskId,omitempty"`
+	Task       string  `json:"task,omitempty"`
+}
+
+type apiEntryInput struct {
+	UserID     *int    `json:"userId"`
+	ActivityID *int    `json:"activityId"`
+	Timestamp  *string `json:"timestamp"`
+	Comment    *string `json:"comment"`
+	ProjectID  *int    `json:"projectId"` // 0 removes the project
+	TaskID     *int    `json:"taskId"`
+	// required to change entries of a locked timesheet month (HR, admin)
+	CorrectionReason *string `json:"correctionReason"`
+}
+
+type apiStatus struct {
+	UserName string `json:"userName"`
+	Status   string `json:"status"`
+	Since    string `json:"since"`
+}
+
+type apiWorkHours struct {
+	UserName  string  `json:"userName"`
+	WorkDate  string  `json:"date"`
+	WorkHours float64 `json:"hours"`
+}
+
+type apiDepartmentSummary struct {
+	DepartmentName  string  `json:"department"`
+	TotalUsers      int     `json:"users"`
+	TotalHours      float64 `json:"hours"`
+	AvgHoursPerUser float64 `json:"avgHoursPerUser"`
+}
+
+type apiTrend struct {
+	Date         string  `json:"date"`
+	TotalHours   float64 `json:"hours"`
+	ActiveUsers  int     `json:"activeUsers"`
+	WorkEntries  int     `json:"workEntries"`
+	BreakEntries int     `json:"breakEntries"`
+}
+
+type apiTask struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+type apiProject struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Client      string    `json:"client"`
+	BudgetHours float64   `json:"budgetHours"`
+	ActiveFrom  string    `json:"activeFrom,omitempty"`
+	ActiveTo    string    `json:"activeTo,omitempty"`
+	Tasks       []apiTask `json:"tasks"`
+}
+
+func toAPIProject(p Project) apiProject {
+	tasks := convertAll(p.Tasks, func(t Task) apiTask { return apiTask{ID: t.ID, Name: t.Name, Active: t.Active} })
+	return apiProject{ID: p.ID, Name: p.Name, Client: p.Client, BudgetHours: p.BudgetHours,
+		ActiveFrom: p.ActiveFrom, ActiveTo: p.ActiveTo, Tasks: tasks}
+}
+
+func convertAll[S, T any](in []S, conv func(S) T) []T {
+	out := make([]T, 0, len(in))
+	for _, v := range in {
+		out = append(out, conv(v))
+	}
+	return out
+}
+
+func validRole(role string) bool {
+	_, ok := roleRank[strings.ToLower(role)]
+	return ok
+}
+
+//---------------------------------------------------------------------
+// Users
+//---------------------------------------------------------------------
+
+func apiListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	search := strings.ToLower(q.Get("q"))
+	var out []apiUser
+	for _, u := range getAllUsers() {
+		if d := q.Get("department_id"); d != "" && strconv.Itoa(u.DepartmentID) != d {
+			continue
+		}
+		if a := q.Get("active"); a != "" && (a == "true") != (u.Active != 0) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(u.Name), search) && !strings.Contains(strings.ToLower(u.Email), search) {
+			continue
+		}
+		out = append(out, toAPIUser(u))
+	}
+	writeList(w, r, out)
+}
+
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	u := getUser(r.PathValue("id"))
+	if u.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "user not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIUser(u))
+}
+
+func apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	var in apiUserInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if in.Name == nil || strings.TrimSpace(*in.Name) == "" || in.Email == nil || strings.TrimSpace(*in.Email) == "" {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "name and email are required")
+		return
+	}
+	u := User{Name: *in.Name, Email: *in.Email, Role: "user"}
+	applyUserInput(&u, in)
+	if !validRole(u.Role) {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "unknown role "+u.Role)
+		return
+	}
+	password, ok := apiCheckPassword(w, r, u, in)
+	if !ok {
+		return
+	}
+	id, err := createUser(u.Name, u.Stampkey, u.Email, password, u.Role, u.Position, strconv.Itoa(u.DepartmentID))
+	if err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	sid := strconv.FormatInt(id, 10)
+	if in.AutoCheckoutMidnight != nil {
+		setUserAutoCheckout(sid, *in.AutoCheckoutMidnight)
+	}
+	if in.Active != nil {
+		setUserActive(sid, *in.Active)
+	}
+	apiCreated(w, "/api/v1/users/"+sid, toAPIUser(getUser(sid)))
+}
+
+// apiCheckPassword returns the password of a user write ("" keeps it) after
+// the tenant's password policy, answering 422 password_policy otherwise
+func apiCheckPassword(w http.ResponseWriter, r *http.Request, u User, in apiUserInput) (string, bool) {
+	if in.Password == nil || *in.Password == "" {
+		return "", true
+	}
+	if err := checkPasswordPolicy(r, u, *in.Password); err != nil {
+		apiError(w, http.StatusUnprocessableEntity, "password_policy", err.Error())
+		return "", false
+	}
+	return *in.Password, true
+}
+
+func applyUserInput(u *User, in apiUserInput) {
+	if in.Name != nil {
+		u.Name = *in.Name
+	}
+	if in.Email != nil {
+		u.Email = *in.Email
+	}
+	if in.Role != nil {
+		u.Role = strings.ToLower(*in.Role)
+	}
+	if in.Position != nil {
+		u.Position = *in.Position
+	}
+	if in.DepartmentID != nil {
+		u.DepartmentID = *in.DepartmentID
+	}
+	if in.Stampkey != nil {
+		u.Stampkey = *in.Stampkey
+	}
+}
+
+func apiUpdateUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	u := getUser(id)
+	if u.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "user not found")
+		return
+	}
+	var in apiUserInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	applyUserInput(&u, in)
+	if strings.TrimSpace(u.Name) == "" || strings.TrimSpace(u.Email) == "" || !validRole(u.Role) {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "name, email and a known role are required")
+		return
+	}
+	password, ok := apiCheckPassword(w, r, u, in)
+	if !ok {
+		return
+	}
+	if err := updateUser(id, u.Name, u.Stampkey, u.Email, password, u.Role, u.Position, strconv.Itoa(u.DepartmentID)); err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	if in.AutoCheckoutMidnight != nil {
+		setUserAutoCheckout(id, *in.AutoCheckoutMidnight)
+	}
+	if in.Active != nil {
+		setUserActive(id, *in.Active)
+	}
+	writeJSON(w, http.StatusOK, toAPIUser(getUser(id)))
+}
+
+func apiDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if getUser(id).ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "user not found")
+		return
+	}
+	if err := deleteUser(id); err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiUserStatus(w http.ResponseWriter, r *http.Request) {
+	u := getUser(r.PathValue("id"))
+	if u.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "user not found")
+		return
+	}
+	st := apiStatus{UserName: u.Name}
+	if status, at, ok := getCurrentStatusForUserID(u.ID); ok {
+		st.Status, st.Since = status, at.Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+//---------------------------------------------------------------------
+// Departments
+//---------------------------------------------------------------------
+
+func apiListDepartments(w http.ResponseWriter, r *http.Request) {
+	writeList(w, r, convertAll(getDepartments(), toAPIDepartment))
+}
+
+func apiGetDepartment(w http.ResponseWriter, r *http.Request) {
+	d := getDepartment(r.PathValue("id"))
+	if d.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "department not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIDepartment(d))
+}
+
+func apiCreateDepartment(w http.ResponseWriter, r *http.Request) {
+	var in apiDepartment
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if strings.TrimSpace(in.Name) == "" {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "name is required")
+		return
+	}
+	id, err := createDepartment(in.Name)
+	if err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	sid := strconv.FormatInt(id, 10)
+	apiCreated(w, "/api/v1/departments/"+sid, toAPIDepartment(getDepartment(sid)))
+}
+
+func apiUpdateDepartment(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if getDepartment(id).ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "department not found")
+		return
+	}
+	var in apiDepartment
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if strings.TrimSpace(in.Name) == "" {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "name is required")
+		return
+	}
+	if err := updateDepartment(id, in.Name); err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIDepartment(getDepartment(id)))
+}
+
+func apiDeleteDepartment(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if getDepartment(id).ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "department not found")
+		return
+	}
+	if err := deleteDepartment(id); err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//---------------------------------------------------------------------
+// Activities
+//---------------------------------------------------------------------
+
+func apiListActivities(w http.ResponseWriter, r *http.Request) {
+	writeList(w, r, convertAll(getAllActivities(), toAPIActivity))
+}
+
+func apiGetActivity(w http.ResponseWriter, r *http.Request) {
+	a := getActivity(r.PathValue("id"))
+	if a.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "activity not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIActivity(a))
+}
+
+func (in apiActivityInput) apply(a *Activity) {
+	if in.Status != nil {
+		a.Status = *in.Status
+	}
+	if in.Work != nil {
+		a.Work = 0
+		if *in.Work {
+			a.Work = 1
+		}
+	}
+	if in.Comment != nil {
+		a.Comment = *in.Comment
+	}
+	if in.CommentRequired != nil {
+		a.CommentRequired = *in.CommentRequired
+	}
+	if in.Billable != nil {
+		a.Billable = *in.Billable
+	}
+	if in.Code != nil {
+		a.Code = strings.TrimSpace(*in.Code)
+	}
+}
+
+func apiCreateActivity(w http.ResponseWriter, r *http.Request) {
+	var in apiActivityInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	var a Activity
+	in.apply(&a)
+	if strings.TrimSpace(a.Status) == "" {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "status is required")
+		return
+	}
+	id, err := createActivity(a.Status, strconv.Itoa(a.Work), a.Comment, a.Code)
+	if err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	sid := strconv.FormatInt(id, 10)
+	setActivityCommentRequired(sid, a.CommentRequired)
+	setActivityBillable(sid, a.Billable)
+	apiCreated(w, "/api/v1/activities/"+sid, toAPIActivity(getActivity(sid)))
+}
+
+func apiUpdateActivity(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	a := getActivity(id)
+	if a.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "activity not found")
+		return
+	}
+	var in apiActivityInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	in.apply(&a)
+	if strings.TrimSpace(a.Status) == "" {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "status is required")
+		return
+	}
+	if err := updateActivity(id, a.Status, strconv.Itoa(a.Work), a.Comment, a.Code); err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	setActivityCommentRequired(id, a.CommentRequired)
+	setActivityBillable(id, a.Billable)
+	writeJSON(w, http.StatusOK, toAPIActivity(getActivity(id)))
+}
+
+func apiDeleteActivity(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if getActivity(id).ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "activity not found")
+		return
+	}
+	if err := deleteActivity(id); err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//---------------------------------------------------------------------
+// Entries and clocking
+//---------------------------------------------------------------------
+
+// apiListEntries supports the same filters as the entries download:
+// from, to (YYYY-MM-DD), department, user and activity (ids)
+func apiListEntries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	entries := getEntriesWithDetailsFiltered(q.Get("from"), q.Get("to"), q.Get("department"), q.Get("user"), q.Get("activity"), "")
+	writeList(w, r, convertAll(entries, func(e EntryDetail) apiEntry { return apiEntry(e) }))
+}
+
+func apiGetEntry(w http.ResponseWriter, r *http.Request) {
+	e := getEntry(r.PathValue("id"))
+	if e.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "entry not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, apiEntry(e))
+}
+
+func apiCreateEntry(w http.ResponseWriter, r *http.Request) {
+	var in apiEntryInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if in.UserID == nil || in.ActivityID == nil {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "userId and activityId are required")
+		return
+	}
+	at := time.Now()
+	if in.Timestamp != nil {
+		t, err := parseAPITime(*in.Timestamp)
+		if err != nil {
+			apiError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+			return
+		}
+		at = t
+	}
+	var details StampDetails
+	if in.Comment != nil {
+		details.Comment = *in.Comment
+	}
+	if in.ProjectID != nil {
+		details.ProjectID = *in.ProjectID
+	}
+	if in.TaskID != nil {
+		details.TaskID = *in.TaskID
+	}
+	reason := ""
+	if in.CorrectionReason != nil {
+		reason = *in.CorrectionReason
+	}
+	audit, ok := apiAuthorizeEntryChange(w, r, EntryDetail{}, strconv.Itoa(*in.UserID), at, reason)
+	if !ok {
+		return
+	}
+	id, status, err := apiStamp(*in.UserID, *in.ActivityID, at, details, false)
+	var rej *StampRejection
+	switch {
+	case errors.As(err, &rej):
+		apiError(w, status, rej.Code, rej.Message)
+		return
+	case err != nil:
+		apiError(w, status, "validation_failed", err.Error())
+		return
+	}
+	sid := strconv.FormatInt(id, 10)
+	e := getEntry(sid)
+	if audit {
+		recordEntryAudit(e.ID, e.UserID, "create", reason, principalFrom(r).Name, "", entrySummary(e))
+	}
+	apiCreated(w, "/api/v1/entries/"+sid, apiEntry(e))
+}
+
+// apiAuthorizeEntryChange applies authorizeEntryChange for the caller and
+// answers 409 period_locked when the change is not allowed
+func apiAuthorizeEntryChange(w http.ResponseWriter, r *http.Request, e EntryDetail, newUserID string, newDate time.Time, reason string) (audit, ok bool) {
+	p := principalFrom(r)
+	role := p.Role
+	if p.isAdmin() {
+		role = "admin"
+	}
+	audit, err := authorizeEntryChange(e, newUserID, newDate, role, reason)
+	var rej *StampRejection
+	if errors.As(err, &rej) {
+		apiError(w, http.StatusConflict, rej.Code, rej.Message)
+		return false, false
+	}
+	return audit, true
+}
+
+// apiStamp validates user and activity and records the entry. Live stamps go
+// through the stamp rules; a rejection is returned as *StampRejection with
+// 409 (422 for a missing required comment or a closed project), a stamp
+// merged into the current entry with 200. Callers check locked months of
+// other stamps with apiAuthorizeEntryChange.
+func apiStamp(userID, activityID int, at time.Time, details StampDetails, live bool) (int64, int, error) {
+	if u := getUser(strconv.Itoa(userID)); u.ID == 0 || u.Active == 0 {
+		return 0, http.StatusUnprocessableEntity, fmt.Errorf("unknown or inactive user %d", userID)
+	}
+	activity := getActivity(strconv.Itoa(activityID))
+	if activity.ID == 0 {
+		return 0, http.StatusUnprocessableEntity, fmt.Errorf("unknown activity %d", activityID)
+	}
+	check := checkStampDetails
+	if !live {
+		// corrections need no comment, but a valid project
+		check = func(_ Activity, d *StampDetails, at time.Time) error { return checkStampProject(d, at) }
+	}
+	if err := check(activity, &details, at); err != nil {
+		return 0, http.StatusUnprocessableEntity, err
+	}
+	if live {
+		id, merged, err := stampEntry(strconv.Itoa(userID), strconv.Itoa(activityID), at, 0, details)
+		var rej *StampRejection
+		switch {
+		case errors.As(err, &rej):
+			return 0, http.StatusConflict, err
+		case err != nil:
+			return 0, http.StatusInternalServerError, err
+		case merged:
+			return id, http.StatusOK, nil
+		}
+		return id, http.StatusCreated, nil
+	}
+	id, err := createEntryFrom(strconv.Itoa(userID), strconv.Itoa(activityID), at, 0, details)
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	return id, http.StatusCreated, nil
+}
+
+func apiUpdateEntry(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	e := getEntry(id)
+	if e.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "entry not found")
+		return
+	}
+	before := e
+	var in apiEntryInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if in.UserID != nil {
+		e.UserID = *in.UserID
+	}
+	if in.ActivityID != nil {
+		e.ActivityID = *in.ActivityID
+	}
+	if in.Comment != nil {
+		e.Comment = *in.Comment
+	}
+	ts := e.Date
+	if in.Timestamp != nil {
+		ts = *in.Timestamp
+	}
+	t, err := parseAPITime(ts)
+	if err != nil {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+	e.Date = t.Format("2006-01-02 15:04:05")
+	if getUser(strconv.Itoa(e.UserID)).ID == 0 || getActivity(strconv.Itoa(e.ActivityID)).ID == 0 {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "unknown user or activity")
+		return
+	}
+	d := StampDetails{ProjectID: e.ProjectID, TaskID: e.TaskID}
+	if in.ProjectID != nil || in.TaskID != nil {
+		if in.ProjectID != nil {
+			d.ProjectID, d.TaskID = *in.ProjectID, 0
+		}
+		if in.TaskID != nil {
+			d.TaskID = *in.TaskID
+		}
+		var rej *StampRejection
+		if err := checkStampProject(&d, t); errors.As(err, &rej) {
+			apiError(w, http.StatusUnprocessableEntity, rej.Code, rej.Message)
+			return
+		}
+	}
+	reason := ""
+	if in.CorrectionReason != nil {
+		reason = *in.CorrectionReason
+	}
+	audit, ok := apiAuthorizeEntryChange(w, r, before, strconv.Itoa(e.UserID), t, reason)
+	if !ok {
+		return
+	}
+	if err := updateEntry(id, strconv.Itoa(e.UserID), strconv.Itoa(e.ActivityID), e.Date, e.Comment, d.ProjectID, d.TaskID); err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	after := getEntry(id)
+	if audit {
+		recordEntryAudit(after.ID, after.UserID, "update", reason, principalFrom(r).Name, entrySummary(before), entrySummary(after))
+	}
+	writeJSON(w, http.StatusOK, apiEntry(after))
+}
+
+// apiDeleteEntry takes the correction reason for a locked month as ?reason=
+func apiDeleteEntry(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	e := getEntry(id)
+	if e.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "entry not found")
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	audit, ok := apiAuthorizeEntryChange(w, r, e, "", time.Time{}, reason)
+	if !ok {
+		return
+	}
+	if err := deleteEntry(id); err != nil {
+		apiStoreError(w, err)
+		return
+	}
+	if audit {
+		recordEntryAudit(e.ID, e.UserID, "delete", reason, principalFrom(r).Name, entrySummary(e), "")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type apiClockRequest struct {
+	UserID     int    `json:"userId"`
+	Stampkey   string `json:"stampkey"`
+	ActivityID int    `json:"activityId"`
+	Timestamp  string `json:"timestamp"`
+	Comment    string `json:"comment"`
+	ProjectID  int    `json:"projectId"`
+	TaskID     int    `json:"taskId"`
+}
+
+// apiClock stamps a user now. Callers without entries:write cannot back-date
+// and, unless they are a service token (terminal), may only stamp themselves.
+func apiClock(w http.ResponseWriter, r *http.Request) {
+	var in apiClockRequest
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	p := principalFrom(r)
+	if in.Stampkey != "" {
+		in.UserID = atoiDefault(getUserIDFromStampKey(in.Stampkey), 0)
+		if in.UserID == 0 {
+			apiError(w, http.StatusUnprocessableEntity, "unknown_card", "no active user with this stampkey")
+			return
+		}
+	}
+	if in.UserID == 0 {
+		in.UserID = p.UserID
+	}
+	if in.UserID == 0 || in.ActivityID == 0 {
+		apiError(w, http.StatusUnprocessableEntity, "validation_failed", "userId (or stampkey) and activityId are required")
+		return
+	}
+	privileged := p.can("entries:write")
+	if !privileged && !p.Service && in.UserID != p.UserID {
+		apiError(w, http.StatusForbidden, "forbidden", "you can only stamp yourself")
+		return
+	}
+	at := time.Now()
+	if in.Timestamp != "" {
+		if !privileged {
+			apiError(w, http.StatusForbidden, "forbidden", "back-dating requires entries:write")
+			return
+		}
+		t, err := parseAPITime(in.Timestamp)
+		if err != nil {
+			apiError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+			return
+		}
+		at = t
+	}
+	// back-dated stamps are corrections and skip the stamp rules, but not
+	// the lock of a closed timesheet month
+	if in.Timestamp != "" {
+		if _, ok := apiAuthorizeEntryChange(w, r, EntryDetail{}, strconv.Itoa(in.UserID), at, ""); !ok {
+			return
+		}
+	}
+	details := StampDetails{Comment: in.Comment, ProjectID: in.ProjectID, TaskID: in.TaskID}
+	id, status, err := apiStamp(in.UserID, in.ActivityID, at, details, in.Timestamp == "")
+	var rej *StampRejection
+	switch {
+	case errors.As(err, &rej):
+		apiError(w, status, rej.Code, rej.Message)
+		return
+	case err != nil:
+		apiError(w, status, "validation_failed", err.Error())
+		return
+	}
+	sid := strconv.FormatInt(id, 10)
+	if status == http.StatusOK {
+		writeJSON(w, http.StatusOK, apiEntry(getEntry(sid)))
+		return
+	}
+	apiCreated(w, "/api/v1/entries/"+sid, apiEntry(getEntry(sid)))
+}
+
+func apiCurrentStatus(w http.ResponseWriter, r *http.Request) {
+	writeList(w, r, convertAll(getCurrentStatusData(), func(c CurrentStatusData) apiStatus {
+		return apiStatus{UserName: c.UserName, Status: c.Status, Since: c.Date}
+	}))
+}
+
+//---------------------------------------------------------------------
+// Reports
+//---------------------------------------------------------------------
+
+// apiWorkHoursReport filters by from, to and user (name or id)
+func apiWorkHoursReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	if id, err := strconv.Atoi(user); err == nil {
+		user = getUser(strconv.Itoa(id)).Name
+	}
+	rows := getWorkHoursDataFiltered(q.Get("from"), q.Get("to"), user, "")
+	writeList(w, r, convertAll(rows, func(x WorkHoursData) apiWorkHours { return apiWorkHours(x) }))
+}
+
+// apiDepartmentReport returns totals per department, or for a single ?day=YYYY-MM-DD
+func apiDepartmentReport(w http.ResponseWriter, r *http.Request) {
+	rows := getDepartmentSummary()
+	if day := r.URL.Query().Get("day"); day != "" {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_parameter", "day must be YYYY-MM-DD")
+			return
+		}
+		rows = getDepartmentSummaryOnDay(day)
+	}
+	writeList(w, r, convertAll(rows, func(x DepartmentSummary) apiDepartmentSummary { return apiDepartmentSummary(x) }))
+}
+
+// apiListProjects lists all projects; ?active=true only those open for stamping today
+func apiListProjects(w http.ResponseWriter, r *http.Request) {
+	list := getProjects()
+	if r.URL.Query().Get("active") == "true" {
+		list = stampProjects(time.Now())
+	}
+	writeList(w, r, convertAll(list, toAPIProject))
+}
+
+func apiGetProject(w http.ResponseWriter, r *http.Request) {
+	p := getProject(r.PathValue("id"))
+	if p.ID == 0 {
+		apiError(w, http.StatusNotFound, "not_found", "project not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIProject(p))
+}
+
+// apiProjectReport returns hours per project, user and ISO week between from and to
+func apiProjectReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.AddDate(0, 0, -7*12)
+	if s := q.Get("from"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_parameter", "from must be YYYY-MM-DD")
+			return
+		}
+		from = t
+	}
+	if s := q.Get("to"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_parameter", "to must be YYYY-MM-DD")
+			return
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	writeList(w, r, projectHours(from, to, atoiDefault(q.Get("project"), 0)))
+}
+
+// apiBillingReport returns the invoice line items of a period, optionally for one ?client=
+func apiBillingReport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := billingPeriod(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	writeList(w, r, invoiceLines(from, to, r.URL.Query().Get("client")))
+}
+
+func apiTrendsReport(w http.ResponseWriter, r *http.Request) {
+	days := atoiDefault(r.URL.Query().Get("days"), 30)
+	if days < 1 || days > 366 {
+		apiError(w, http.StatusBadRequest, "invalid_parameter", "days must be between 1 and 366")
+		return
+	}
+	writeList(w, r, convertAll(getTimeTrackingTrends(days), func(x TimeTrackingTrend) apiTrend { return apiTrend(x) }))
+}
+
+//---------------------------------------------------------------------
+// Routing
+//---------------------------------------------------------------------
+
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(openAPISpec)
+	})
+
+	mux.Handle("GET /api/v1/users", apiAuth("users:read", apiListUsers))
+	mux.Handle("POST /api/v1/users", apiAuth("users:write", apiCreateUser))
+	mux.Handle("GET /api/v1/users/{id}", apiAuth("users:read", apiGetUser))
+	mux.Handle("PUT /api/v1/users/{id}", apiAuth("users:write", apiUpdateUser))
+	mux.Handle("DELETE /api/v1/users/{id}", apiAuth("users:write", apiDeleteUser))
+	mux.Handle("GET /api/v1/users/{id}/status", apiAuth("status:read", apiUserStatus))
+
+	mux.Handle("GET /api/v1/departments", apiAuth("departments:read", apiListDepartments))
+	mux.Handle("POST /api/v1/departments", apiAuth("departments:write", apiCreateDepartment))
+	mux.Handle("GET /api/v1/departments/{id}", apiAuth("departments:read", apiGetDepartment))
+	mux.Handle("PUT /api/v1/departments/{id}", apiAuth("departments:write", apiUpdateDepartment))
+	mux.Handle("DELETE /api/v1/departments/{id}", apiAuth("departments:write", apiDeleteDepartment))
+
+	mux.Handle("GET /api/v1/activities", apiAuth("activities:read", apiListActivities))
+	mux.Handle("POST /api/v1/activities", apiAuth("activities:write", apiCreateActivity))
+	mux.Handle("GET /api/v1/activities/{id}", apiAuth("activities:read", apiGetActivity))
+	mux.Handle("PUT /api/v1/activities/{id}", apiAuth("activities:write", apiUpdateActivity))
+	mux.Handle("DELETE /api/v1/activities/{id}", apiAuth("activities:write", apiDeleteActivity))
+
+	mux.Handle("GET /api/v1/entries", apiAuth("entries:read", apiListEntries))
+	mux.Handle("POST /api/v1/entries", apiAuth("entries:write", apiCreateEntry))
+	mux.Handle("GET /api/v1/entries/{id}", apiAuth("entries:read", apiGetEntry))
+	mux.Handle("PUT /api/v1/entries/{id}", apiAuth("entries:write", apiUpdateEntry))
+	mux.Handle("DELETE /api/v1/entries/{id}", apiAuth("entries:write", apiDeleteEntry))
+
+	mux.Handle("POST /api/v1/clock", apiAuth("clock:write", apiClock))
+	mux.Handle("GET /api/v1/status", apiAuth("status:read", apiCurrentStatus))
+
+	mux.Handle("GET /api/v1/reports/work-hours", apiAuth("reports:read", apiWorkHoursReport))
+	mux.Handle("GET /api/v1/reports/departments", apiAuth("reports:read", apiDepartmentReport))
+	mux.Handle("GET /api/v1/reports/trends", apiAuth("reports:read", apiTrendsReport))
+	mux.Handle("GET /api/v1/reports/projects", apiAuth("reports:read", apiProjectReport))
+	mux.Handle("GET /api/v1/reports/billing", apiAuth("reports:read", apiBillingReport))
+
+	mux.Handle("GET /api/v1/projects", apiAuth("projects:read", apiListProjects))
+	mux.Handle("GET /api/v1/projects/{id}", apiAuth("projects:read", apiGetProject))
+
+	// anything else below /api/ answers in JSON instead of redirecting to the login page
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, http.StatusNotFound, "not_found", "no such endpoint: "+r.Method+" "+r.URL.Path)
+	})
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Billing: hours stamped on a billable activity and booked to a project are
+// billed to the project's client. The hourly rate is the most specific
+// billing rate matching project, user and activity; the cost center is the
+// project's, otherwise the user's.
+
+// BillingConfig is the tenant's "billing" block for invoice drafts
+type BillingConfig struct {
+	Currency   string   `json:"currency"`   // default EUR
+	VATPercent *float64 `json:"vatPercent"` // default 19
+	Issuer     []string `json:"issuer"`     // sender lines on the invoice draft
+}
+
+func (c BillingConfig) currency() string {
+	if c.Currency == "" {
+		return "EUR"
+	}
+	return c.Currency
+}
+
+func (c BillingConfig) vatPercent() float64 {
+	if c.VATPercent == nil {
+		return 19
+	}
+	return *c.VATPercent
+}
+
+// CostCenter is an internal cost center users and projects can belong to
+type CostCenter struct {
+	ID   int
+	Code string
+	Name string
+}
+
+func (c CostCenter) Label() string {
+	return c.Code + " " + c.Name
+}
+
+// BillingRate is an hourly rate; 0 in UserID, ActivityID or ProjectID matches any
+type BillingRate struct {
+	ID         int
+	UserID     int
+	ActivityID int
+	ProjectID  int
+	Rate       float64
+
+	User, Activity, Project string // for display
+}
+
+func (b BillingRate) matches(userID, activityID, projectID int) bool {
+	return (b.UserID == 0 || b.UserID == userID) &&
+		(b.ActivityID == 0 || b.ActivityID == activityID) &&
+		(b.ProjectID == 0 || b.ProjectID == projectID)
+}
+
+// weight ranks matching rates: a project rate beats a user rate beats an
+// activity rate, and combinations beat their parts
+func (b BillingRate) weight() int {
+	w := 0
+	if b.ProjectID != 0 {
+		w += 4
+	}
+	if b.UserID != 0 {
+		w += 2
+	}
+	if b.ActivityID != 0 {
+		w++
+	}
+	return w
+}
+
+// resolveRate picks the most specific rate; ok is false when none matches
+func resolveRate(rates []BillingRate, userID, activityID, projectID int) (rate float64, ok bool) {
+	best := -1
+	for _, b := range rates {
+		if b.matches(userID, activityID, projectID) && b.weight() > best {
+			best, rate = b.weight(), b.Rate
+		}
+	}
+	return rate, best >= 0
+}
+
+var errDuplicateRate = errors.New("rate exists")
+
+func getCostCenters() []CostCenter {
+	db := getDB()
+	defer db.Close()
+	rows, err := db.Query(fmt.Sprintf("SELECT id, code, name FROM %s ORDER BY code", tbl("cost_centers")))
+	if err != nil {
+		log.Printf("getCostCenters query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var list []CostCenter
+	for rows.Next() {
+		var c CostCenter
+		if err := rows.Scan(&c.ID, &c.Code, &c.Name); err != nil {
+			log.Printf("getCostCenters scan failed: %v", err)
+			continue
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+func createCostCenter(code, name string) error {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("INSERT INTO %s (code, name) VALUES (@code, @name)", tbl("cost_centers"))
+	_, err := db.Exec(query, sql.Named("code", code), sql.Named("name", name))
+	if err != nil {
+		log.Printf("createCostCenter failed: %v", err)
+	}
+	return err
+}
+
+// deleteCostCenter removes a cost center; users and projects lose it
+func deleteCostCenter(id string) {
+	db := getDB()
+	defer db.Close()
+	for _, t := range []string{"users", "projects"} {
+		query := fmt.Sprintf("UPDATE %s SET cost_center_id=NULL WHERE cost_center_id=@id", tbl(t))
+		if _, err := db.Exec(query, sql.Named("id", id)); err != nil {
+			log.Printf("deleteCostCenter %s failed: %v", t, err)
+		}
+	}
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("cost_centers")), sql.Named("id", id)); err != nil {
+		log.Printf("deleteCostCenter failed: %v", err)
+	}
+}
+
+// getUserCostCenter returns the user's cost center id, 0 for none
+func getUserCostCenter(userID string) int {
+	db := getDB()
+	defer db.Close()
+	var v sql.NullInt64
+	query := fmt.Sprintf("SELECT cost_center_id FROM %s WHERE id=@id", tbl("users"))
+	if err := db.QueryRow(query, sql.Named("id", userID)).Scan(&v); err != nil {
+		return 0
+	}
+	return int(v.Int64)
+}
+
+func setUserCostCenter(userID, costCenterID string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET cost_center_id=@cc WHERE id=@id", tbl("users"))
+	if _, err := db.Exec(query, sql.Named("cc", refValue(atoiDefault(costCenterID, 0))), sql.Named("id", userID)); err != nil {
+		log.Printf("setUserCostCenter failed: %v", err)
+	}
+}
+
+func getBillingRates() []BillingRate {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`SELECT b.id, COALESCE(b.user_id, 0), COALESCE(b.activity_id, 0), COALESCE(b.project_id, 0), b.rate,
+		COALESCE(u.name, ''), COALESCE(t.status, ''), COALESCE(p.name, '')
+		FROM %s b
+		LEFT JOIN %s u ON u.id = b.user_id
+		LEFT JOIN %s t ON t.id = b.activity_id
+		LEFT JOIN %s p ON p.id = b.project_id`, tbl("billing_rates"), tbl("users"), tbl("type"), tbl("projects"))
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Printf("getBillingRates query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var list []BillingRate
+	for rows.Next() {
+		var b BillingRate
+		if err := rows.Scan(&b.ID, &b.UserID, &b.ActivityID, &b.ProjectID, &b.Rate, &b.User, &b.Activity, &b.Project); err != nil {
+			log.Printf("getBillingRates scan failed: %v", err)
+			continue
+		}
+		list = append(list, b)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].weight() > list[j].weight() })
+	return list
+}
+
+// addBillingRate stores a rate; each combination of user, activity and project has one rate
+func addBillingRate(b BillingRate) error {
+	for _, o := range getBillingRates() {
+		if o.UserID == b.UserID && o.ActivityID == b.ActivityID && o.ProjectID == b.ProjectID {
+			return errDuplicateRate
+		}
+	}
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("INSERT INTO %s (user_id, activity_id, project_id, rate) VALUES (@uid, @aid, @pid, @rate)", tbl("billing_rates"))
+	_, err := db.Exec(query, sql.Named("uid", refValue(b.UserID)), sql.Named("aid", refValue(b.ActivityID)),
+		sql.Named("pid", refValue(b.ProjectID)), sql.Named("rate", b.Rate))
+	if err != nil {
+		log.Printf("addBillingRate failed: %v", err)
+	}
+	return err
+}
+
+func deleteBillingRate(id string) {
+	db := getDB()
+	defer db.Close()
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("billing_rates")), sql.Named("id", id)); err != nil {
+		log.Printf("deleteBillingRate failed: %v", err)
+	}
+}
+
+//---------------------------------------------------------------------
+// Invoice line items
+//---------------------------------------------------------------------
+
+// InvoiceLine is the billable time of one user on one project with one
+// activity at one rate
+type InvoiceLine struct {
+	Client      string  `json:"client"`
+	ProjectID   int     `json:"projectId"`
+	Project     string  `json:"project"`
+	CostCenter  string  `json:"costCenter"`
+	Activity    string  `json:"activity"`
+	UserName    string  `json:"userName"`
+	Description string  `json:"description"`
+	Hours       float64 `json:"hours"` // rounded to 0.01 h
+	Rate        float64 `json:"rate"`  // 0: no matching billing rate
+	Amount      float64 `json:"amount"`
+}
+
+// invoiceLines collects the billable hours between from and to, optionally
+// for one client, from the same spans as the project reports.
+func invoiceLines(from, to time.Time, client string) []InvoiceLine {
+	rates := getBillingRates()
+	type key struct {
+		project, user, activity int
+		rate                    float64
+	}
+	sums := map[key]*InvoiceLine{}
+	var order []key
+	walkProjectSpans(from, to, func(s projectStamp, hours float64) {
+		if !s.Billable || (client != "" && s.Client != client) {
+			return
+		}
+		rate, _ := resolveRate(rates, s.UserID, s.ActivityID, s.ProjectID)
+		k := key{s.ProjectID, s.UserID, s.ActivityID, rate}
+		if sums[k] == nil {
+			sums[k] = &InvoiceLine{Client: s.Client, ProjectID: s.ProjectID, Project: s.Project,
+				CostCenter: s.CostCenter, Activity: s.Activity, UserName: s.UserName,
+				Description: s.Activity + " – " + s.UserName, Rate: rate}
+			order = append(order, k)
+		}
+		sums[k].Hours += hours
+	})
+
+	list := make([]InvoiceLine, 0, len(order))
+	for _, k := range order {
+		l := *sums[k]
+		l.Hours = math.Round(l.Hours*100) / 100
+		l.Amount = math.Round(l.Hours*l.Rate*100) / 100
+		list = append(list, l)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		return a.Description < b.Description
+	})
+	return list
+}
+
+// Invoice is the draft for one client
+type Invoice struct {
+	Client string
+	Lines  []InvoiceLine
+	Hours  float64
+	Net    float64
+	VAT    float64
+	Gross  float64
+	// MissingRates counts lines without a billing rate
+	MissingRates int
+}
+
+// groupInvoices splits line items into one invoice per client
+func groupInvoices(lines []InvoiceLine, vatPercent float64) []Invoice {
+	var list []Invoice
+	for _, l := range lines {
+		if len(list) == 0 || list[len(list)-1].Client != l.Client {
+			list = append(list, Invoice{Client: l.Client})
+		}
+		inv := &list[len(list)-1]
+		inv.Lines = append(inv.Lines, l)
+		inv.Hours += l.Hours
+		inv.Net += l.Amount
+		if l.Rate == 0 {
+			inv.MissingRates++
+		}
+	}
+	for i := range list {
+		list[i].VAT = math.Round(list[i].Net*vatPercent) / 100
+		list[i].Gross = list[i].Net + list[i].VAT
+	}
+	return list
+}
+
+// billingPeriod reads from/to (YYYY-MM-DD, to inclusive); the default is the previous month
+func billingPeriod(r *http.Request) (from, to time.Time, err error) {
+	now := time.Now()
+	from = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.Local)
+	to = from.AddDate(0, 1, 0)
+	q := r.URL.Query()
+	if s := q.Get("from"); s != "" {
+		if from, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return from, to, errors.New("from must be YYYY-MM-DD")
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		t, perr := time.ParseInLocation("2006-01-02", s, time.Local)
+		if perr != nil {
+			return from, to, errors.New("to must be YYYY-MM-DD")
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+//---------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------
+
+// billingHandler manages cost centers and billing rates
+func billingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "add_cost_center":
+			code := strings.TrimSpace(r.FormValue("code"))
+			name := strings.TrimSpace(r.FormValue("name"))
+			if code == "" || name == "" {
+				http.Error(w, "Nummer und Bezeichnung angeben.", http.StatusBadRequest)
+				return
+			}
+			if err := createCostCenter(code, name); err != nil {
+				http.Error(w, "Kostenstelle existiert bereits.", http.StatusConflict)
+				return
+			}
+		case "delete_cost_center":
+			deleteCostCenter(r.FormValue("id"))
+		case "add_rate":
+			rate, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(r.FormValue("rate")), ",", "."), 64)
+			if err != nil || rate < 0 {
+				http.Error(w, "Stundensatz muss eine positive Zahl sein.", http.StatusBadRequest)
+				return
+			}
+			b := BillingRate{
+				UserID:     atoiDefault(r.FormValue("user_id"), 0),
+				ActivityID: atoiDefault(r.FormValue("activity_id"), 0),
+				ProjectID:  atoiDefault(r.FormValue("project_id"), 0),
+				Rate:       rate,
+			}
+			if err := addBillingRate(b); err != nil {
+				if errors.Is(err, errDuplicateRate) {
+					http.Error(w, "Für diese Kombination gibt es bereits einen Satz; bitte zuerst löschen.", http.StatusConflict)
+					return
+				}
+				http.Error(w, "Speichern fehlgeschlagen.", http.StatusInternalServerError)
+				return
+			}
+		case "delete_rate":
+			deleteBillingRate(r.FormValue("id"))
+		}
+		http.Redirect(w, r, "/admin/billing", http.StatusSeeOther)
+		return
+	}
+	cfg := loadTenantConfig(boundHost()).Billing
+	renderTemplate(w, r, "billing", map[string]any{
+		"CostCenters": getCostCenters(),
+		"Rates":       getBillingRates(),
+		"Users":       getAllUsers(),
+		"Activities":  getActivities(),
+		"Projects":    getProjects(),
+		"Currency":    cfg.currency(),
+	})
+}
+
+// invoiceHandler renders a printable invoice draft per client for a period
+func invoiceHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := billingPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg := loadTenantConfig(boundHost()).Billing
+	client := r.URL.Query().Get("client")
+	last := to.AddDate(0, 0, -1)
+	renderTemplate(w, r, "invoice", map[string]any{
+		"Invoices":   groupInvoices(invoiceLines(from, to, client), cfg.vatPercent()),
+		"Client":     client,
+		"From":       from.Format("02.01.2006"),
+		"To":         last.Format("02.01.2006"),
+		"FromISO":    from.Format("2006-01-02"),
+		"ToISO":      last.Format("2006-01-02"),
+		"Date":       time.Now().Format("02.01.2006"),
+		"Currency":   cfg.currency(),
+		"VATPercent": cfg.vatPercent(),
+		"Issuer":     cfg.Issuer,
+	})
+}
+
+// downloadInvoiceLines exports the invoice line items of a period as CSV or JSON;
+// from/to are dates (default: the previous month), client is optional
+func downloadInvoiceLines(w http.ResponseWriter, r *http.Request) {
+	from, to, err := billingPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lines := invoiceLines(from, to, r.URL.Query().Get("client"))
+	timestamp := time.Now().Format("2006-01-02_15-04-05")
+
+	switch r.URL.Query().Get("format") {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=invoice_lines_%s.json", timestamp))
+		json.NewEncoder(w).Encode(lines)
+	default: // csv
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=invoice_lines_%s.csv", timestamp))
+		enc := csv.NewWriter(w)
+		_ = enc.Write([]string{"Client", "Project", "Cost Center", "Activity", "User", "Hours", "Rate", "Amount"})
+		for _, l := range lines {
+			enc.Write([]string{l.Client, l.Project, l.CostCenter, l.Activity, l.UserName,
+				strconv.FormatFloat(l.Hours, 'f', 2, 64), strconv.FormatFloat(l.Rate, 'f', 2, 64), strconv.FormatFloat(l.Amount, 'f', 2, 64)})
+		}
+		enc.Flush()
+	}
+}
+
+// clients lists the distinct clients of all projects
+func clients(projects []Project) []string {
+	var list []string
+	for _, p := range projects {
+		if p.Client != "" && !slices.Contains(list, p.Client) {
+			list = append(list, p.Client)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
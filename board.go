@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Live attendance board. Every recorded stamp notifies the statusBroker for
+// the tenant (host); connected /board/events streams then send a fresh
+// snapshot. Snapshots are computed on the subscriber's request goroutine, so
+// each stream only ever reads its own tenant database.
+const (
+	boardKeepAlive      = 25 * time.Second
+	boardRefresh        = 5 * time.Minute // catches day changes without stamps
+	boardPresentMaxSpan = 16 * time.Hour  // a work stamp older than this counts as absent
+)
+
+type statusBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{} // host -> subscribers
+}
+
+var boardBroker = &statusBroker{subs: map[string]map[chan struct{}]struct{}{}}
+
+func (b *statusBroker) subscribe(host string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[host] == nil {
+		b.subs[host] = map[chan struct{}]struct{}{}
+	}
+	b.subs[host][ch] = struct{}{}
+	return ch
+}
+
+func (b *statusBroker) unsubscribe(host string, ch chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[host], ch)
+	if len(b.subs[host]) == 0 {
+		delete(b.subs, host)
+	}
+}
+
+// publish wakes all subscribers of host; pending wake-ups are coalesced
+func (b *statusBroker) publish(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for h, subs := range b.subs {
+		// MSSQL tenants share one database, so every board may be affected
+		if h != host && dbBackend == "sqlite" {
+			continue
+		}
+		for ch := range subs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// notifyStatusChange tells the boards of the current tenant that stamps changed
+func notifyStatusChange() {
+	boardBroker.publish(boundHost())
+}
+
+//---------------------------------------------------------------------
+// Board data
+//---------------------------------------------------------------------
+
+type BoardPerson struct {
+	Name     string `json:"name"`
+	State    string `json:"state"` // present, break, absent
+	Activity string `json:"activity"`
+	Since    string `json:"since,omitempty"` // RFC 3339
+}
+
+type BoardDepartment struct {
+	Name    string        `json:"name"`
+	Present int           `json:"present"`
+	Break   int           `json:"break"`
+	Absent  int           `json:"absent"`
+	People  []BoardPerson `json:"people"`
+}
+
+type AttendanceBoard struct {
+	UpdatedAt   string            `json:"updatedAt"`
+	Present     int               `json:"present"`
+	Break       int               `json:"break"`
+	Absent      int               `json:"absent"`
+	Departments []BoardDepartment `json:"departments"`
+}
+
+type lastStamp struct {
+	At       time.Time
+	Activity string
+	Work     bool
+}
+
+// getLastStamps returns the latest entry per user
+func getLastStamps() map[int]lastStamp {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf(`SELECT e.user_id, e.date, t.status, t.work
+		FROM %s e
+		JOIN (SELECT user_id, MAX(date) AS latest FROM %s GROUP BY user_id) l ON l.user_id = e.user_id AND l.latest = e.date
+		JOIN %s t ON t.id = e.type_id`, tbl("entries"), tbl("entries"), tbl("type"))
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Printf("getLastStamps query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	stamps := map[int]lastStamp{}
+	for rows.Next() {
+		var uid, work int
+		var s lastStamp
+		if err := rows.Scan(&uid, &s.At, &s.Activity, &work); err != nil {
+			log.Printf("getLastStamps scan failed: %v", err)
+			continue
+		}
+		s.Work = work == 1
+		stamps[uid] = s
+	}
+	return stamps
+}
+
+// boardState classifies a user's last stamp. Non-work activities called
+// "Break"/"Pause" count as break on the same day, anything else as absent.
+func boardState(s lastStamp, ok bool, now time.Time) string {
+	switch {
+	case !ok:
+		return "absent"
+	case s.Work && now.Sub(s.At) < boardPresentMaxSpan:
+		return "present"
+	case !s.Work && sameDay(s.At, now) && isBreakActivity(s.Activity):
+		return "break"
+	}
+	return "absent"
+}
+
+func isBreakActivity(name string) bool {
+	n := strings.ToLower(name)
+	return strings.Contains(n, "break") || strings.Contains(n, "pause")
+}
+
+func sameDay(a, b time.Time) bool {
+	a, b = a.In(time.Local), b.In(time.Local)
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+func getAttendanceBoard() AttendanceBoard {
+	now := time.Now()
+	deptNames := map[int]string{}
+	for _, d := range getDepartments() {
+		deptNames[d.ID] = d.Name
+	}
+	stamps := getLastStamps()
+
+	byDept := map[string]*BoardDepartment{}
+	board := AttendanceBoard{UpdatedAt: now.Format(time.RFC3339)}
+	for _, u := range getAllUsers() {
+		if u.Active == 0 {
+			continue
+		}
+		name := deptNames[u.DepartmentID]
+		if name == "" {
+			name = "Ohne Abteilung"
+		}
+		d := byDept[name]
+		if d == nil {
+			d = &BoardDepartment{Name: name}
+			byDept[name] = d
+		}
+		s, ok := stamps[u.ID]
+		p := BoardPerson{Name: u.Name, State: boardState(s, ok, now)}
+		if ok {
+			p.Activity, p.Since = s.Activity, s.At.Format(time.RFC3339)
+		}
+		switch p.State {
+		case "present":
+			d.Present++
+			board.Present++
+		case "break":
+			d.Break++
+			board.Break++
+		default:
+			d.Absent++
+			board.Absent++
+		}
+		d.People = append(d.People, p)
+	}
+
+	rank := map[string]int{"present": 0, "break": 1, "absent": 2}
+	for _, d := range byDept {
+		sort.SliceStable(d.People, func(i, j int) bool {
+			if rank[d.People[i].State] != rank[d.People[j].State] {
+				return rank[d.People[i].State] < rank[d.People[j].State]
+			}
+			return d.People[i].Name < d.People[j].Name
+		})
+		board.Departments = append(board.Departments, *d)
+	}
+	sort.Slice(board.Departments, func(i, j int) bool { return board.Departments[i].Name < board.Departments[j].Name })
+	return board
+}
+
+//---------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------
+
+// boardHandler renders the board page; ?wall=1 switches to the fullscreen wallboard
+func boardHandler(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, r, "board", map[string]any{
+		"Wall":  r.URL.Query().Get("wall") == "1",
+		"Token": r.URL.Query().Get("access_token"),
+	})
+}
+
+// boardEventsHandler streams board snapshots as Server-Sent Events
+func boardEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx: do not buffer the stream
+
+	host := requestHost(r)
+	ch := boardBroker.subscribe(host)
+	defer boardBroker.unsubscribe(host, ch)
+
+	send := func() bool {
+		data, err := json.Marshal(getAttendanceBoard())
+		if err != nil {
+			log.Printf("board snapshot encoding failed: %v", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: board\ndata: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	if !send() {
+		return
+	}
+
+	keepAlive := time.NewTicker(boardKeepAlive)
+	defer keepAlive.Stop()
+	refresh := time.NewTicker(boardRefresh)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			if !send() {
+				return
+			}
+		case <-refresh.C:
+			if !send() {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// boardAuth accepts a login session or an API token with status:read; the
+// token may be passed as ?access_token= because wallboard browsers and
+// EventSource cannot send an Authorization header
+func boardAuth(users map[string]AuthUser, next http.Handler) http.Handler {
+	h := bearerOrSession("status:read", func(h http.Handler) http.Handler { return basicAuthMiddleware(users, h) }, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := r.URL.Query().Get("access_token"); t != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+t)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bulk clocking: one activity barcode followed by any number of user cards.
+// All cards are looked up, checked against the stamp rules and inserted in
+// one transaction, and every card gets its own outcome in the response.
+// With "atomic" nothing is recorded unless every card can be stamped.
+// Terminals send an Idempotency-Key header (or "idempotencyKey") so a retry
+// after a lost response replays the stored result instead of stamping twice.
+
+const (
+	bulkClockMaxCodes = 500
+	idempotencyKeep   = 24 * time.Hour
+)
+
+// BulkClockResult is the outcome for one scanned user card
+type BulkClockResult struct {
+	Code string `json:"code"`
+	// stamped, merged, unknown_card, duplicate, debounced, repeated_status,
+	// transition_not_allowed, failed or rolled_back (atomic batch not recorded)
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+	UserID  int    `json:"userId,omitempty"`
+	Name    string `json:"name,omitempty"`
+	EntryID int64  `json:"entryId,omitempty"`
+}
+
+// BulkClockResponse is returned by /bulkClock
+type BulkClockResponse struct {
+	Activity string            `json:"activity"`
+	Atomic   bool              `json:"atomic"`
+	Recorded bool              `json:"recorded"`
+	Stamped  int               `json:"stamped"`
+	Failed   int               `json:"failed"`
+	Results  []BulkClockResult `json:"results"`
+}
+
+func (r BulkClockResult) ok() bool {
+	return r.Result == "stamped" || r.Result == "merged"
+}
+
+// recordBulkClock stamps all cards of a batch inside one transaction. When
+// key is set, the response is stored with the entries so that it commits
+// (or not) together with them.
+func recordBulkClock(activity Activity, req BulkClockRequest, key, hash string, terminalID int) (BulkClockResponse, int, error) {
+	resp := BulkClockResponse{Activity: activity.Status, Atomic: req.Atomic, Results: []BulkClockResult{}}
+
+	db := getDB()
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return resp, 0, err
+	}
+	defer tx.Rollback()
+
+	insert := fmt.Sprintf(`INSERT INTO %s (date, type_id, user_id, terminal_id, comment, project_id, task_id)
+	                       VALUES (@date, @aid, @uid, @tid, @comment, @pid, @task)`, tbl("entries"))
+	comment := strings.TrimSpace(req.Comment)
+	now := time.Now()
+	seen := map[string]bool{}
+	var stamped []BulkClockResult
+	for _, raw := range req.UserCodes {
+		item := BulkClockResult{Code: strings.TrimSpace(raw)}
+		userID, name := stampKeyUser(tx, scannedCode(item.Code, "USR"))
+		item.UserID, item.Name = atoiDefault(userID, 0), name
+		if userID == "" {
+			item.Result = "unknown_card"
+			resp.Results = append(resp.Results, item)
+			continue
+		}
+		if seen[userID] {
+			item.Result, item.Message = "duplicate", "Ausweis mehrfach im Stapel."
+			resp.Results = append(resp.Results, item)
+			continue
+		}
+		seen[userID] = true
+
+		if err := lockUserStamps(tx, userID); err != nil {
+			return resp, 0, err
+		}
+		ensureMidnightAutoCheckoutWithDB(tx, item.UserID, now)
+		existing, err := checkStamp(tx, userID, activity, now, StampDetails{ProjectID: req.ProjectID, TaskID: req.TaskID})
+		var rej *StampRejection
+		switch {
+		case errors.As(err, &rej):
+			item.Result, item.Message = rej.Code, rej.Message
+		case err != nil:
+			item.Result, item.Message = "failed", stampErrorMessage(err)
+		case existing != 0:
+			item.Result, item.EntryID = "merged", existing
+		default:
+			id, err := insertID(tx, insert, sql.Named("date", now), sql.Named("aid", activity.ID), sql.Named("uid", userID), sql.Named("tid", terminalIDValue(terminalID)), sql.Named("comment", comment),
+				sql.Named("pid", refValue(req.ProjectID)), sql.Named("task", refValue(req.TaskID)))
+			if err != nil {
+				log.Printf("bulkClock insert for user %s failed: %v", userID, err)
+				item.Result, item.Message = "failed", "Stempeln fehlgeschlagen."
+				break
+			}
+			item.Result, item.EntryID = "stamped", id
+			stamped = append(stamped, item)
+		}
+		resp.Results = append(resp.Results, item)
+	}
+
+	for _, item := range resp.Results {
+		if item.ok() {
+			resp.Stamped++
+		} else {
+			resp.Failed++
+		}
+	}
+	if req.Atomic && resp.Failed > 0 {
+		// nothing is committed; a retry with the same key runs again
+		for i := range resp.Results {
+			if resp.Results[i].ok() {
+				resp.Results[i].Result, resp.Results[i].EntryID = "rolled_back", 0
+			}
+		}
+		resp.Stamped = 0
+		return resp, http.StatusConflict, nil
+	}
+
+	resp.Recorded = true
+	if key != "" {
+		body, err := json.Marshal(resp)
+		if err != nil {
+			return resp, 0, err
+		}
+		if err := storeIdempotentResponse(tx, key, "bulkClock", hash, http.StatusOK, body); err != nil {
+			return resp, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return resp, 0, err
+	}
+
+	if len(stamped) > 0 {
+		notifyStatusChange()
+	}
+	for _, item := range stamped {
+		emitEntryEvent("entry.created", item.EntryID)
+		checkDailyHours(strconv.Itoa(item.UserID), now)
+	}
+	return resp, http.StatusOK, nil
+}
+
+// bulkClockHandler records a batch of scanned user cards for one activity
+func bulkClockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Bad payload", http.StatusBadRequest)
+		return
+	}
+	var req BulkClockRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		http.Error(w, "Bad payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.UserCodes) == 0 {
+		http.Error(w, "No user codes", http.StatusBadRequest)
+		return
+	}
+	if len(req.UserCodes) > bulkClockMaxCodes {
+		http.Error(w, fmt.Sprintf("Too many user codes (max %d)", bulkClockMaxCodes), http.StatusBadRequest)
+		return
+	}
+
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if key == "" {
+		key = strings.TrimSpace(req.IdempotencyKey)
+	}
+	if len(key) > 128 {
+		http.Error(w, "Idempotency key too long", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(payload)
+	hash := hex.EncodeToString(sum[:])
+	if key != "" && replayIdempotentResponse(w, key, "bulkClock", hash) {
+		return
+	}
+
+	activity, ok := getActivityByScan(req.ActivityCode)
+	if !ok {
+		http.Error(w, "Unknown activity code", http.StatusBadRequest)
+		return
+	}
+	details := StampDetails{Comment: req.Comment, ProjectID: req.ProjectID, TaskID: req.TaskID}
+	if err := checkStampDetails(activity, &details, time.Now()); err != nil {
+		http.Error(w, stampErrorMessage(err), http.StatusUnprocessableEntity)
+		return
+	}
+	req.ProjectID = details.ProjectID
+
+	resp, status, err := recordBulkClock(activity, req, key, hash, stampTerminal(r).ID)
+	if err != nil {
+		// a concurrent request with the same key may have won the race
+		if key != "" && replayIdempotentResponse(w, key, "bulkClock", hash) {
+			return
+		}
+		log.Printf("bulkClock failed: %v", err)
+		http.Error(w, "Bulk clock failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, resp)
+}
+
+// replayIdempotentResponse writes the stored response for key, if any. A key
+// reused with a different request body is answered with 422.
+func replayIdempotentResponse(w http.ResponseWriter, key, endpoint, hash string) bool {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("SELECT endpoint, request_hash, status, response FROM %s WHERE idempotency_key=@key", tbl("idempotency_keys"))
+	var storedEndpoint, storedHash, body string
+	var status int
+	if err := db.QueryRow(query, sql.Named("key", key)).Scan(&storedEndpoint, &storedHash, &status, &body); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("idempotency lookup failed: %v", err)
+		}
+		return false
+	}
+	if storedEndpoint != endpoint || storedHash != hash {
+		http.Error(w, "Idempotency key was used for a different request", http.StatusUnprocessableEntity)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+	return true
+}
+
+// storeIdempotentResponse keeps a response for idempotencyKeep and drops
+// expired keys
+func storeIdempotentResponse(q sqlRunner, key, endpoint, hash string, status int, body []byte) error {
+	now := time.Now()
+	if _, err := q.Exec(fmt.Sprintf("DELETE FROM %s WHERE created_at < @before", tbl("idempotency_keys")),
+		sql.Named("before", now.Add(-idempotencyKeep).Unix())); err != nil {
+		log.Printf("prune idempotency_keys failed: %v", err)
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (idempotency_key, endpoint, request_hash, status, response, created_at)
+	                      VALUES (@key, @endpoint, @hash, @status, @response, @now)`, tbl("idempotency_keys"))
+	_, err := q.Exec(query, sql.Named("key", key), sql.Named("endpoint", endpoint), sql.Named("hash", hash),
+		sql.Named("status", status), sql.Named("response", string(body)), sql.Named("now", now.Unix()))
+	return err
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Correction requests: an employee who forgot to stamp or stamped wrong asks
+// for a correction from /myHistory with a reason. A manager of their
+// department (or an admin) approves it, which applies the change through the
+// normal entry functions and links the entry back to the request.
+
+const (
+	correctionAdd      = "add"      // missing stamp
+	correctionTime     = "time"     // move an entry
+	correctionActivity = "activity" // change an entry's activity
+
+	correctionPending  = "pending"
+	correctionApproved = "approved"
+	correctionRejected = "rejected"
+)
+
+// CorrectionRequest asks to add a stamp or change the time or activity of one
+type CorrectionRequest struct {
+	ID            int
+	UserID        int
+	UserName      string
+	DepartmentID  int
+	Kind          string
+	EntryID       int // 0 for a missing stamp
+	EntryDate     string
+	EntryActivity string
+	ActivityID    int // activity of a missing stamp or the new activity
+	Activity      string
+	At            time.Time // time of a missing stamp or the new time
+	Reason        string
+	Status        string
+	Note          string // reason of a rejection
+	DecidedBy     string
+	CreatedAt     time.Time
+	AppliedEntry  int
+}
+
+// Describe summarizes the requested change
+func (c CorrectionRequest) Describe() string {
+	switch c.Kind {
+	case correctionAdd:
+		return fmt.Sprintf("Fehlende Stempelung %s am %s", c.Activity, c.At.Format("02.01.2006 15:04"))
+	case correctionTime:
+		return fmt.Sprintf("%s vom %s auf %s verschieben", c.EntryActivity, c.entryTime(), c.At.Format("02.01.2006 15:04"))
+	case correctionActivity:
+		return fmt.Sprintf("%s vom %s in %s ändern", c.EntryActivity, c.entryTime(), c.Activity)
+	}
+	return c.Kind
+}
+
+func (c CorrectionRequest) entryTime() string {
+	if c.EntryDate == "" {
+		return "(gelöscht)"
+	}
+	return parseDBTimeInLoc(c.EntryDate, time.Local).Format("02.01.2006 15:04")
+}
+
+var errCorrectionState = errors.New("correction request is no longer pending")
+
+// newCorrectionRequest validates a request of user u from the /myHistory form
+func newCorrectionRequest(u User, r *http.Request) (CorrectionRequest, error) {
+	c := CorrectionRequest{
+		UserID:     u.ID,
+		Kind:       r.FormValue("kind"),
+		EntryID:    atoiDefault(r.FormValue("entry_id"), 0),
+		ActivityID: atoiDefault(r.FormValue("activity_id"), 0),
+		Reason:     strings.TrimSpace(r.FormValue("reason")),
+	}
+	if c.Reason == "" {
+		return c, errors.New("Bitte einen Grund angeben.")
+	}
+	if c.Kind != correctionAdd {
+		if e := getEntry(strconv.Itoa(c.EntryID)); e.ID == 0 || e.UserID != u.ID {
+			return c, errors.New("Unbekannter Eintrag.")
+		}
+	}
+	if c.Kind == correctionAdd || c.Kind == correctionTime {
+		at, err := time.ParseInLocation("2006-01-02T15:04", r.FormValue("at"), time.Local)
+		if err != nil {
+			return c, errors.New("Bitte Datum und Uhrzeit angeben.")
+		}
+		if at.After(time.Now()) {
+			return c, errors.New("Der Zeitpunkt liegt in der Zukunft.")
+		}
+		c.At = at
+	}
+	switch c.Kind {
+	case correctionAdd, correctionActivity:
+		if getActivity(strconv.Itoa(c.ActivityID)).ID == 0 {
+			return c, errors.New("Bitte eine Aktivität wählen.")
+		}
+	case correctionTime:
+		c.ActivityID = 0
+	default:
+		return c, errors.New("Unbekannte Art der Korrektur.")
+	}
+	return c, nil
+}
+
+//---------------------------------------------------------------------
+// Storage
+//---------------------------------------------------------------------
+
+func createCorrectionRequest(c CorrectionRequest) error {
+	db := getDB()
+	defer db.Close()
+	var at any
+	if !c.At.IsZero() {
+		at = c.At.Unix()
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (user_id, kind, entry_id, activity_id, requested_at, reason, status, created_at)
+		VALUES (@uid, @kind, @eid, @aid, @at, @reason, @s, @now)`, tbl("correction_requests"))
+	_, err := db.Exec(query, sql.Named("uid", c.UserID), sql.Named("kind", c.Kind), sql.Named("eid", refValue(c.EntryID)),
+		sql.Named("aid", refValue(c.ActivityID)), sql.Named("at", at), sql.Named("reason", c.Reason),
+		sql.Named("s", correctionPending), sql.Named("now", time.Now().Unix()))
+	if err != nil {
+		log.Printf("createCorrectionRequest failed: %v", err)
+	}
+	return err
+}
+
+// getCorrectionRequests lists requests, newest first. userID limits them to
+// one employee, departmentID to one department (0: all), status to one state
+// ("": all).
+func getCorrectionRequests(userID, departmentID int, status string, limit int) []CorrectionRequest {
+	where := ""
+	var args []any
+	if userID != 0 {
+		where += " AND c.user_id=@uid"
+		args = append(args, sql.Named("uid", userID))
+	}
+	if departmentID != 0 {
+		where += " AND u.department_id=@dep"
+		args = append(args, sql.Named("dep", departmentID))
+	}
+	if status != "" {
+		where += " AND c.status=@s"
+		args = append(args, sql.Named("s", status))
+	}
+	return queryCorrectionRequests(where, args, limit)
+}
+
+func getCorrectionRequest(id int) (CorrectionRequest, bool) {
+	list := queryCorrectionRequests(" AND c.id=@id", []any{sql.Named("id", id)}, 1)
+	if len(list) == 0 {
+		return CorrectionRequest{}, false
+	}
+	return list[0], true
+}
+
+func queryCorrectionRequests(where string, args []any, limit int) []CorrectionRequest {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`SELECT c.id, c.user_id, u.name, COALESCE(u.department_id, 0), c.kind, COALESCE(c.entry_id, 0),
+		COALESCE(e.date, ''), COALESCE(et.status, ''), COALESCE(c.activity_id, 0), COALESCE(t.status, ''),
+		COALESCE(c.requested_at, 0), c.reason, c.status, COALESCE(c.note, ''), COALESCE(c.decided_by, ''),
+		c.created_at, COALESCE(c.applied_entry_id, 0)
+		FROM %s c
+		JOIN %s u ON u.id = c.user_id
+		LEFT JOIN %s e ON e.id = c.entry_id
+		LEFT JOIN %s et ON et.id = e.type_id
+		LEFT JOIN %s t ON t.id = c.activity_id
+		WHERE 1=1`, tbl("correction_requests"), tbl("users"), tbl("entries"), tbl("type"), tbl("type"))
+	rows, err := db.Query(query+where+" ORDER BY c.created_at DESC, c.id DESC", args...)
+	if err != nil {
+		log.Printf("queryCorrectionRequests query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var list []CorrectionRequest
+	for rows.Next() {
+		var c CorrectionRequest
+		var at, created int64
+		if err := rows.Scan(&c.ID, &c.UserID, &c.UserName, &c.DepartmentID, &c.Kind, &c.EntryID, &c.EntryDate, &c.EntryActivity,
+			&c.ActivityID, &c.Activity, &at, &c.Reason, &c.Status, &c.Note, &c.DecidedBy, &created, &c.AppliedEntry); err != nil {
+			log.Printf("queryCorrectionRequests scan failed: %v", err)
+			continue
+		}
+		if at != 0 {
+			c.At = time.Unix(at, 0)
+		}
+		c.CreatedAt = time.Unix(created, 0)
+		list = append(list, c)
+		if limit > 0 && len(list) == limit {
+			break
+		}
+	}
+	return list
+}
+
+// decideCorrectionRequest moves a pending request to status; it fails with
+// errCorrectionState when someone else decided it first
+func decideCorrectionRequest(id int, status, by, note string) error {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`UPDATE %s SET status=@s, decided_by=@by, decided_at=@now, note=@note
+		WHERE id=@id AND status=@pending`, tbl("correction_requests"))
+	res, err := db.Exec(query, sql.Named("s", status), sql.Named("by", by), sql.Named("now", time.Now().Unix()),
+		sql.Named("note", note), sql.Named("id", id), sql.Named("pending", correctionPending))
+	if err != nil {
+		log.Printf("decideCorrectionRequest failed: %v", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errCorrectionState
+	}
+	return nil
+}
+
+// reopenCorrectionRequest undoes an approval whose change could not be applied
+func reopenCorrectionRequest(id int) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET status=@s, decided_by=NULL, decided_at=NULL WHERE id=@id", tbl("correction_requests"))
+	if _, err := db.Exec(query, sql.Named("s", correctionPending), sql.Named("id", id)); err != nil {
+		log.Printf("reopenCorrectionRequest failed: %v", err)
+	}
+}
+
+// linkCorrection records the entry a request was applied to on both sides
+func linkCorrection(requestID int, entryID int64) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET applied_entry_id=@eid WHERE id=@id", tbl("correction_requests"))
+	if _, err := db.Exec(query, sql.Named("eid", entryID), sql.Named("id", requestID)); err != nil {
+		log.Printf("linkCorrection request failed: %v", err)
+	}
+	query = fmt.Sprintf("UPDATE %s SET correction_request_id=@id WHERE id=@eid", tbl("entries"))
+	if _, err := db.Exec(query, sql.Named("id", requestID), sql.Named("eid", entryID)); err != nil {
+		log.Printf("linkCorrection entry failed: %v", err)
+	}
+}
+
+// entryCorrectionRequest returns the request an entry was last corrected by, 0 for none
+func entryCorrectionRequest(entryID string) (id int) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("SELECT COALESCE(correction_request_id, 0) FROM %s WHERE id=@id", tbl("entries"))
+	if err := db.QueryRow(query, sql.Named("id", entryID)).Scan(&id); err != nil && err != sql.ErrNoRows {
+		log.Printf("entryCorrectionRequest failed: %v", err)
+	}
+	return id
+}
+
+// applyCorrection makes the requested change through the normal entry
+// functions. Locked months need an HR or admin approver, and the change is
+// audited with the request's reason.
+func applyCorrection(c CorrectionRequest, role, by string) (int64, error) {
+	reason := fmt.Sprintf("Korrekturantrag #%d: %s", c.ID, c.Reason)
+	uid := strconv.Itoa(c.UserID)
+	if c.Kind == correctionAdd {
+		audit, err := authorizeEntryChange(EntryDetail{}, uid, c.At, role, reason)
+		if err != nil {
+			return 0, err
+		}
+		id, err := createEntryFrom(uid, strconv.Itoa(c.ActivityID), c.At, 0, StampDetails{})
+		if err != nil {
+			return 0, err
+		}
+		if audit {
+			e := getEntry(strconv.FormatInt(id, 10))
+			recordEntryAudit(e.ID, e.UserID, "create", reason, by, "", entrySummary(e))
+		}
+		return id, nil
+	}
+
+	eid := strconv.Itoa(c.EntryID)
+	before := getEntry(eid)
+	if before.ID == 0 || before.UserID != c.UserID {
+		return 0, errors.New("Der Eintrag existiert nicht mehr.")
+	}
+	date, activityID := before.Date, before.ActivityID
+	at := parseDBTimeInLoc(before.Date, time.Local)
+	if c.Kind == correctionTime {
+		at = c.At
+		date = c.At.Format("2006-01-02 15:04:05")
+	} else {
+		activityID = c.ActivityID
+	}
+	audit, err := authorizeEntryChange(before, uid, at, role, reason)
+	if err != nil {
+		return 0, err
+	}
+	if err := updateEntry(eid, uid, strconv.Itoa(activityID), date, before.Comment, before.ProjectID, before.TaskID); err != nil {
+		return 0, err
+	}
+	if audit {
+		after := getEntry(eid)
+		recordEntryAudit(after.ID, after.UserID, "update", reason, by, entrySummary(before), entrySummary(after))
+	}
+	return int64(before.ID), nil
+}
+
+//---------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------
+
+// myHistoryUser identifies the employee on /myHistory: the logged-in DB user
+// or, without a session, email and password of the form
+func myHistoryUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	if u, ok := currentDBUserFromSession(r); ok {
+		return u, true
+	}
+	email := r.FormValue("email")
+	if wait, blocked := loginBlocked(r, email); blocked {
+		tooManyAttempts(w, wait)
+		return User{}, false
+	}
+	u, ok := getUserByEmail(email)
+	if !passwordMatches(u, ok, r.FormValue("pwd")) {
+		recordLoginFailure(r, email)
+		renderTemplate(w, r, "myHistory", map[string]any{"Error": "Invalid email or password."})
+		return User{}, false
+	}
+	recordLoginSuccess(email)
+	return u, true
+}
+
+// myCorrectionHandler takes a correction request from /myHistory
+func myCorrectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, ok := myHistoryUser(w, r)
+	if !ok {
+		return
+	}
+	data := myHistoryData(u, r.FormValue("from"), r.FormValue("to"), true)
+	c, err := newCorrectionRequest(u, r)
+	if err == nil {
+		err = createCorrectionRequest(c)
+	}
+	if err != nil {
+		data["CorrectionError"] = err.Error()
+	} else {
+		data["CorrectionSent"] = true
+		data["Corrections"] = getCorrectionRequests(u.ID, 0, "", 10)
+	}
+	renderTemplate(w, r, "myHistory", data)
+}
+
+// correctionsHandler lists the correction requests an approver may decide
+// and applies approved ones
+func correctionsHandler(w http.ResponseWriter, r *http.Request) {
+	role := sessionRole(r)
+	viewer, _ := currentDBUserFromSession(r)
+	if !isRole(role, "admin", "manager") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		c, ok := getCorrectionRequest(atoiDefault(r.FormValue("id"), 0))
+		if !ok {
+			http.Error(w, "Unbekannter Antrag.", http.StatusNotFound)
+			return
+		}
+		if !canApprove(role, viewer, getUser(strconv.Itoa(c.UserID))) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		by := sessionUsername(r)
+		switch r.FormValue("action") {
+		case "approve":
+			if err := decideCorrectionRequest(c.ID, correctionApproved, by, ""); err != nil {
+				correctionConflict(w, err)
+				return
+			}
+			id, err := applyCorrection(c, role, by)
+			if err != nil {
+				reopenCorrectionRequest(c.ID)
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			linkCorrection(c.ID, id)
+		case "reject":
+			if err := decideCorrectionRequest(c.ID, correctionRejected, by, strings.TrimSpace(r.FormValue("note"))); err != nil {
+				correctionConflict(w, err)
+				return
+			}
+		default:
+			http.Error(w, "Unbekannte Aktion.", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/corrections", http.StatusSeeOther)
+		return
+	}
+
+	departmentID := 0
+	if !isRole(role, "admin") {
+		departmentID = viewer.DepartmentID
+		if departmentID == 0 {
+			renderTemplate(w, r, "corrections", map[string]any{})
+			return
+		}
+	}
+	var pending []CorrectionRequest
+	for _, c := range getCorrectionRequests(0, departmentID, correctionPending, 0) {
+		if c.UserID != viewer.ID || isRole(role, "admin") {
+			pending = append(pending, c)
+		}
+	}
+	renderTemplate(w, r, "corrections", map[string]any{
+		"Pending": pending,
+		"Decided": decidedCorrections(departmentID, 50),
+		"IsAdmin": isRole(role, "admin"),
+	})
+}
+
+func decidedCorrections(departmentID, limit int) []CorrectionRequest {
+	where, args := " AND c.status<>@s", []any{sql.Named("s", correctionPending)}
+	if departmentID != 0 {
+		where += " AND u.department_id=@dep"
+		args = append(args, sql.Named("dep", departmentID))
+	}
+	return queryCorrectionRequests(where, args, limit)
+}
+
+func correctionConflict(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCorrectionState) {
+		http.Error(w, "Der Antrag wurde bereits entschieden.", http.StatusConflict)
+		return
+	}
+	http.Error(w, "Speichern fehlgeschlagen.", http.StatusInternalServerError)
+}
@@ -49,6 +49,14 @@ func SetRequestHost(host string) {
 	currentHostByGID.Store(getGID(), host)
 }
 
+// boundHost returns the host the current goroutine is bound to, if any
+func boundHost() string {
+	if v, ok := currentHostByGID.Load(getGID()); ok {
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
+
 // ClearRequestHost clears the host binding for the current goroutine
 func ClearRequestHost() {
 	currentHostByGID.Delete(getGID())
@@ -75,8 +83,8 @@ func resolveSQLitePath() string {
 		// sanitize host for filesystem
 		safe := strings.ToLower(host)
 		safe = strings.ReplaceAll(safe, "/", "-")
-		// ensure tenant dir exists: tenant/<host>
-		dir := filepath.Join("tenant", safe)
+		// ensure tenant dir exists: <tenantRoot>/<host>
+		dir := filepath.Join(tenantRoot(), safe)
 		_ = os.MkdirAll(dir, 0o755)
 		return filepath.Join(dir, "time_tracking.db")
 	}
@@ -101,6 +109,8 @@ func EnsureSchemaCurrent() {
 	ensureUserPasswordColumn()
 	ensureUserRoleColumn()
 	ensureUserAutoCheckoutColumn()
+	ensureExtraColumns()
+	migrateEntryDates()
 	initializedDBs.Store(path, true)
 }
 
@@ -140,8 +150,10 @@ func init() {
 		log.Printf("[DB] Backend=sqlite defaultPath=%s (will switch per-host if set)", sqlitePath)
 	}
 
-	// 3. Tabellen / Views anlegen (nur wenn sinnvoll)
-	createDatabaseAndTables()
+	// 3. Tabellen / Views anlegen (nur wenn sinnvoll, nicht für `reader`)
+	if !readerCommand() {
+		createDatabaseAndTables()
+	}
 }
 
 //---------------------------------------------------------------------
@@ -165,6 +177,13 @@ func getDB() *sql.DB {
 		driver = "sqlite"
 		dsn = resolveSQLitePath()
 		log.Printf("[DB] Opening SQLite dsn=%s", dsn)
+		// store times in a format SQLite's date functions understand and wait
+		// for locks held by background writers (webhook dispatcher) instead of failing
+		if strings.Contains(dsn, "?") {
+			dsn += "&_time_format=sqlite&_pragma=busy_timeout(5000)"
+		} else {
+			dsn += "?_time_format=sqlite&_pragma=busy_timeout(5000)"
+		}
 	}
 
 	db, err := sql.Open(driver, dsn)
@@ -198,6 +217,8 @@ func createDatabaseAndTables() {
 		ensureUserPasswordColumn()
 		ensureUserRoleColumn()
 		ensureUserAutoCheckoutColumn()
+		ensureExtraColumns()
+		migrateEntryDates()
 	case "mssql":
 		if os.Getenv("DB_AUTO_MIGRATE") == "1" {
 			//execBatches(embeddedMSSQLSchema, "\nGO")
@@ -205,6 +226,140 @@ func createDatabaseAndTables() {
 		ensureUserPasswordColumn()
 		ensureUserRoleColumn()
 		ensureUserAutoCheckoutColumn()
+		ensureExtraColumns()
+	}
+}
+
+// ensureExtraColumns adds columns introduced after the initial schema
+func ensureExtraColumns() {
+	ensureColumn("users", "totp_secret", "totp_secret TEXT", "totp_secret NVARCHAR(64) NULL")
+	ensureColumn("users", "totp_enabled", "totp_enabled INTEGER DEFAULT 0", "totp_enabled INT NOT NULL DEFAULT 0")
+	ensureColumn("users", "totp_last_step", "totp_last_step INTEGER DEFAULT 0", "totp_last_step BIGINT NOT NULL DEFAULT 0")
+	ensureColumn("users", "active", "active INTEGER DEFAULT 1", "active INT NOT NULL DEFAULT 1")
+	ensureColumn("users", "ldap_dn", "ldap_dn TEXT", "ldap_dn NVARCHAR(400) NULL")
+	ensureColumn("users", "debounce_seconds", "debounce_seconds INTEGER", "debounce_seconds INT NULL")
+	ensureColumn("type", "code", "code TEXT", "code NVARCHAR(64) NULL")
+	ensureColumn("type", "comment_required", "comment_required INTEGER DEFAULT 0", "comment_required INT NOT NULL DEFAULT 0")
+	ensureActivityCodeIndex()
+	ensureColumn("departments", "toggle_work_type_id", "toggle_work_type_id INTEGER", "toggle_work_type_id INT NULL")
+	ensureColumn("departments", "toggle_off_type_id", "toggle_off_type_id INTEGER", "toggle_off_type_id INT NULL")
+	ensureColumn("terminals", "pairing_hash", "pairing_hash TEXT", "pairing_hash NVARCHAR(64) NULL")
+	ensureColumn("terminals", "pairing_expires_at", "pairing_expires_at INTEGER", "pairing_expires_at BIGINT NULL")
+	ensureColumn("terminals", "paired_at", "paired_at INTEGER", "paired_at BIGINT NULL")
+	ensureColumn("terminals", "qr_secret", "qr_secret TEXT", "qr_secret NVARCHAR(64) NULL")
+	ensureColumn("entries", "terminal_id", "terminal_id INTEGER", "terminal_id INT NULL")
+	ensureColumn("entries", "latitude", "latitude REAL", "latitude FLOAT NULL")
+	ensureColumn("entries", "longitude", "longitude REAL", "longitude FLOAT NULL")
+	ensureColumn("entries", "location_accuracy", "location_accuracy REAL", "location_accuracy FLOAT NULL")
+	ensureColumn("entries", "geofence", "geofence TEXT", "geofence NVARCHAR(16) NULL")
+	ensureColumn("entries", "geo_reviewed_by", "geo_reviewed_by TEXT", "geo_reviewed_by NVARCHAR(255) NULL")
+	ensureColumn("entries", "geo_reviewed_at", "geo_reviewed_at INTEGER", "geo_reviewed_at BIGINT NULL")
+	ensureColumn("entries", "project_id", "project_id INTEGER", "project_id INT NULL")
+	ensureColumn("entries", "task_id", "task_id INTEGER", "task_id INT NULL")
+	ensureColumn("entries", "correction_request_id", "correction_request_id INTEGER", "correction_request_id INT NULL")
+	ensureColumn("type", "billable", "billable INTEGER DEFAULT 0", "billable INT NOT NULL DEFAULT 0")
+	ensureColumn("users", "cost_center_id", "cost_center_id INTEGER", "cost_center_id INT NULL")
+	ensureColumn("projects", "cost_center_id", "cost_center_id INTEGER", "cost_center_id INT NULL")
+}
+
+// goTimeLayout is how the SQLite driver stored times before the DSN asked
+// for _time_format=sqlite; SQLite's date functions return NULL for it
+const goTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// migrateEntryDates rewrites entries.date values in the old Go format into
+// the SQLite format, so JULIANDAY and DATE see them. Rows that are already
+// readable are left alone; it runs on every start and is a no-op once done.
+func migrateEntryDates() {
+	if dbBackend != "sqlite" {
+		return
+	}
+	db := getDB()
+	defer db.Close()
+	rows, err := db.Query(fmt.Sprintf("SELECT id, CAST(date AS TEXT) FROM %s WHERE JULIANDAY(date) IS NULL", tbl("entries")))
+	if err != nil {
+		log.Printf("migrateEntryDates query failed: %v", err)
+		return
+	}
+	dates := map[int64]time.Time{}
+	for rows.Next() {
+		var id int64
+		var s string
+		if err := rows.Scan(&id, &s); err != nil {
+			continue
+		}
+		s, _, _ = strings.Cut(s, " m=") // monotonic clock reading of time.Now()
+		t, err := time.Parse(goTimeLayout, s)
+		if err != nil {
+			log.Printf("migrateEntryDates: entry %d has unreadable date %q", id, s)
+			continue
+		}
+		dates[id] = t
+	}
+	rows.Close()
+	for id, t := range dates {
+		query := fmt.Sprintf("UPDATE %s SET date=@date WHERE id=@id", tbl("entries"))
+		if _, err := db.Exec(query, sql.Named("date", t), sql.Named("id", id)); err != nil {
+			log.Printf("migrateEntryDates update %d failed: %v", id, err)
+		}
+	}
+	if len(dates) > 0 {
+		log.Printf("[DB] migrated %d entry dates to the SQLite time format", len(dates))
+	}
+}
+
+// ensureColumn adds column to table if missing; the definitions are backend specific
+func ensureColumn(table, column, sqliteDef, mssqlDef string) {
+	db := getDB()
+	defer db.Close()
+	switch dbBackend {
+	case "sqlite":
+		rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+		if err != nil {
+			return
+		}
+		has := false
+		for rows.Next() {
+			var cid int
+			var name, ctype string
+			var notnull, pk int
+			var dflt sql.NullString
+			if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err == nil && strings.EqualFold(name, column) {
+				has = true
+				break
+			}
+		}
+		rows.Close()
+		if !has {
+			if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, sqliteDef)); err != nil {
+				log.Printf("add %s.%s failed: %v", table, column, err)
+			}
+		}
+	case "mssql":
+		var exists int
+		err := db.QueryRow("SELECT 1 FROM sys.columns WHERE Name = @col AND Object_ID = Object_ID(@tbl)",
+			sql.Named("col", column), sql.Named("tbl", tbl(table))).Scan(&exists)
+		if err == sql.ErrNoRows {
+			if _, err2 := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s", tbl(table), mssqlDef)); err2 != nil {
+				log.Printf("add %s.%s failed: %v", table, column, err2)
+			}
+		}
+	}
+}
+
+// ensureActivityCodeIndex makes activity codes unique; rows without a code are ignored
+func ensureActivityCodeIndex() {
+	db := getDB()
+	defer db.Close()
+	var err error
+	switch dbBackend {
+	case "sqlite":
+		_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_type_code ON type(code)`)
+	case "mssql":
+		_, err = db.Exec(fmt.Sprintf(`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'idx_type_code' AND object_id = OBJECT_ID(@tbl))
+			CREATE UNIQUE INDEX idx_type_code ON %s (code) WHERE code IS NOT NULL`, tbl("type")), sql.Named("tbl", tbl("type")))
+	}
+	if err != nil {
+		log.Printf("create index idx_type_code failed: %v", err)
 	}
 }
 
@@ -350,6 +505,7 @@ type User struct {
 	Position             string
 	DepartmentID         int
 	AutoCheckoutMidnight int
+	Active               int
 }
 
 type Activity struct {
@@ -357,11 +513,19 @@ type Activity struct {
 	Status  string
 	Work    int
 	Comment string
+	Code    string // barcode code, unique when set
+	// CommentRequired makes interactive stamping ask for a comment
+	CommentRequired bool
+	// Billable hours of the activity go into client invoices
+	Billable bool
 }
 
 type Department struct {
 	ID   int
 	Name string
+	// activities for toggle stamping, 0 = tenant default
+	ToggleWorkID int
+	ToggleOffID  int
 }
 
 //---------------------------------------------------------------------
@@ -374,7 +538,7 @@ func getUsers() []User {
 	db := getDB()
 	defer db.Close()
 
-	rows, err := db.Query(fmt.Sprintf("SELECT id, name, email, COALESCE(password,''), COALESCE(role,'user'), position, department_id, stampkey, COALESCE(auto_checkout_midnight,0) FROM %s", tbl("users")))
+	rows, err := db.Query(fmt.Sprintf("SELECT id, name, email, COALESCE(password,''), COALESCE(role,'user'), position, department_id, stampkey, COALESCE(auto_checkout_midnight,0), COALESCE(active,1) FROM %s", tbl("users")))
 	if err != nil {
 		log.Printf("getUsers query failed: %v", err)
 		return nil
@@ -384,7 +548,7 @@ func getUsers() []User {
 	var list []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Position, &u.DepartmentID, &u.Stampkey, &u.AutoCheckoutMidnight); err != nil {
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Position, &u.DepartmentID, &u.Stampkey, &u.AutoCheckoutMidnight, &u.Active); err != nil {
 			log.Printf("getUsers scan failed: %v", err)
 			continue
 		}
@@ -397,7 +561,7 @@ func getActivities() []Activity {
 	db := getDB()
 	defer db.Close()
 
-	rows, err := db.Query(fmt.Sprintf("SELECT id, status, work, comment FROM %s", tbl("type")))
+	rows, err := db.Query(fmt.Sprintf("SELECT id, status, work, comment, COALESCE(code, ''), COALESCE(comment_required, 0), COALESCE(billable, 0) FROM %s", tbl("type")))
 	if err != nil {
 		log.Printf("getActivities query failed: %v", err)
 		return nil
@@ -407,7 +571,7 @@ func getActivities() []Activity {
 	var list []Activity
 	for rows.Next() {
 		var a Activity
-		if err := rows.Scan(&a.ID, &a.Status, &a.Work, &a.Comment); err != nil {
+		if err := rows.Scan(&a.ID, &a.Status, &a.Work, &a.Comment, &a.Code, &a.CommentRequired, &a.Billable); err != nil {
 			log.Printf("getActivities scan failed: %v", err)
 			continue
 		}
@@ -420,7 +584,7 @@ func getDepartments() []Department {
 	db := getDB()
 	defer db.Close()
 
-	rows, err := db.Query(fmt.Sprintf("SELECT id, name FROM %s", tbl("departments")))
+	rows, err := db.Query(fmt.Sprintf("SELECT id, name, COALESCE(toggle_work_type_id,0), COALESCE(toggle_off_type_id,0) FROM %s", tbl("departments")))
 	if err != nil {
 		log.Printf("getDepartments query failed: %v", err)
 		return nil
@@ -430,7 +594,7 @@ func getDepartments() []Department {
 	var list []Department
 	for rows.Next() {
 		var d Department
-		if err := rows.Scan(&d.ID, &d.Name); err != nil {
+		if err := rows.Scan(&d.ID, &d.Name, &d.ToggleWorkID, &d.ToggleOffID); err != nil {
 			log.Printf("getDepartments scan failed: %v", err)
 			continue
 		}
@@ -468,10 +632,10 @@ func getUser(id string) User {
 	db := getDB()
 	defer db.Close()
 
-	query := fmt.Sprintf("SELECT id, name, stampkey, email, COALESCE(password,''), COALESCE(role,'user'), position, department_id, COALESCE(auto_checkout_midnight,0) FROM %s WHERE id=@id", tbl("users"))
+	query := fmt.Sprintf("SELECT id, name, stampkey, email, COALESCE(password,''), COALESCE(role,'user'), position, department_id, COALESCE(auto_checkout_midnight,0), COALESCE(active,1) FROM %s WHERE id=@id", tbl("users"))
 	var u User
 	if err := db.QueryRow(query, sql.Named("id", id)).
-		Scan(&u.ID, &u.Name, &u.Stampkey, &u.Email, &u.Password, &u.Role, &u.Position, &u.DepartmentID, &u.AutoCheckoutMidnight); err != nil {
+		Scan(&u.ID, &u.Name, &u.Stampkey, &u.Email, &u.Password, &u.Role, &u.Position, &u.DepartmentID, &u.AutoCheckoutMidnight, &u.Active); err != nil {
 		log.Printf("getUser failed: %v", err)
 		return User{}
 	}
@@ -482,7 +646,7 @@ func getAllUsers() []User {
 	db := getDB()
 	defer db.Close()
 
-	query := fmt.Sprintf("SELECT id, name, stampkey, email, COALESCE(password,''), COALESCE(role,'user'), position, department_id, COALESCE(auto_checkout_midnight,0) FROM %s", tbl("users"))
+	query := fmt.Sprintf("SELECT id, name, stampkey, email, COALESCE(password,''), COALESCE(role,'user'), position, department_id, COALESCE(auto_checkout_midnight,0), COALESCE(active,1) FROM %s", tbl("users"))
 	rows, err := db.Query(query)
 	if err != nil {
 		log.Printf("getAllUsers query failed: %v", err)
@@ -493,7 +657,7 @@ func getAllUsers() []User {
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Name, &u.Stampkey, &u.Email, &u.Password, &u.Role, &u.Position, &u.DepartmentID, &u.AutoCheckoutMidnight); err != nil {
+		if err := rows.Scan(&u.ID, &u.Name, &u.Stampkey, &u.Email, &u.Password, &u.Role, &u.Position, &u.DepartmentID, &u.AutoCheckoutMidnight, &u.Active); err != nil {
 			log.Printf("getAllUsers scan failed: %v", err)
 			continue
 		}
@@ -506,7 +670,7 @@ func getAllActivities() []Activity {
 	db := getDB()
 	defer db.Close()
 
-	query := fmt.Sprintf("SELECT id, status, work, comment FROM %s", tbl("type"))
+	query := fmt.Sprintf("SELECT id, status, work, comment, COALESCE(code, ''), COALESCE(comment_required, 0), COALESCE(billable, 0) FROM %s", tbl("type"))
 	rows, err := db.Query(query)
 	if err != nil {
 		log.Printf("getAllActivities query failed: %v", err)
@@ -517,7 +681,7 @@ func getAllActivities() []Activity {
 	var activities []Activity
 	for rows.Next() {
 		var a Activity
-		if err := rows.Scan(&a.ID, &a.Status, &a.Work, &a.Comment); err != nil {
+		if err := rows.Scan(&a.ID, &a.Status, &a.Work, &a.Comment, &a.Code, &a.CommentRequired, &a.Billable); err != nil {
 			log.Printf("getAllActivities scan failed: %v", err)
 			continue
 		}
@@ -530,45 +694,122 @@ func getActivity(id string) Activity {
 	db := getDB()
 	defer db.Close()
 
-	query := fmt.Sprintf("SELECT id, status, work, comment FROM %s WHERE id=@id", tbl("type"))
+	query := fmt.Sprintf("SELECT id, status, work, comment, COALESCE(code, ''), COALESCE(comment_required, 0), COALESCE(billable, 0) FROM %s WHERE id=@id", tbl("type"))
 	var a Activity
 	if err := db.QueryRow(query, sql.Named("id", id)).
-		Scan(&a.ID, &a.Status, &a.Work, &a.Comment); err != nil {
+		Scan(&a.ID, &a.Status, &a.Work, &a.Comment, &a.Code, &a.CommentRequired, &a.Billable); err != nil {
 		log.Printf("getActivity failed: %v", err)
 		return Activity{}
 	}
 	return a
 }
 
+// getActivityByCode looks up an activity by its barcode code
+func getActivityByCode(code string) (Activity, bool) {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT id, status, work, comment, code, COALESCE(comment_required, 0), COALESCE(billable, 0) FROM %s WHERE code=@code", tbl("type"))
+	var a Activity
+	if err := db.QueryRow(query, sql.Named("code", code)).Scan(&a.ID, &a.Status, &a.Work, &a.Comment, &a.Code, &a.CommentRequired, &a.Billable); err != nil {
+		return Activity{}, false
+	}
+	return a, true
+}
+
 func getDepartment(id string) Department {
 	db := getDB()
 	defer db.Close()
 
-	query := fmt.Sprintf("SELECT id, name FROM %s WHERE id=@id", tbl("departments"))
+	query := fmt.Sprintf("SELECT id, name, COALESCE(toggle_work_type_id,0), COALESCE(toggle_off_type_id,0) FROM %s WHERE id=@id", tbl("departments"))
 	var d Department
 	if err := db.QueryRow(query, sql.Named("id", id)).
-		Scan(&d.ID, &d.Name); err != nil {
+		Scan(&d.ID, &d.Name, &d.ToggleWorkID, &d.ToggleOffID); err != nil {
 		log.Printf("getDepartment failed: %v", err)
 		return Department{}
 	}
 	return d
 }
 
+// getDepartmentByName looks up a department by its unique name
+func getDepartmentByName(name string) (Department, bool) {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT id, name FROM %s WHERE name=@name", tbl("departments"))
+	var d Department
+	if err := db.QueryRow(query, sql.Named("name", name)).Scan(&d.ID, &d.Name); err != nil {
+		return Department{}, false
+	}
+	return d, true
+}
+
+// scannedCode strips the frame printed on barcode cards ("USR-<key>-END",
+// "ACT-<code>-END") from a scan; other input is returned trimmed
+func scannedCode(raw, prefix string) string {
+	s := strings.TrimSpace(raw)
+	u := strings.ToUpper(s)
+	if len(s) > len(prefix)+5 && strings.HasPrefix(u, prefix+"-") && strings.HasSuffix(u, "-END") {
+		return s[len(prefix)+1 : len(s)-4]
+	}
+	return s
+}
+
+// getActivityByScan resolves a scanned activity barcode by its code; a
+// numeric id still works for cards printed before activities had codes
+func getActivityByScan(raw string) (Activity, bool) {
+	code := scannedCode(raw, "ACT")
+	if a, ok := getActivityByCode(code); ok {
+		return a, true
+	}
+	if _, err := strconv.Atoi(code); err == nil {
+		if a := getActivity(code); a.ID != 0 {
+			return a, true
+		}
+	}
+	return Activity{}, false
+}
+
 func getUserIDFromStampKey(stampKey string) string {
 	db := getDB()
 	defer db.Close()
+	id, _ := stampKeyUser(db, stampKey)
+	return id
+}
 
-	query := fmt.Sprintf("SELECT id FROM %s WHERE stampkey=@sk", tbl("users"))
-	var id string
-	if err := db.QueryRow(query, sql.Named("sk", stampKey)).Scan(&id); err != nil {
+// stampKeyUser looks up an active user's id and name by stampkey, inside a
+// transaction if q is one
+func stampKeyUser(q sqlRunner, stampKey string) (id, name string) {
+	query := fmt.Sprintf("SELECT id, name FROM %s WHERE stampkey=@sk AND COALESCE(active,1)=1", tbl("users"))
+	if err := q.QueryRow(query, sql.Named("sk", stampKey)).Scan(&id, &name); err != nil {
 		// kein fatal – kann vorkommen, wenn Karte unbekannt
-		return ""
+		return "", ""
 	}
-	return id
+	return id, name
 }
 
 // ----------- INSERT --------------------------------------------------
 
+// sqlRunner is implemented by *sql.DB and *sql.Tx
+type sqlRunner interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// insertID runs an INSERT and returns the id of the new row on both backends
+func insertID(db sqlRunner, query string, args ...any) (int64, error) {
+	if dbBackend == "mssql" {
+		var id int64
+		err := db.QueryRow(query+"; SELECT CAST(SCOPE_IDENTITY() AS BIGINT)", args...).Scan(&id)
+		return id, err
+	}
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
 func createUniqueStampKey() int {
 	db := getDB()
 	defer db.Close()
@@ -593,7 +834,7 @@ func createUniqueStampKey() int {
 	}
 }
 
-func createUser(name, stampkey, email, password, role, position, departmentID string) {
+func createUser(name, stampkey, email, password, role, position, departmentID string) (int64, error) {
 	db := getDB()
 	defer db.Close()
 
@@ -612,7 +853,7 @@ func createUser(name, stampkey, email, password, role, position, departmentID st
 
 		if count > 0 {
 			log.Printf("Stampkey %s already exists. Please use a different one.", stampkey)
-			return
+			return 0, fmt.Errorf("stampkey %s already exists", stampkey)
 		}
 	}
 
@@ -629,7 +870,7 @@ func createUser(name, stampkey, email, password, role, position, departmentID st
 	}
 	query := fmt.Sprintf(`INSERT INTO %s (name, stampkey, email, password, role, position, department_id)
                            VALUES (@name,@sk,@mail,@pwd,@role,@pos,@dept)`, tbl("users"))
-	_, err := db.Exec(query,
+	id, err := insertID(db, query,
 		sql.Named("name", name),
 		sql.Named("sk", stampkey),
 		sql.Named("mail", email),
@@ -640,7 +881,10 @@ func createUser(name, stampkey, email, password, role, position, departmentID st
 	)
 	if err != nil {
 		log.Printf("createUser insert failed: %v", err)
+		return id, err
 	}
+	emitUserEvent("user.created", strconv.FormatInt(id, 10))
+	return id, nil
 }
 
 // setUserAutoCheckout updates the per-user auto checkout flag (0/1)
@@ -657,56 +901,98 @@ func setUserAutoCheckout(id string, enabled bool) {
 	}
 }
 
-func createActivity(status, work, comment string) {
+// activityCodeValue stores an empty code as NULL so the unique index ignores it
+func activityCodeValue(code string) any {
+	if code = strings.TrimSpace(code); code != "" {
+		return code
+	}
+	return nil
+}
+
+func createActivity(status, work, comment, code string) (int64, error) {
 	db := getDB()
 	defer db.Close()
 
 	workInt, _ := strconv.Atoi(work)
-	query := fmt.Sprintf(`INSERT INTO %s (status, work, comment)
-	                       VALUES (@status,@work,@comment)`, tbl("type"))
-	_, err := db.Exec(query,
+	query := fmt.Sprintf(`INSERT INTO %s (status, work, comment, code)
+	                       VALUES (@status,@work,@comment,@code)`, tbl("type"))
+	id, err := insertID(db, query,
 		sql.Named("status", status),
 		sql.Named("work", workInt),
 		sql.Named("comment", comment),
+		sql.Named("code", activityCodeValue(code)),
 	)
 	if err != nil {
-		log.Printf("updateDepartment failed: %v", err)
+		log.Printf("createActivity failed: %v", err)
 	}
+	return id, err
 }
 
-func createDepartment(name string) {
+func createDepartment(name string) (int64, error) {
 	db := getDB()
 	defer db.Close()
 
 	query := fmt.Sprintf("INSERT INTO %s (name) VALUES (@name)", tbl("departments"))
-	if _, err := db.Exec(query, sql.Named("name", name)); err != nil {
+	id, err := insertID(db, query, sql.Named("name", name))
+	if err != nil {
 		log.Printf("createDepartment failed: %v", err)
 	}
+	return id, err
 }
 
 // createEntry creates a new time entry for a user
-func createEntry(userID, activityID string, entrydate time.Time) {
+func createEntry(userID, activityID string, entrydate time.Time) (int64, error) {
+	return createEntryFrom(userID, activityID, entrydate, 0, StampDetails{})
+}
+
+// createEntryFrom creates an entry stamped on a registered terminal (0: none)
+// with the comment and project entered at stamping time
+func createEntryFrom(userID, activityID string, entrydate time.Time, terminalID int, details StampDetails) (int64, error) {
 	db := getDB()
 	defer db.Close()
 
+	id, err := insertEntry(db, userID, activityID, entrydate, terminalID, details)
+	if err != nil {
+		return id, err
+	}
+	entryCreated(userID, id, entrydate)
+	return id, nil
+}
+
+// insertEntry inserts an entry on q, which may be a transaction; the caller
+// reports it with entryCreated once it is committed
+func insertEntry(q sqlRunner, userID, activityID string, entrydate time.Time, terminalID int, details StampDetails) (int64, error) {
 	// Ensure midnight auto-checkout if enabled and last working entry is on a previous day
-	ensureMidnightAutoCheckoutWithDB(db, atoiDefault(userID, 0), entrydate)
+	ensureMidnightAutoCheckoutWithDB(q, atoiDefault(userID, 0), entrydate)
 
-	query := fmt.Sprintf(`INSERT INTO %s (user_id, type_id, date)
-                            VALUES (@uid, @aid, @date)`, tbl("entries"))
-	_, err := db.Exec(query,
+	query := fmt.Sprintf(`INSERT INTO %s (user_id, type_id, date, terminal_id, comment, project_id, task_id)
+                            VALUES (@uid, @aid, @date, @tid, @comment, @pid, @task)`, tbl("entries"))
+	id, err := insertID(q, query,
 		sql.Named("uid", userID),
 		sql.Named("aid", activityID),
 		sql.Named("date", entrydate),
+		sql.Named("tid", terminalIDValue(terminalID)),
+		sql.Named("comment", strings.TrimSpace(details.Comment)),
+		sql.Named("pid", refValue(details.ProjectID)),
+		sql.Named("task", refValue(details.TaskID)),
 	)
 	if err != nil {
 		log.Printf("createEntry failed: %v", err)
 	}
+	return id, err
+}
+
+// entryCreated notifies status listeners, webhooks and the daily hours check
+// about a new entry
+func entryCreated(userID string, id int64, at time.Time) {
+	notifyStatusChange()
+	emitEntryEvent("entry.created", id)
+	checkDailyHours(userID, at)
 }
 
 // ensureMidnightAutoCheckoutWithDB inserts a non-work entry at 23:59:59 of the day of the
 // user's last working entry if auto checkout is enabled and the last entry is from a previous day.
-func ensureMidnightAutoCheckoutWithDB(db *sql.DB, userID int, now time.Time) {
+func ensureMidnightAutoCheckoutWithDB(db sqlRunner, userID int, now time.Time) {
 	if userID <= 0 {
 		return
 	}
@@ -767,7 +1053,7 @@ func getUserEntriesDetailed(userID int, from, to string) []EntryDetail {
                  WHERE next_e.user_id = e.user_id AND next_e.date > e.date), 
                 datetime('now')
             ) as end_time,
-            COALESCE(
+            MAX(COALESCE(
                 (JULIANDAY(
                     COALESCE(
                         (SELECT MIN(next_e.date) FROM %s next_e 
@@ -775,7 +1061,7 @@ func getUserEntriesDetailed(userID int, from, to string) []EntryDetail {
                         datetime('now')
                     )
                 ) - JULIANDAY(e.date)) * 24, 0
-            ) as duration,
+            ), 0) as duration,
             COALESCE(e.comment, '') as comment
         FROM %s e
         JOIN %s u ON e.user_id = u.id
@@ -812,7 +1098,7 @@ func getUserEntriesDetailed(userID int, from, to string) []EntryDetail {
 
 // ----------- UPDATE --------------------------------------------------
 
-func updateUser(id, name, stampkey, email, password, role, position, departmentID string) {
+func updateUser(id, name, stampkey, email, password, role, position, departmentID string) error {
 	db := getDB()
 	defer db.Close()
 
@@ -840,8 +1126,10 @@ func updateUser(id, name, stampkey, email, password, role, position, departmentI
 		)
 		if err != nil {
 			log.Printf("updateUser with password failed: %v", err)
+			return err
 		}
-		return
+		emitUserEvent("user.updated", id)
+		return nil
 	}
 	query := fmt.Sprintf(`UPDATE %s
 						  SET name=@name, stampkey=@sk, email=@mail, role=@role, position=@pos, department_id=@dept
@@ -857,6 +1145,49 @@ func updateUser(id, name, stampkey, email, password, role, position, departmentI
 	)
 	if err != nil {
 		log.Printf("updateUser failed: %v", err)
+		return err
+	}
+	emitUserEvent("user.updated", id)
+	return nil
+}
+
+// setUserRoleAndDepartment is used by directory/SSO logins to sync role and department
+func setUserRoleAndDepartment(id int, role string, departmentID int) {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("UPDATE %s SET role=@role, department_id=@dept WHERE id=@id", tbl("users"))
+	if _, err := db.Exec(query, sql.Named("role", role), sql.Named("dept", departmentID), sql.Named("id", id)); err != nil {
+		log.Printf("setUserRoleAndDepartment failed: %v", err)
+	}
+}
+
+// setUserPassword stores a new bcrypt hash for the user
+func setUserPassword(id int, password string) {
+	db := getDB()
+	defer db.Close()
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("hash password failed: %v", err)
+		return
+	}
+	query := fmt.Sprintf("UPDATE %s SET password=@pwd WHERE id=@id", tbl("users"))
+	if _, err := db.Exec(query, sql.Named("pwd", string(b)), sql.Named("id", id)); err != nil {
+		log.Printf("setUserPassword failed: %v", err)
+	}
+}
+
+// setUserActive enables or disables a user; inactive users cannot log in or stamp
+func setUserActive(id string, active bool) {
+	db := getDB()
+	defer db.Close()
+	val := 0
+	if active {
+		val = 1
+	}
+	query := fmt.Sprintf("UPDATE %s SET active=@active WHERE id=@id", tbl("users"))
+	if _, err := db.Exec(query, sql.Named("active", val), sql.Named("id", id)); err != nil {
+		log.Printf("update active failed: %v", err)
 	}
 }
 
@@ -864,9 +1195,9 @@ func updateUser(id, name, stampkey, email, password, role, position, departmentI
 func getUserByEmail(email string) (User, bool) {
 	db := getDB()
 	defer db.Close()
-	query := fmt.Sprintf("SELECT id, name, email, COALESCE(password,''), COALESCE(role,'user'), stampkey, position, COALESCE(department_id,0), COALESCE(auto_checkout_midnight,0) FROM %s WHERE email=@mail", tbl("users"))
+	query := fmt.Sprintf("SELECT id, name, email, COALESCE(password,''), COALESCE(role,'user'), stampkey, position, COALESCE(department_id,0), COALESCE(auto_checkout_midnight,0), COALESCE(active,1) FROM %s WHERE email=@mail", tbl("users"))
 	var u User
-	if err := db.QueryRow(query, sql.Named("mail", email)).Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Stampkey, &u.Position, &u.DepartmentID, &u.AutoCheckoutMidnight); err != nil {
+	if err := db.QueryRow(query, sql.Named("mail", email)).Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Stampkey, &u.Position, &u.DepartmentID, &u.AutoCheckoutMidnight, &u.Active); err != nil {
 		return User{}, false
 	}
 	return u, true
@@ -876,9 +1207,9 @@ func getUserByEmail(email string) (User, bool) {
 func getUserByName(name string) (User, bool) {
 	db := getDB()
 	defer db.Close()
-	query := fmt.Sprintf("SELECT id, name, stampkey, email, COALESCE(password,''), COALESCE(role,'user'), position, COALESCE(department_id,0), COALESCE(auto_checkout_midnight,0) FROM %s WHERE name=@name", tbl("users"))
+	query := fmt.Sprintf("SELECT id, name, stampkey, email, COALESCE(password,''), COALESCE(role,'user'), position, COALESCE(department_id,0), COALESCE(auto_checkout_midnight,0), COALESCE(active,1) FROM %s WHERE name=@name", tbl("users"))
 	var u User
-	if err := db.QueryRow(query, sql.Named("name", name)).Scan(&u.ID, &u.Name, &u.Stampkey, &u.Email, &u.Password, &u.Role, &u.Position, &u.DepartmentID, &u.AutoCheckoutMidnight); err != nil {
+	if err := db.QueryRow(query, sql.Named("name", name)).Scan(&u.ID, &u.Name, &u.Stampkey, &u.Email, &u.Password, &u.Role, &u.Position, &u.DepartmentID, &u.AutoCheckoutMidnight, &u.Active); err != nil {
 		return User{}, false
 	}
 	return u, true
@@ -897,6 +1228,15 @@ func getCurrentStatusForUserID(userID int) (status string, at time.Time, ok bool
 	return s, t, true
 }
 
+// dailyWorkHours sums the work hours of a user (by name as in view) on day (YYYY-MM-DD)
+func dailyWorkHours(userName, day string) float64 {
+	var hours float64
+	for _, wh := range getWorkHoursDataFiltered(day, day, userName, "") {
+		hours += wh.WorkHours
+	}
+	return hours
+}
+
 // Work hours filtered for a single user (by user name as in view)
 func getWorkHoursDataForUser(userName string) []WorkHoursData {
 	db := getDB()
@@ -919,27 +1259,73 @@ func getWorkHoursDataForUser(userName string) []WorkHoursData {
 	return list
 }
 
-func updateActivity(id, status, work, comment string) {
+func updateActivity(id, status, work, comment, code string) error {
 	db := getDB()
 	defer db.Close()
 
 	workInt, _ := strconv.Atoi(work)
 	query := fmt.Sprintf(`UPDATE %s
-	                      SET status=@status, work=@work, comment=@comment
+	                      SET status=@status, work=@work, comment=@comment, code=@code
 	                      WHERE id=@id`, tbl("type"))
 	_, err := db.Exec(query,
 		sql.Named("status", status),
 		sql.Named("work", workInt),
 		sql.Named("comment", comment),
+		sql.Named("code", activityCodeValue(code)),
 		sql.Named("id", id),
 	)
 	if err != nil {
 		log.Printf("updateActivity failed: %v", err)
 	}
+	return err
+}
+
+// setActivityCommentRequired marks an activity as needing a comment when stamped interactively
+func setActivityCommentRequired(id string, required bool) {
+	db := getDB()
+	defer db.Close()
+	v := 0
+	if required {
+		v = 1
+	}
+	query := fmt.Sprintf("UPDATE %s SET comment_required=@v WHERE id=@id", tbl("type"))
+	if _, err := db.Exec(query, sql.Named("v", v), sql.Named("id", id)); err != nil {
+		log.Printf("setActivityCommentRequired failed: %v", err)
+	}
+}
+
+// setActivityBillable marks an activity's hours as billable to clients
+func setActivityBillable(id string, billable bool) {
+	db := getDB()
+	defer db.Close()
+	v := 0
+	if billable {
+		v = 1
+	}
+	query := fmt.Sprintf("UPDATE %s SET billable=@v WHERE id=@id", tbl("type"))
+	if _, err := db.Exec(query, sql.Named("v", v), sql.Named("id", id)); err != nil {
+		log.Printf("setActivityBillable failed: %v", err)
+	}
+}
+
+// setDepartmentToggle sets the toggle stamping activities of a department (0 = tenant default)
+func setDepartmentToggle(id string, workID, offID int) {
+	db := getDB()
+	defer db.Close()
+	nullable := func(v int) any {
+		if v <= 0 {
+			return nil
+		}
+		return v
+	}
+	query := fmt.Sprintf("UPDATE %s SET toggle_work_type_id=@w, toggle_off_type_id=@o WHERE id=@id", tbl("departments"))
+	if _, err := db.Exec(query, sql.Named("w", nullable(workID)), sql.Named("o", nullable(offID)), sql.Named("id", id)); err != nil {
+		log.Printf("setDepartmentToggle failed: %v", err)
+	}
 }
 
 // Additional CRUD functions for editing
-func updateDepartment(id, name string) {
+func updateDepartment(id, name string) error {
 	db := getDB()
 	defer db.Close()
 
@@ -949,27 +1335,50 @@ func updateDepartment(id, name string) {
 		sql.Named("id", id),
 	)
 	if err != nil {
-		log.Printf("updateEntry failed: %v", err)
+		log.Printf("updateDepartment failed: %v", err)
 	}
+	return err
 }
 
-func updateEntry(id, userID, activityID, date, comment string) {
+// updateEntry writes all fields of an entry in one statement; projectID and
+// taskID 0 book it to no project
+func updateEntry(id, userID, activityID, date, comment string, projectID, taskID int) error {
 	db := getDB()
 	defer db.Close()
 
 	query := fmt.Sprintf(`UPDATE %s
-	                      SET user_id=@uid, type_id=@aid, date=@date, comment=@comment
+	                      SET user_id=@uid, type_id=@aid, date=@date, comment=@comment,
+	                          project_id=@pid, task_id=@tid
 	                      WHERE id=@id`, tbl("entries"))
 	_, err := db.Exec(query,
 		sql.Named("uid", userID),
 		sql.Named("aid", activityID),
 		sql.Named("date", date),
 		sql.Named("comment", comment),
+		sql.Named("pid", refValue(projectID)),
+		sql.Named("tid", refValue(taskID)),
 		sql.Named("id", id),
 	)
 	if err != nil {
-		log.Printf("deleteEntry failed: %v", err)
+		log.Printf("updateEntry failed: %v", err)
+		return err
 	}
+	notifyStatusChange()
+	emitEntryEvent("entry.updated", int64(atoiDefault(id, 0)))
+	return nil
+}
+
+// setEntryComment stores the free-text comment of an entry
+func setEntryComment(id int64, comment string) error {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("UPDATE %s SET comment=@comment WHERE id=@id", tbl("entries"))
+	_, err := db.Exec(query, sql.Named("comment", comment), sql.Named("id", id))
+	if err != nil {
+		log.Printf("setEntryComment failed: %v", err)
+	}
+	return err
 }
 
 func getEntry(id string) EntryDetail {
@@ -991,7 +1400,7 @@ func getEntry(id string) EntryDetail {
 				 WHERE next_e.user_id = e.user_id AND next_e.date > e.date), 
 				datetime('now')
 			) as end_time,
-			COALESCE(
+			MAX(COALESCE(
 				(JULIANDAY(
 					COALESCE(
 						(SELECT MIN(next_e.date) FROM %s next_e 
@@ -999,18 +1408,22 @@ func getEntry(id string) EntryDetail {
 						datetime('now')
 					)
 				) - JULIANDAY(e.date)) * 24, 0
-			) as duration,
-			COALESCE(e.comment, '') as comment
+			), 0) as duration,
+			COALESCE(e.comment, '') as comment,
+			COALESCE(e.project_id, 0), COALESCE(p.name, ''), COALESCE(e.task_id, 0), COALESCE(k.name, '')
 		FROM %s e
 		JOIN %s u ON e.user_id = u.id
 		LEFT JOIN %s d ON u.department_id = d.id
 		JOIN %s t ON e.type_id = t.id
+		LEFT JOIN %s p ON p.id = e.project_id
+		LEFT JOIN %s k ON k.id = e.task_id
 		WHERE e.id = @id
-	`, tbl("entries"), tbl("entries"), tbl("entries"), tbl("users"), tbl("departments"), tbl("type"))
+	`, tbl("entries"), tbl("entries"), tbl("entries"), tbl("users"), tbl("departments"), tbl("type"), tbl("projects"), tbl("tasks"))
 
 	var e EntryDetail
 	if err := db.QueryRow(query, sql.Named("id", id)).
-		Scan(&e.ID, &e.UserID, &e.UserName, &e.Department, &e.ActivityID, &e.Activity, &e.Date, &e.Start, &e.End, &e.Duration, &e.Comment); err != nil {
+		Scan(&e.ID, &e.UserID, &e.UserName, &e.Department, &e.ActivityID, &e.Activity, &e.Date, &e.Start, &e.End, &e.Duration, &e.Comment,
+			&e.ProjectID, &e.Project, &e.TaskID, &e.Task); err != nil {
 		log.Printf("Get entry failed: %v", err)
 		return EntryDetail{}
 	}
@@ -1018,43 +1431,62 @@ func getEntry(id string) EntryDetail {
 }
 
 // Delete functions
-func deleteEntry(id string) {
+func deleteEntry(id string) error {
 	db := getDB()
 	defer db.Close()
 
+	// keep the entry for the webhook payload
+	var gone EntryDetail
+	if webhookSubscribed("entry.deleted") {
+		gone = getEntry(id)
+	}
 	query := fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("entries"))
 	_, err := db.Exec(query, sql.Named("id", id))
 	if err != nil {
-		log.Printf("deleteActivity failed: %v", err)
+		log.Printf("deleteEntry failed: %v", err)
+		return err
 	}
+	notifyStatusChange()
+	emitEvent("entry.deleted", func() any { return apiEntry(gone) })
+	return nil
 }
 
-func deleteActivity(id string) {
+func deleteActivity(id string) error {
 	db := getDB()
 	defer db.Close()
 
 	query := fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("type"))
 	_, err := db.Exec(query, sql.Named("id", id))
 	if err != nil {
-		log.Printf("deleteDepartment failed: %v", err)
+		log.Printf("deleteActivity failed: %v", err)
 	}
+	return err
 }
 
-func deleteDepartment(id string) {
+func deleteDepartment(id string) error {
 	db := getDB()
 	defer db.Close()
 
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE department_id=@id", tbl("geofences")), sql.Named("id", id)); err != nil {
+		log.Printf("deleteDepartment geofences failed: %v", err)
+	}
 	query := fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("departments"))
 	_, err := db.Exec(query, sql.Named("id", id))
 	if err != nil {
-		log.Printf("deleteUser entries failed: %v", err)
+		log.Printf("deleteDepartment failed: %v", err)
 	}
+	return err
 }
 
-func deleteUser(id string) {
+func deleteUser(id string) error {
 	db := getDB()
 	defer db.Close()
 
+	var gone User
+	if webhookSubscribed("user.deleted") {
+		gone = getUser(id)
+	}
+
 	// First delete all entries for this user
 	query := fmt.Sprintf("DELETE FROM %s WHERE user_id=@id", tbl("entries"))
 	_, err := db.Exec(query, sql.Named("id", id))
@@ -1062,12 +1494,20 @@ func deleteUser(id string) {
 		log.Printf("deleteUser failed: %v", err)
 	}
 
+	// Drop 2FA recovery codes, pending reset links and personal API tokens
+	deleteRecoveryCodes(atoiDefault(id, 0))
+	deletePasswordResetTokens(atoiDefault(id, 0))
+	deleteUserAPITokens(atoiDefault(id, 0))
+
 	// Then delete the user
 	query = fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("users"))
 	_, err = db.Exec(query, sql.Named("id", id))
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("deleteUser failed: %v", err)
+		return err
 	}
+	emitEvent("user.deleted", func() any { return toAPIUser(gone) })
+	return nil
 }
 
 //---------------------------------------------------------------------
@@ -1167,6 +1607,10 @@ type EntryDetail struct {
 	End        string
 	Duration   float64
 	Comment    string
+	ProjectID  int
+	Project    string
+	TaskID     int
+	Task       string
 }
 
 // Enhanced statistics functions
@@ -1468,10 +1912,19 @@ func getDepartmentSummaryOnDay(day string) []DepartmentSummary {
 	return list
 }
 
-func getEntriesWithDetails() []EntryDetail {
+// getEntriesWithDetails returns the latest 1000 entries, optionally only
+// those whose comment contains commentQuery
+func getEntriesWithDetails(commentQuery string) []EntryDetail {
 	db := getDB()
 	defer db.Close()
 
+	where := ""
+	var args []any
+	if q := strings.TrimSpace(commentQuery); q != "" {
+		where = "WHERE e.comment LIKE @q"
+		args = append(args, sql.Named("q", "%"+q+"%"))
+	}
+
 	// Select next event end_time without doing duration math in SQL to avoid
 	// timezone differences between SQLite datetime('now') (UTC) and local times.
 	query := fmt.Sprintf(`
@@ -1486,16 +1939,21 @@ func getEntriesWithDetails() []EntryDetail {
 			e.date as start_time,
 			(SELECT MIN(next_e.date) FROM %s next_e 
 			 WHERE next_e.user_id = e.user_id AND next_e.date > e.date) as end_time,
-			COALESCE(e.comment, '') as comment
+			COALESCE(e.comment, '') as comment,
+			COALESCE(p.name, '') as project,
+			COALESCE(k.name, '') as task
 		FROM %s e
 		JOIN %s u ON e.user_id = u.id
 		LEFT JOIN %s d ON u.department_id = d.id
 		JOIN %s t ON e.type_id = t.id
+		LEFT JOIN %s p ON p.id = e.project_id
+		LEFT JOIN %s k ON k.id = e.task_id
+		%s
 		ORDER BY e.date DESC
 		LIMIT 1000
-	`, tbl("entries"), tbl("entries"), tbl("users"), tbl("departments"), tbl("type"))
+	`, tbl("entries"), tbl("entries"), tbl("users"), tbl("departments"), tbl("type"), tbl("projects"), tbl("tasks"), where)
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Printf("Query entries with details failed: %v", err)
 		return nil
@@ -1506,7 +1964,7 @@ func getEntriesWithDetails() []EntryDetail {
 	for rows.Next() {
 		var e EntryDetail
 		var end sql.NullString
-		if err := rows.Scan(&e.ID, &e.UserID, &e.UserName, &e.Department, &e.ActivityID, &e.Activity, &e.Date, &e.Start, &end, &e.Comment); err != nil {
+		if err := rows.Scan(&e.ID, &e.UserID, &e.UserName, &e.Department, &e.ActivityID, &e.Activity, &e.Date, &e.Start, &end, &e.Comment, &e.Project, &e.Task); err != nil {
 			log.Printf("Scan entry detail failed: %v", err)
 			continue
 		}
@@ -1550,7 +2008,7 @@ func getEntriesForDepartmentOnDay(deptName, day string) []EntryDetail {
 				 WHERE next_e.user_id = e.user_id AND next_e.date > e.date), 
 				datetime('now')
 			) as end_time,
-			COALESCE(
+			MAX(COALESCE(
 				(JULIANDAY(
 					COALESCE(
 						(SELECT MIN(next_e.date) FROM %s next_e 
@@ -1558,7 +2016,7 @@ func getEntriesForDepartmentOnDay(deptName, day string) []EntryDetail {
 						datetime('now')
 					)
 				) - JULIANDAY(e.date)) * 24, 0
-			) as duration,
+			), 0) as duration,
 			COALESCE(e.comment, '') as comment
 		FROM %s e
 		JOIN %s u ON e.user_id = u.id
@@ -1599,7 +2057,8 @@ func getCalendarEntries(startDate, endDate time.Time, userFilter, activityFilter
 			u.name as user_name,
 			t.status as activity,
 			t.work as is_work,
-			COALESCE(
+			COALESCE(e.comment, '') as comment,
+			MAX(COALESCE(
 				(JULIANDAY(
 					COALESCE(
 						(SELECT MIN(next_e.date) FROM %s next_e 
@@ -1607,7 +2066,7 @@ func getCalendarEntries(startDate, endDate time.Time, userFilter, activityFilter
 						datetime('now')
 					)
 				) - JULIANDAY(e.date)) * 24, 0
-			) as hours
+			), 0) as hours
 		FROM %s e
 		INNER JOIN %s u ON u.id = e.user_id
 		INNER JOIN %s t ON t.id = e.type_id
@@ -1642,7 +2101,7 @@ func getCalendarEntries(startDate, endDate time.Time, userFilter, activityFilter
 	for rows.Next() {
 		var entry CalendarEntry
 		var isWork int
-		if err := rows.Scan(&entry.Date, &entry.UserName, &entry.Activity, &isWork, &entry.Hours); err != nil {
+		if err := rows.Scan(&entry.Date, &entry.UserName, &entry.Activity, &isWork, &entry.Comment, &entry.Hours); err != nil {
 			log.Printf("Scan calendar entry failed: %v", err)
 			continue
 		}
@@ -1663,26 +2122,29 @@ func getEntriesWithDetailsFiltered(fromDate, toDate, department, user, activity,
         SELECT e.id, e.user_id, u.name as user_name, 
                COALESCE(d.name, 'No Department') as department,
                e.type_id, t.status as activity, 
-               DATE(e.timestamp) as date,
-               TIME(e.timestamp) as start_time,
+               DATE(e.date) as date,
+               TIME(e.date) as start_time,
                '' as end_time,
                0.0 as duration,
-               COALESCE(e.comment, '') as comment
+               COALESCE(e.comment, '') as comment,
+               COALESCE(e.project_id, 0), COALESCE(p.name, ''), COALESCE(e.task_id, 0), COALESCE(k.name, '')
         FROM %s e
         LEFT JOIN %s u ON e.user_id = u.id
         LEFT JOIN %s d ON u.department_id = d.id  
         LEFT JOIN %s t ON e.type_id = t.id
-        WHERE 1=1`, tbl("entries"), tbl("users"), tbl("departments"), tbl("type"))
+        LEFT JOIN %s p ON p.id = e.project_id
+        LEFT JOIN %s k ON k.id = e.task_id
+        WHERE 1=1`, tbl("entries"), tbl("users"), tbl("departments"), tbl("type"), tbl("projects"), tbl("tasks"))
 
 	var args []interface{}
 
 	// Add date range filters
 	if fromDate != "" {
-		query += " AND DATE(e.timestamp) >= ?"
+		query += " AND DATE(e.date) >= ?"
 		args = append(args, fromDate)
 	}
 	if toDate != "" {
-		query += " AND DATE(e.timestamp) <= ?"
+		query += " AND DATE(e.date) <= ?"
 		args = append(args, toDate)
 	}
 
@@ -1704,7 +2166,7 @@ func getEntriesWithDetailsFiltered(fromDate, toDate, department, user, activity,
 		args = append(args, activity)
 	}
 
-	query += " ORDER BY e.timestamp DESC"
+	query += " ORDER BY e.date DESC"
 
 	// Add limit for preview
 	if limit != "" && limit != "0" {
@@ -1724,7 +2186,8 @@ func getEntriesWithDetailsFiltered(fromDate, toDate, department, user, activity,
 	var list []EntryDetail
 	for rows.Next() {
 		var e EntryDetail
-		if err := rows.Scan(&e.ID, &e.UserID, &e.UserName, &e.Department, &e.ActivityID, &e.Activity, &e.Date, &e.Start, &e.End, &e.Duration, &e.Comment); err != nil {
+		if err := rows.Scan(&e.ID, &e.UserID, &e.UserName, &e.Department, &e.ActivityID, &e.Activity, &e.Date, &e.Start, &e.End, &e.Duration, &e.Comment,
+			&e.ProjectID, &e.Project, &e.TaskID, &e.Task); err != nil {
 			log.Printf("Scan filtered entry detail failed: %v", err)
 			continue
 		}
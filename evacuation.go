@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Evacuation roll-call. Starting an evacuation snapshots everybody whose
+// current status is a work activity; wardens then check people off at the
+// assembly point by scanning their stampkey (or by hand). Open roll-call
+// pages follow the progress over Server-Sent Events. Only one evacuation
+// per tenant can be active at a time.
+
+type Evacuation struct {
+	ID        int
+	StartedAt time.Time
+	StartedBy string
+	EndedAt   time.Time
+	EndedBy   string
+	Total     int
+	Checked   int
+}
+
+func (e Evacuation) Active() bool {
+	return e.EndedAt.IsZero()
+}
+
+func (e Evacuation) Missing() int {
+	return e.Total - e.Checked
+}
+
+type EvacuationPerson struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"userId"`
+	Name       string    `json:"name"`
+	Department string    `json:"department"`
+	Activity   string    `json:"activity"` // status at the start of the evacuation
+	Since      time.Time `json:"since"`
+	InSnapshot bool      `json:"inSnapshot"` // false: scanned but not stamped in
+	CheckedAt  time.Time `json:"checkedAt"`
+	CheckedBy  string    `json:"checkedBy"`
+	Method     string    `json:"method"` // scan or manual
+}
+
+func (p EvacuationPerson) Checked() bool {
+	return !p.CheckedAt.IsZero()
+}
+
+// evacuationBroker notifies open roll-call pages of a tenant about check-offs
+var evacuationBroker = &statusBroker{subs: map[string]map[chan struct{}]struct{}{}}
+
+//---------------------------------------------------------------------
+// Storage
+//---------------------------------------------------------------------
+
+const evacuationColumns = `e.id, e.started_at, COALESCE(e.started_by, ''), e.ended_at, COALESCE(e.ended_by, ''),
+	(SELECT COUNT(*) FROM %[2]s p WHERE p.evacuation_id = e.id),
+	(SELECT COUNT(*) FROM %[2]s p WHERE p.evacuation_id = e.id AND p.checked_at IS NOT NULL)`
+
+func queryEvacuations(where string, args ...any) []Evacuation {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT "+evacuationColumns+" FROM %[1]s e WHERE %[3]s ORDER BY e.started_at DESC",
+		tbl("evacuations"), tbl("evacuation_persons"), where)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("evacuations query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []Evacuation
+	for rows.Next() {
+		var e Evacuation
+		var started int64
+		var ended sql.NullInt64
+		if err := rows.Scan(&e.ID, &started, &e.StartedBy, &ended, &e.EndedBy, &e.Total, &e.Checked); err != nil {
+			log.Printf("evacuations scan failed: %v", err)
+			continue
+		}
+		e.StartedAt, e.EndedAt = time.Unix(started, 0), fromUnix(ended)
+		list = append(list, e)
+	}
+	return list
+}
+
+func getActiveEvacuation() (Evacuation, bool) {
+	list := queryEvacuations("e.ended_at IS NULL")
+	if len(list) == 0 {
+		return Evacuation{}, false
+	}
+	return list[0], true
+}
+
+func getEvacuation(id string) (Evacuation, bool) {
+	list := queryEvacuations("e.id=@id", sql.Named("id", id))
+	if len(list) == 0 {
+		return Evacuation{}, false
+	}
+	return list[0], true
+}
+
+func getEvacuations() []Evacuation {
+	return queryEvacuations("1=1")
+}
+
+// startEvacuation opens a roll-call with everybody currently in a work
+// status. started is false when another roll-call is already running; the
+// conditional insert keeps two wardens pressing start at once from opening two.
+func startEvacuation(by string) (id int64, started bool, err error) {
+	db := getDB()
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	lock := ""
+	if dbBackend == "mssql" {
+		lock = " WITH (UPDLOCK, HOLDLOCK)"
+	}
+	insert := fmt.Sprintf(`INSERT INTO %s (started_at, started_by) SELECT @now, @by
+		WHERE NOT EXISTS (SELECT 1 FROM %s%s WHERE ended_at IS NULL)`, tbl("evacuations"), tbl("evacuations"), lock)
+	res, err := tx.Exec(insert, sql.Named("now", time.Now().Unix()), sql.Named("by", by))
+	if err != nil {
+		log.Printf("startEvacuation failed: %v", err)
+		return 0, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, false, err
+	}
+	// the new roll-call is the only active one
+	if err := tx.QueryRow(fmt.Sprintf("SELECT id FROM %s WHERE ended_at IS NULL", tbl("evacuations"))).Scan(&id); err != nil {
+		log.Printf("startEvacuation id failed: %v", err)
+		return 0, false, err
+	}
+
+	query := fmt.Sprintf(`SELECT cs.user_id, cs.user_name, COALESCE(d.name, ''), cs.status, cs.date
+		FROM %s cs
+		JOIN %s t ON t.id = cs.type_id
+		JOIN %s u ON u.id = cs.user_id
+		LEFT JOIN %s d ON d.id = u.department_id
+		WHERE t.work = 1`, tbl("current_status"), tbl("type"), tbl("users"), tbl("departments"))
+	rows, err := tx.Query(query)
+	if err != nil {
+		log.Printf("startEvacuation snapshot failed: %v", err)
+		return 0, false, err
+	}
+	var people []EvacuationPerson
+	seen := map[int]bool{}
+	for rows.Next() {
+		var p EvacuationPerson
+		if err := rows.Scan(&p.UserID, &p.Name, &p.Department, &p.Activity, &p.Since); err != nil {
+			log.Printf("startEvacuation scan failed: %v", err)
+			continue
+		}
+		if !seen[p.UserID] {
+			seen[p.UserID] = true
+			people = append(people, p)
+		}
+	}
+	rows.Close()
+
+	insert = fmt.Sprintf(`INSERT INTO %s (evacuation_id, user_id, user_name, department, activity, since, in_snapshot)
+		VALUES (@eid, @uid, @name, @dept, @activity, @since, 1)`, tbl("evacuation_persons"))
+	for _, p := range people {
+		if _, err := tx.Exec(insert, sql.Named("eid", id), sql.Named("uid", p.UserID), sql.Named("name", p.Name),
+			sql.Named("dept", p.Department), sql.Named("activity", p.Activity), sql.Named("since", p.Since.Unix())); err != nil {
+			log.Printf("startEvacuation insert person failed: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	log.Printf("evacuation %d started by %s with %d persons", id, by, len(people))
+	return id, true, nil
+}
+
+func getEvacuationPersons(evacuationID int) []EvacuationPerson {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf(`SELECT id, user_id, user_name, COALESCE(department, ''), COALESCE(activity, ''), since, in_snapshot,
+		checked_at, COALESCE(checked_by, ''), COALESCE(method, '')
+		FROM %s WHERE evacuation_id=@eid ORDER BY department, user_name`, tbl("evacuation_persons"))
+	rows, err := db.Query(query, sql.Named("eid", evacuationID))
+	if err != nil {
+		log.Printf("getEvacuationPersons query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []EvacuationPerson
+	for rows.Next() {
+		var p EvacuationPerson
+		var since, checked sql.NullInt64
+		var inSnapshot int
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &p.Department, &p.Activity, &since, &inSnapshot, &checked, &p.CheckedBy, &p.Method); err != nil {
+			log.Printf("getEvacuationPersons scan failed: %v", err)
+			continue
+		}
+		p.Since, p.CheckedAt, p.InSnapshot = fromUnix(since), fromUnix(checked), inSnapshot == 1
+		list = append(list, p)
+	}
+	return list
+}
+
+// checkEvacuationPerson marks a user as arrived. The result is "checked",
+// "already" or "added" (arrived but was not stamped in).
+func checkEvacuationPerson(evacuationID int, u User, by, method string) (string, error) {
+	db := getDB()
+	defer db.Close()
+
+	var id int
+	var checked sql.NullInt64
+	query := fmt.Sprintf("SELECT id, checked_at FROM %s WHERE evacuation_id=@eid AND user_id=@uid", tbl("evacuation_persons"))
+	err := db.QueryRow(query, sql.Named("eid", evacuationID), sql.Named("uid", u.ID)).Scan(&id, &checked)
+	now := time.Now().Unix()
+	switch {
+	case err == sql.ErrNoRows:
+		dept := ""
+		if u.DepartmentID != 0 {
+			dept = getDepartment(strconv.Itoa(u.DepartmentID)).Name
+		}
+		insert := fmt.Sprintf(`INSERT INTO %s (evacuation_id, user_id, user_name, department, in_snapshot, checked_at, checked_by, method)
+			VALUES (@eid, @uid, @name, @dept, 0, @now, @by, @method)`, tbl("evacuation_persons"))
+		if _, err := db.Exec(insert, sql.Named("eid", evacuationID), sql.Named("uid", u.ID), sql.Named("name", u.Name), sql.Named("dept", dept),
+			sql.Named("now", now), sql.Named("by", by), sql.Named("method", method)); err != nil {
+			log.Printf("checkEvacuationPerson insert failed: %v", err)
+			return "", err
+		}
+		return "added", nil
+	case err != nil:
+		log.Printf("checkEvacuationPerson lookup failed: %v", err)
+		return "", err
+	case checked.Valid:
+		return "already", nil
+	}
+	update := fmt.Sprintf("UPDATE %s SET checked_at=@now, checked_by=@by, method=@method WHERE id=@id", tbl("evacuation_persons"))
+	if _, err := db.Exec(update, sql.Named("now", now), sql.Named("by", by), sql.Named("method", method), sql.Named("id", id)); err != nil {
+		log.Printf("checkEvacuationPerson update failed: %v", err)
+		return "", err
+	}
+	return "checked", nil
+}
+
+func endEvacuation(id int, by string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET ended_at=@now, ended_by=@by WHERE id=@id AND ended_at IS NULL", tbl("evacuations"))
+	if _, err := db.Exec(query, sql.Named("now", time.Now().Unix()), sql.Named("by", by), sql.Named("id", id)); err != nil {
+		log.Printf("endEvacuation failed: %v", err)
+	}
+}
+
+//---------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------
+
+func sessionUsername(r *http.Request) string {
+	session, _ := store.Get(r, "session")
+	name, _ := session.Values["username"].(string)
+	return name
+}
+
+// evacuationHandler shows the running roll-call, or the start button and past evacuations
+func evacuationHandler(w http.ResponseWriter, r *http.Request) {
+	if e, ok := getActiveEvacuation(); ok {
+		renderTemplate(w, r, "evacuation", map[string]any{"Active": e})
+		return
+	}
+	renderTemplate(w, r, "evacuation", map[string]any{"History": getEvacuations()})
+}
+
+func evacuationStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, started, err := startEvacuation(sessionUsername(r))
+	if err != nil {
+		renderInternalServerError(w, err)
+		return
+	}
+	if started {
+		evacuationBroker.publish(requestHost(r))
+	}
+	http.Redirect(w, r, "/evacuation", http.StatusSeeOther)
+}
+
+func evacuationEndHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e, ok := getActiveEvacuation()
+	if !ok {
+		http.Redirect(w, r, "/evacuation", http.StatusSeeOther)
+		return
+	}
+	endEvacuation(e.ID, sessionUsername(r))
+	evacuationBroker.publish(requestHost(r))
+	http.Redirect(w, r, fmt.Sprintf("/evacuation/report?id=%d", e.ID), http.StatusSeeOther)
+}
+
+// evacuationCheckHandler checks a person off by scanned stampkey ("code") or
+// by user id ("user_id", manual) and answers with JSON for the scan page
+func evacuationCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e, ok := getActiveEvacuation()
+	if !ok {
+		writeJSON(w, http.StatusConflict, map[string]string{"result": "inactive"})
+		return
+	}
+	method, userID := "scan", ""
+	if code := strings.TrimSpace(r.FormValue("code")); code != "" {
+		userID = getUserIDFromStampKey(scannedCode(code, "USR"))
+	} else if id := r.FormValue("user_id"); id != "" {
+		method, userID = "manual", id
+	}
+	var u User
+	if userID != "" {
+		u = getUser(userID)
+	}
+	if u.ID == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"result": "unknown"})
+		return
+	}
+	result, err := checkEvacuationPerson(e.ID, u, sessionUsername(r), method)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"result": "error", "message": err.Error()})
+		return
+	}
+	evacuationBroker.publish(requestHost(r))
+	writeJSON(w, http.StatusOK, map[string]string{"result": result, "name": u.Name})
+}
+
+type evacuationSnapshot struct {
+	Active    bool               `json:"active"`
+	ID        int                `json:"id"`
+	StartedAt time.Time          `json:"startedAt"`
+	Total     int                `json:"total"`
+	Checked   int                `json:"checked"`
+	Missing   []EvacuationPerson `json:"missing"`
+	Arrived   []EvacuationPerson `json:"arrived"`
+}
+
+func currentEvacuationSnapshot() evacuationSnapshot {
+	e, ok := getActiveEvacuation()
+	if !ok {
+		return evacuationSnapshot{}
+	}
+	snap := evacuationSnapshot{Active: true, ID: e.ID, StartedAt: e.StartedAt, Total: e.Total, Checked: e.Checked,
+		Missing: []EvacuationPerson{}, Arrived: []EvacuationPerson{}}
+	for _, p := range getEvacuationPersons(e.ID) {
+		if p.Checked() {
+			snap.Arrived = append(snap.Arrived, p)
+		} else {
+			snap.Missing = append(snap.Missing, p)
+		}
+	}
+	return snap
+}
+
+// evacuationEventsHandler streams the roll-call state as Server-Sent Events
+func evacuationEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	host := requestHost(r)
+	ch := evacuationBroker.subscribe(host)
+	defer evacuationBroker.unsubscribe(host, ch)
+
+	send := func() bool {
+		data, _ := json.Marshal(currentEvacuationSnapshot())
+		if _, err := fmt.Fprintf(w, "event: rollcall\ndata: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	if !send() {
+		return
+	}
+	keepAlive := time.NewTicker(boardKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			if !send() {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// evacuationReportHandler shows the timestamped report of an evacuation (?format=csv to download)
+func evacuationReportHandler(w http.ResponseWriter, r *http.Request) {
+	e, ok := getEvacuation(r.URL.Query().Get("id"))
+	if !ok {
+		renderNotFound(w)
+		return
+	}
+	persons := getEvacuationPersons(e.ID)
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=evacuation_%d_%s.csv", e.ID, e.StartedAt.Format("20060102_1504")))
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"name", "department", "status_at_start", "since", "stamped_in", "checked_at", "checked_by", "method"})
+		for _, p := range persons {
+			row := []string{p.Name, p.Department, p.Activity, "", strconv.FormatBool(p.InSnapshot), "", p.CheckedBy, p.Method}
+			if !p.Since.IsZero() {
+				row[3] = p.Since.Format(time.RFC3339)
+			}
+			if p.Checked() {
+				row[5] = p.CheckedAt.Format(time.RFC3339)
+			}
+			_ = cw.Write(row)
+		}
+		cw.Flush()
+		return
+	}
+	var missing, arrived, extra []EvacuationPerson
+	for _, p := range persons {
+		switch {
+		case !p.InSnapshot:
+			extra = append(extra, p)
+		case p.Checked():
+			arrived = append(arrived, p)
+		default:
+			missing = append(missing, p)
+		}
+	}
+	renderTemplate(w, r, "evacuationReport", map[string]any{
+		"Evacuation":  e,
+		"Missing":     missing,
+		"Arrived":     arrived,
+		"Extra":       extra,
+		"GeneratedAt": time.Now(),
+	})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mobile self-stamping with optional location. /mobile lets a logged-in
+// user stamp from the phone and send the browser's position along. Each
+// department may define circular geofences; a stamp outside all of them,
+// or without a position where fences exist, is stored anyway and flagged
+// for review on /admin/geoReview.
+
+// geofence results stored in entries.geofence; "" means nothing to check
+const (
+	geoInside     = "inside"
+	geoOutside    = "outside"
+	geoNoLocation = "no_location"
+)
+
+const geoMaxAccuracy = 5000.0 // metres; coarser positions are ignored
+
+type Geofence struct {
+	ID           int
+	DepartmentID int
+	Name         string
+	Latitude     float64
+	Longitude    float64
+	Radius       float64 // metres
+}
+
+// Location is a browser position with its accuracy radius in metres
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Accuracy  float64 `json:"accuracy"`
+}
+
+func (l Location) valid() bool {
+	return l.Latitude >= -90 && l.Latitude <= 90 && l.Longitude >= -180 && l.Longitude <= 180 &&
+		!(l.Latitude == 0 && l.Longitude == 0) && l.Accuracy >= 0 && l.Accuracy <= geoMaxAccuracy
+}
+
+// distanceMeters is the great-circle distance (haversine)
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000.0
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// checkGeofences classifies loc against the fences and returns the nearest
+// fence with the distance to its edge. The position's accuracy counts in
+// the user's favour, up to the fence's own radius.
+func checkGeofences(fences []Geofence, loc *Location) (result string, nearest Geofence, outBy float64) {
+	if len(fences) == 0 {
+		return "", Geofence{}, 0
+	}
+	if loc == nil {
+		return geoNoLocation, Geofence{}, 0
+	}
+	outBy = math.Inf(1)
+	for _, f := range fences {
+		d := distanceMeters(loc.Latitude, loc.Longitude, f.Latitude, f.Longitude) - f.Radius
+		if d < outBy {
+			nearest, outBy = f, d
+		}
+		if d <= math.Min(loc.Accuracy, f.Radius) {
+			return geoInside, f, 0
+		}
+	}
+	return geoOutside, nearest, outBy
+}
+
+//---------------------------------------------------------------------
+// DB access
+//---------------------------------------------------------------------
+
+func getGeofences(departmentID int) []Geofence {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT id, department_id, name, latitude, longitude, radius FROM %s WHERE department_id=@dep ORDER BY name", tbl("geofences"))
+	rows, err := db.Query(query, sql.Named("dep", departmentID))
+	if err != nil {
+		log.Printf("getGeofences query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []Geofence
+	for rows.Next() {
+		var f Geofence
+		if err := rows.Scan(&f.ID, &f.DepartmentID, &f.Name, &f.Latitude, &f.Longitude, &f.Radius); err != nil {
+			log.Printf("getGeofences scan failed: %v", err)
+			continue
+		}
+		list = append(list, f)
+	}
+	return list
+}
+
+func addGeofence(f Geofence) error {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("INSERT INTO %s (department_id, name, latitude, longitude, radius) VALUES (@dep, @name, @lat, @lon, @radius)", tbl("geofences"))
+	_, err := db.Exec(query, sql.Named("dep", f.DepartmentID), sql.Named("name", f.Name), sql.Named("lat", f.Latitude),
+		sql.Named("lon", f.Longitude), sql.Named("radius", f.Radius))
+	if err != nil {
+		log.Printf("addGeofence failed: %v", err)
+	}
+	return err
+}
+
+func deleteGeofence(id, departmentID string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("DELETE FROM %s WHERE id=@id AND department_id=@dep", tbl("geofences"))
+	if _, err := db.Exec(query, sql.Named("id", id), sql.Named("dep", departmentID)); err != nil {
+		log.Printf("deleteGeofence failed: %v", err)
+	}
+}
+
+// setEntryLocation stores the position (nil: none sent) and geofence result
+func setEntryLocation(entryID int64, loc *Location, result string) {
+	db := getDB()
+	defer db.Close()
+	var lat, lon, acc, res any
+	if loc != nil {
+		lat, lon, acc = loc.Latitude, loc.Longitude, loc.Accuracy
+	}
+	if result != "" {
+		res = result
+	}
+	query := fmt.Sprintf("UPDATE %s SET latitude=@lat, longitude=@lon, location_accuracy=@acc, geofence=@res WHERE id=@id", tbl("entries"))
+	if _, err := db.Exec(query, sql.Named("lat", lat), sql.Named("lon", lon), sql.Named("acc", acc), sql.Named("res", res), sql.Named("id", entryID)); err != nil {
+		log.Printf("setEntryLocation failed: %v", err)
+	}
+}
+
+// EntryLocation is the stored position of an entry and its review state
+type EntryLocation struct {
+	EntryID    int
+	UserID     int
+	UserName   string
+	Department string
+	Activity   string
+	Date       time.Time
+	Location   *Location
+	Geofence   string
+	ReviewedBy string
+	ReviewedAt time.Time
+}
+
+// Flagged reports stamps a manager should look at
+func (l EntryLocation) Flagged() bool {
+	return l.Geofence == geoOutside || l.Geofence == geoNoLocation
+}
+
+// MapURL links the position on OpenStreetMap
+func (l EntryLocation) MapURL() string {
+	if l.Location == nil {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f#map=17/%.6f/%.6f",
+		l.Location.Latitude, l.Location.Longitude, l.Location.Latitude, l.Location.Longitude)
+}
+
+const entryLocationColumns = `e.id, e.user_id, u.name, COALESCE(d.name, ''), t.status, e.date, e.latitude, e.longitude,
+	COALESCE(e.location_accuracy, 0), COALESCE(e.geofence, ''), COALESCE(e.geo_reviewed_by, ''), e.geo_reviewed_at`
+
+func entryLocationFrom() string {
+	return fmt.Sprintf(`FROM %s e JOIN %s u ON u.id = e.user_id JOIN %s t ON t.id = e.type_id
+		LEFT JOIN %s d ON d.id = u.department_id`, tbl("entries"), tbl("users"), tbl("type"), tbl("departments"))
+}
+
+func scanEntryLocation(scan func(...any) error) (EntryLocation, error) {
+	var l EntryLocation
+	var lat, lon sql.NullFloat64
+	var acc float64
+	var reviewed sql.NullInt64
+	if err := scan(&l.EntryID, &l.UserID, &l.UserName, &l.Department, &l.Activity, &l.Date, &lat, &lon, &acc, &l.Geofence, &l.ReviewedBy, &reviewed); err != nil {
+		return l, err
+	}
+	if lat.Valid && lon.Valid {
+		l.Location = &Location{Latitude: lat.Float64, Longitude: lon.Float64, Accuracy: acc}
+	}
+	l.ReviewedAt = fromUnix(reviewed)
+	return l, nil
+}
+
+// getEntryLocation returns the position stamped with an entry, if any
+func getEntryLocation(entryID string) (EntryLocation, bool) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("SELECT %s %s WHERE e.id=@id", entryLocationColumns, entryLocationFrom())
+	l, err := scanEntryLocation(db.QueryRow(query, sql.Named("id", entryID)).Scan)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("getEntryLocation failed: %v", err)
+		}
+		return EntryLocation{}, false
+	}
+	return l, l.Location != nil || l.Geofence != ""
+}
+
+// getGeoReviews lists flagged stamps of a department (0: all), open ones
+// first, then the latest reviewed
+func getGeoReviews(departmentID, limit int) []EntryLocation {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`SELECT %s %s WHERE e.geofence IN (@out, @none) AND (@dep = 0 OR u.department_id = @dep)
+		ORDER BY CASE WHEN e.geo_reviewed_at IS NULL THEN 0 ELSE 1 END, e.date DESC`, entryLocationColumns, entryLocationFrom())
+	rows, err := db.Query(query, sql.Named("out", geoOutside), sql.Named("none", geoNoLocation), sql.Named("dep", departmentID))
+	if err != nil {
+		log.Printf("getGeoReviews query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []EntryLocation
+	for rows.Next() && len(list) < limit {
+		l, err := scanEntryLocation(rows.Scan)
+		if err != nil {
+			log.Printf("getGeoReviews scan failed: %v", err)
+			continue
+		}
+		list = append(list, l)
+	}
+	return list
+}
+
+func countOpenGeoReviews(departmentID int) int {
+	db := getDB()
+	defer db.Close()
+	var n int
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s e JOIN %s u ON u.id = e.user_id
+		WHERE e.geofence IN (@out, @none) AND e.geo_reviewed_at IS NULL AND (@dep = 0 OR u.department_id = @dep)`, tbl("entries"), tbl("users"))
+	if err := db.QueryRow(query, sql.Named("out", geoOutside), sql.Named("none", geoNoLocation), sql.Named("dep", departmentID)).Scan(&n); err != nil {
+		log.Printf("countOpenGeoReviews failed: %v", err)
+	}
+	return n
+}
+
+func reviewEntryLocation(entryID, by string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET geo_reviewed_by=@by, geo_reviewed_at=@now WHERE id=@id AND geo_reviewed_at IS NULL", tbl("entries"))
+	if _, err := db.Exec(query, sql.Named("by", by), sql.Named("now", time.Now().Unix()), sql.Named("id", entryID)); err != nil {
+		log.Printf("reviewEntryLocation failed: %v", err)
+	}
+}
+
+//---------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------
+
+// mobileStampRequest is posted by the mobile page; Location is omitted when
+// the user did not share it or the browser could not determine it
+type mobileStampRequest struct {
+	ActivityID int       `json:"activityId"`
+	Location   *Location `json:"location,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	ProjectID  int       `json:"projectId,omitempty"`
+	TaskID     int       `json:"taskId,omitempty"`
+}
+
+type mobileStampResponse struct {
+	Result   string  `json:"result"` // stamped, merged, rejected, error
+	Message  string  `json:"message,omitempty"`
+	Activity string  `json:"activity,omitempty"`
+	Geofence string  `json:"geofence,omitempty"`
+	Fence    string  `json:"fence,omitempty"`
+	OutBy    float64 `json:"outBy,omitempty"` // metres outside the nearest fence
+}
+
+// mobileHandler is the phone stamping view of the logged-in user
+func mobileHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := currentDBUserFromSession(r)
+	if !ok || u.ID == 0 {
+		http.Redirect(w, r, "/passwordStamp", http.StatusSeeOther)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var current any
+		if st, at, ok := getCurrentStatusForUserID(u.ID); ok {
+			current = map[string]string{"Status": st, "Since": humanizeDuration(time.Since(at))}
+		}
+		work, off := toggleActivities(u)
+		renderTemplate(w, r, "mobile", map[string]any{
+			"User":       u,
+			"Current":    current,
+			"AtWork":     isAtWork(u.ID, time.Now()),
+			"Work":       work,
+			"Off":        off,
+			"Activities": getActivities(),
+			"Projects":   stampProjects(time.Now()),
+			"Fenced":     len(getGeofences(u.DepartmentID)) > 0,
+		})
+	case http.MethodPost:
+		var req mobileStampRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, apiMaxBody)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, mobileStampResponse{Result: "error", Message: "invalid JSON body"})
+			return
+		}
+		if req.Location != nil && !req.Location.valid() {
+			req.Location = nil
+		}
+		writeJSON(w, http.StatusOK, mobileStamp(u, req, time.Now()))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// mobileStamp stamps the user and records the position; stamps outside the
+// department's fences are kept and flagged, never rejected
+func mobileStamp(u User, req mobileStampRequest, now time.Time) mobileStampResponse {
+	activity := getActivity(strconv.Itoa(req.ActivityID))
+	if activity.ID == 0 {
+		return mobileStampResponse{Result: "error", Message: "Unbekannte Aktivität."}
+	}
+	details := StampDetails{Comment: req.Comment, ProjectID: req.ProjectID, TaskID: req.TaskID}
+	err := checkStampDetails(activity, &details, now)
+	var id int64
+	var merged bool
+	if err == nil {
+		id, merged, err = stampEntry(strconv.Itoa(u.ID), strconv.Itoa(activity.ID), now, 0, details)
+	}
+	var rej *StampRejection
+	switch {
+	case errors.As(err, &rej):
+		return mobileStampResponse{Result: "rejected", Message: rej.Message}
+	case err != nil:
+		log.Printf("mobile stamp for %s failed: %v", u.Name, err)
+		return mobileStampResponse{Result: "error", Message: stampErrorMessage(err)}
+	case merged:
+		// the earlier stamp keeps its own position
+		return mobileStampResponse{Result: "merged", Activity: activity.Status}
+	}
+	result, fence, outBy := checkGeofences(getGeofences(u.DepartmentID), req.Location)
+	setEntryLocation(id, req.Location, result)
+	return mobileStampResponse{Result: "stamped", Activity: activity.Status, Geofence: result, Fence: fence.Name, OutBy: math.Round(outBy)}
+}
+
+// geofencesHandler adds and removes a department's geofences
+func geofencesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dep := r.FormValue("department_id")
+	switch r.FormValue("action") {
+	case "delete":
+		deleteGeofence(r.FormValue("id"), dep)
+	default:
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(r.FormValue("latitude")), 64)
+		lon, err2 := strconv.ParseFloat(strings.TrimSpace(r.FormValue("longitude")), 64)
+		radius, err3 := strconv.ParseFloat(strings.TrimSpace(r.FormValue("radius")), 64)
+		loc := Location{Latitude: lat, Longitude: lon}
+		if err1 != nil || err2 != nil || err3 != nil || !loc.valid() || radius <= 0 {
+			http.Error(w, "Invalid geofence: latitude, longitude and a positive radius in metres are required", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			name = fmt.Sprintf("%.5f, %.5f", lat, lon)
+		}
+		addGeofence(Geofence{DepartmentID: atoiDefault(dep, 0), Name: name, Latitude: lat, Longitude: lon, Radius: radius})
+	}
+	http.Redirect(w, r, "/editDepartment?id="+dep, http.StatusSeeOther)
+}
+
+// geoReviewHandler lists stamps outside their geofences for review; managers
+// see and confirm those of their own department
+func geoReviewHandler(w http.ResponseWriter, r *http.Request) {
+	role := sessionRole(r)
+	viewer, _ := currentDBUserFromSession(r)
+	if !isRole(role, "admin", "manager") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		e := getEntry(r.FormValue("id"))
+		if e.ID == 0 || !canApprove(role, viewer, getUser(strconv.Itoa(e.UserID))) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		reviewEntryLocation(strconv.Itoa(e.ID), sessionUsername(r))
+		http.Redirect(w, r, "/admin/geoReview", http.StatusSeeOther)
+		return
+	}
+
+	departmentID := 0
+	if !isRole(role, "admin") {
+		departmentID = viewer.DepartmentID
+		if departmentID == 0 {
+			renderTemplate(w, r, "geoReview", map[string]any{})
+			return
+		}
+	}
+	renderTemplate(w, r, "geoReview", map[string]any{
+		"Reviews":  getGeoReviews(departmentID, 200),
+		"Open":     countOpenGeoReviews(departmentID),
+		"IsAdmin":  isRole(role, "admin"),
+		"ViewerID": viewer.ID,
+	})
+}
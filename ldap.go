@@ -0,0 +1,514 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig configures directory authentication and user sync for a tenant
+// (key "ldap" in tenant/<host>/config.json).
+type LDAPConfig struct {
+	URL                string `json:"url"` // ldap://dc.example.local:389 or ldaps://…
+	StartTLS           bool   `json:"startTLS"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	// BindDN/BindPassword is the service account used to search the directory
+	BindDN       string `json:"bindDN"`
+	BindPassword string `json:"bindPassword"`
+	BaseDN       string `json:"baseDN"`
+	// UserFilter finds the account on login; {login} is replaced by the escaped login name
+	UserFilter string `json:"userFilter"`
+	// SyncFilter selects all accounts that are synced into the users table
+	SyncFilter     string `json:"syncFilter"`
+	NameAttr       string `json:"nameAttr"`       // default displayName (falls back to cn)
+	EmailAttr      string `json:"emailAttr"`      // default mail
+	PositionAttr   string `json:"positionAttr"`   // default title
+	DepartmentAttr string `json:"departmentAttr"` // default department
+	// GroupRoles maps memberOf group DNs (or their CN) to app roles
+	GroupRoles map[string]string `json:"groupRoles"`
+	// AutoCreate creates a users row on the first successful directory login
+	AutoCreate bool `json:"autoCreate"`
+	// CreateDepartments creates departments named by DepartmentAttr if missing
+	CreateDepartments bool `json:"createDepartments"`
+	// SyncIntervalMinutes runs the sync in the background; 0 disables scheduling
+	SyncIntervalMinutes int `json:"syncIntervalMinutes"`
+}
+
+func (c *LDAPConfig) enabled() bool {
+	return c != nil && c.URL != "" && c.BaseDN != ""
+}
+
+func (c *LDAPConfig) userFilter() string {
+	if c.UserFilter != "" {
+		return c.UserFilter
+	}
+	return "(&(objectClass=person)(|(mail={login})(uid={login})(sAMAccountName={login})))"
+}
+
+func (c *LDAPConfig) syncFilter() string {
+	if c.SyncFilter != "" {
+		return c.SyncFilter
+	}
+	return "(&(objectClass=person)(mail=*))"
+}
+
+func attrOr(v, def string) string {
+	if v != "" {
+		return v
+	}
+	return def
+}
+
+// directoryUser is the part of a directory entry that is mapped onto users
+type directoryUser struct {
+	DN         string
+	Name       string
+	Email      string
+	Position   string
+	Department string
+	Groups     []string
+	Disabled   bool
+}
+
+func ldapConnect(cfg *LDAPConfig) (*ldap.Conn, error) {
+	serverName := ""
+	if u, err := url.Parse(cfg.URL); err == nil {
+		serverName = u.Hostname()
+	}
+	tlsCfg := &tls.Config{ServerName: serverName, InsecureSkipVerify: cfg.InsecureSkipVerify}
+	conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(10 * time.Second)
+	if cfg.StartTLS {
+		if err := conn.StartTLS(tlsCfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if cfg.BindDN != "" {
+		if err := conn.Bind(cfg.BindDN, cfg.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *LDAPConfig) attributes() []string {
+	return []string{attrOr(c.NameAttr, "displayName"), "cn", attrOr(c.EmailAttr, "mail"),
+		attrOr(c.PositionAttr, "title"), attrOr(c.DepartmentAttr, "department"), "memberOf", "userAccountControl"}
+}
+
+func (c *LDAPConfig) toDirectoryUser(e *ldap.Entry) directoryUser {
+	du := directoryUser{
+		DN:         e.DN,
+		Name:       e.GetAttributeValue(attrOr(c.NameAttr, "displayName")),
+		Email:      strings.TrimSpace(e.GetAttributeValue(attrOr(c.EmailAttr, "mail"))),
+		Position:   e.GetAttributeValue(attrOr(c.PositionAttr, "title")),
+		Department: strings.TrimSpace(e.GetAttributeValue(attrOr(c.DepartmentAttr, "department"))),
+	}
+	if du.Name == "" {
+		du.Name = e.GetAttributeValue("cn")
+	}
+	// groups are matched by full DN and by their CN
+	for _, g := range e.GetAttributeValues("memberOf") {
+		du.Groups = append(du.Groups, g)
+		if dn, err := ldap.ParseDN(g); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			du.Groups = append(du.Groups, dn.RDNs[0].Attributes[0].Value)
+		}
+	}
+	// Active Directory: ACCOUNTDISABLE flag
+	if uac, err := strconv.Atoi(e.GetAttributeValue("userAccountControl")); err == nil && uac&2 != 0 {
+		du.Disabled = true
+	}
+	return du
+}
+
+// ldapAuthenticate looks up login with the service account and binds as the found entry
+func ldapAuthenticate(cfg *LDAPConfig, login, password string) (directoryUser, error) {
+	// an empty password would be an unauthenticated bind that many servers accept
+	if strings.TrimSpace(login) == "" || password == "" {
+		return directoryUser{}, fmt.Errorf("empty credentials")
+	}
+	conn, err := ldapConnect(cfg)
+	if err != nil {
+		return directoryUser{}, err
+	}
+	defer conn.Close()
+
+	filter := strings.ReplaceAll(cfg.userFilter(), "{login}", ldap.EscapeFilter(login))
+	res, err := conn.Search(ldap.NewSearchRequest(cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 10, false, filter, cfg.attributes(), nil))
+	if err != nil {
+		return directoryUser{}, err
+	}
+	if len(res.Entries) != 1 {
+		return directoryUser{}, fmt.Errorf("%d directory entries match %q", len(res.Entries), login)
+	}
+	du := cfg.toDirectoryUser(res.Entries[0])
+	if err := conn.Bind(du.DN, password); err != nil {
+		return directoryUser{}, err
+	}
+	return du, nil
+}
+
+// ldapLogin authenticates against the tenant directory and returns the matching
+// (possibly just created) DB user with attributes refreshed from the directory
+func ldapLogin(r *http.Request, login, password string) (User, bool) {
+	cfg := tenantConfigFor(r).LDAP
+	if !cfg.enabled() {
+		return User{}, false
+	}
+	du, err := ldapAuthenticate(cfg, login, password)
+	if err != nil {
+		log.Printf("LDAP login for %q failed: %v", login, err)
+		return User{}, false
+	}
+	if du.Disabled || du.Email == "" {
+		return User{}, false
+	}
+	dns := getUserLDAPDNs()
+	existing, found := findDirectoryUser(du, getAllUsers(), dns)
+	if !found && !cfg.AutoCreate {
+		log.Printf("LDAP login for %q: no matching user and autoCreate is off", login)
+		return User{}, false
+	}
+	var match *User
+	if found {
+		match = &existing
+	}
+	reconcileDirectoryUser(cfg, du, match, dns[existing.ID], false)
+	u, ok := getUserByEmail(du.Email)
+	return u, ok && u.Active != 0
+}
+
+//---------------------------------------------------------------------
+// Sync
+//---------------------------------------------------------------------
+
+// LDAPSyncChange describes what the sync did (or would do) with one user
+type LDAPSyncChange struct {
+	Action  string // create, update, deactivate
+	Name    string
+	Email   string
+	Details string
+}
+
+type LDAPSyncReport struct {
+	DryRun    bool
+	Started   time.Time
+	Finished  time.Time
+	Changes   []LDAPSyncChange
+	Unchanged int
+	Error     string
+}
+
+// findDirectoryUser matches a directory entry by stored DN first, then by email
+func findDirectoryUser(du directoryUser, users []User, dns map[int]string) (User, bool) {
+	for _, u := range users {
+		if dn := dns[u.ID]; dn != "" && strings.EqualFold(dn, du.DN) {
+			return u, true
+		}
+	}
+	for _, u := range users {
+		if du.Email != "" && strings.EqualFold(u.Email, du.Email) {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// reconcileDirectoryUser creates or updates one user from the directory.
+// existing is nil when no users row matches. Nothing is written in dry-run mode.
+func reconcileDirectoryUser(cfg *LDAPConfig, du directoryUser, existing *User, storedDN string, dryRun bool) (LDAPSyncChange, bool) {
+	change := LDAPSyncChange{Name: du.Name, Email: du.Email}
+
+	deptID, deptNote := 0, ""
+	if du.Department != "" {
+		if d, ok := getDepartmentByName(du.Department); ok {
+			deptID = d.ID
+		} else if cfg.CreateDepartments {
+			deptNote = "neue Abteilung " + du.Department
+			if !dryRun {
+				createDepartment(du.Department)
+				if d, ok := getDepartmentByName(du.Department); ok {
+					deptID = d.ID
+				}
+			}
+		}
+	}
+	role := highestMappedRole(cfg.GroupRoles, du.Groups)
+
+	if existing == nil {
+		if du.Disabled {
+			return change, false
+		}
+		if role == "" {
+			role = "user"
+		}
+		change.Action = "create"
+		change.Details = "Rolle " + role
+		if deptNote != "" {
+			change.Details += ", " + deptNote
+		}
+		if !dryRun {
+			createUser(du.Name, "", du.Email, "", role, du.Position, strconv.Itoa(deptID))
+			if u, ok := getUserByEmail(du.Email); ok {
+				updateDirectoryUser(u.ID, du.Name, du.Email, du.Position, role, deptID, true, du.DN)
+			}
+		}
+		return change, true
+	}
+
+	u := *existing
+	if role == "" || len(cfg.GroupRoles) == 0 {
+		role = u.Role
+	}
+	if deptID == 0 && deptNote == "" {
+		deptID = u.DepartmentID
+	}
+	active := !du.Disabled
+	var diffs []string
+	if u.Name != du.Name {
+		diffs = append(diffs, fmt.Sprintf("Name %q → %q", u.Name, du.Name))
+	}
+	if !strings.EqualFold(u.Email, du.Email) {
+		diffs = append(diffs, fmt.Sprintf("E-Mail %s → %s", u.Email, du.Email))
+	}
+	if u.Position != du.Position {
+		diffs = append(diffs, fmt.Sprintf("Position %q → %q", u.Position, du.Position))
+	}
+	if u.DepartmentID != deptID || deptNote != "" {
+		diffs = append(diffs, "Abteilung → "+du.Department)
+	}
+	if u.Role != role {
+		diffs = append(diffs, fmt.Sprintf("Rolle %s → %s", u.Role, role))
+	}
+	if (u.Active != 0) != active {
+		if active {
+			diffs = append(diffs, "reaktiviert")
+		} else {
+			diffs = append(diffs, "im Verzeichnis deaktiviert")
+		}
+	}
+	if len(diffs) == 0 && storedDN == du.DN {
+		return change, false
+	}
+	change.Action = "update"
+	if !active && u.Active != 0 {
+		change.Action = "deactivate"
+	}
+	change.Details = strings.Join(diffs, ", ")
+	if change.Details == "" {
+		change.Details = "Verzeichnis-DN verknüpft"
+	}
+	if !dryRun {
+		updateDirectoryUser(u.ID, du.Name, du.Email, du.Position, role, deptID, active, du.DN)
+	}
+	return change, true
+}
+
+// runLDAPSync mirrors the directory into users. Directory-managed users (with a
+// stored DN) that disappeared from the directory are deactivated, never deleted.
+func runLDAPSync(cfg *LDAPConfig, dryRun bool) (rep LDAPSyncReport) {
+	rep = LDAPSyncReport{DryRun: dryRun, Started: time.Now()}
+	defer func() { rep.Finished = time.Now() }()
+
+	conn, err := ldapConnect(cfg)
+	if err != nil {
+		rep.Error = err.Error()
+		return rep
+	}
+	defer conn.Close()
+	res, err := conn.SearchWithPaging(ldap.NewSearchRequest(cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 60, false, cfg.syncFilter(), cfg.attributes(), nil), 500)
+	if err != nil {
+		rep.Error = err.Error()
+		return rep
+	}
+
+	users := getAllUsers()
+	dns := getUserLDAPDNs()
+	seen := map[int]bool{}
+	for _, e := range res.Entries {
+		du := cfg.toDirectoryUser(e)
+		if du.Email == "" {
+			continue
+		}
+		var match *User
+		u, ok := findDirectoryUser(du, users, dns)
+		if ok {
+			seen[u.ID] = true
+			match = &u
+		}
+		if change, changed := reconcileDirectoryUser(cfg, du, match, dns[u.ID], dryRun); changed {
+			rep.Changes = append(rep.Changes, change)
+		} else {
+			rep.Unchanged++
+		}
+	}
+	for _, u := range users {
+		if dns[u.ID] == "" || seen[u.ID] || u.Active == 0 {
+			continue
+		}
+		rep.Changes = append(rep.Changes, LDAPSyncChange{Action: "deactivate", Name: u.Name, Email: u.Email, Details: "nicht mehr im Verzeichnis"})
+		if !dryRun {
+			setUserActive(strconv.Itoa(u.ID), false)
+		}
+	}
+	sort.SliceStable(rep.Changes, func(i, j int) bool { return rep.Changes[i].Action < rep.Changes[j].Action })
+	return rep
+}
+
+func getUserLDAPDNs() map[int]string {
+	db := getDB()
+	defer db.Close()
+
+	out := map[int]string{}
+	rows, err := db.Query(fmt.Sprintf("SELECT id, ldap_dn FROM %s WHERE ldap_dn IS NOT NULL AND ldap_dn <> ''", tbl("users")))
+	if err != nil {
+		log.Printf("getUserLDAPDNs query failed: %v", err)
+		return out
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var dn string
+		if err := rows.Scan(&id, &dn); err == nil {
+			out[id] = dn
+		}
+	}
+	return out
+}
+
+// getUserLDAPDN returns the directory DN of a synced user ("" for local accounts)
+func getUserLDAPDN(id int) string {
+	db := getDB()
+	defer db.Close()
+	var dn sql.NullString
+	query := fmt.Sprintf("SELECT ldap_dn FROM %s WHERE id=@id", tbl("users"))
+	if err := db.QueryRow(query, sql.Named("id", id)).Scan(&dn); err != nil {
+		return ""
+	}
+	return dn.String
+}
+
+func updateDirectoryUser(id int, name, email, position, role string, departmentID int, active bool, dn string) {
+	db := getDB()
+	defer db.Close()
+
+	act := 0
+	if active {
+		act = 1
+	}
+	query := fmt.Sprintf(`UPDATE %s
+			  SET name=@name, email=@mail, position=@pos, role=@role, department_id=@dept, active=@active, ldap_dn=@dn
+			  WHERE id=@id`, tbl("users"))
+	_, err := db.Exec(query,
+		sql.Named("name", name),
+		sql.Named("mail", email),
+		sql.Named("pos", position),
+		sql.Named("role", role),
+		sql.Named("dept", departmentID),
+		sql.Named("active", act),
+		sql.Named("dn", dn),
+		sql.Named("id", id),
+	)
+	if err != nil {
+		log.Printf("updateDirectoryUser failed: %v", err)
+	}
+}
+
+//---------------------------------------------------------------------
+// Scheduling and admin page
+//---------------------------------------------------------------------
+
+var ldapLastSync sync.Map // host -> LDAPSyncReport
+
+// tenantHosts lists the hosts that have a tenant directory. With SQLite only
+// those that already have a database count, so background jobs do not create
+// empty ones for directories holding just templates or config; MSSQL tenants
+// share one database and are listed by their config directory.
+func tenantHosts() []string {
+	root := tenantRoot()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	var hosts []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if dbBackend == "sqlite" {
+			if _, err := os.Stat(filepath.Join(root, e.Name(), "time_tracking.db")); err != nil {
+				continue
+			}
+		}
+		hosts = append(hosts, e.Name())
+	}
+	return hosts
+}
+
+// startLDAPSyncScheduler checks every minute which tenants are due for a sync
+func startLDAPSyncScheduler() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			for _, host := range tenantHosts() {
+				cfg := loadTenantConfig(host).LDAP
+				if !cfg.enabled() || cfg.SyncIntervalMinutes <= 0 {
+					continue
+				}
+				if v, ok := ldapLastSync.Load(host); ok && time.Since(v.(LDAPSyncReport).Started) < time.Duration(cfg.SyncIntervalMinutes)*time.Minute {
+					continue
+				}
+				SetRequestHost(host)
+				EnsureSchemaCurrent()
+				rep := runLDAPSync(cfg, false)
+				ClearRequestHost()
+				ldapLastSync.Store(host, rep)
+				if rep.Error != "" {
+					log.Printf("LDAP sync for %s failed: %s", host, rep.Error)
+				} else {
+					log.Printf("LDAP sync for %s: %d changes, %d unchanged", host, len(rep.Changes), rep.Unchanged)
+				}
+			}
+		}
+	}()
+}
+
+// ldapAdminHandler shows the last sync and runs a dry run or a real sync on demand
+func ldapAdminHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := tenantConfigFor(r).LDAP
+	data := map[string]any{"Enabled": cfg.enabled()}
+	if cfg.enabled() {
+		data["URL"] = cfg.URL
+		data["BaseDN"] = cfg.BaseDN
+		data["Interval"] = cfg.SyncIntervalMinutes
+	}
+	host := requestHost(r)
+	if r.Method == http.MethodPost && cfg.enabled() {
+		rep := runLDAPSync(cfg, r.FormValue("action") != "sync")
+		if !rep.DryRun {
+			ldapLastSync.Store(host, rep)
+		}
+		data["Report"] = rep
+	} else if v, ok := ldapLastSync.Load(host); ok {
+		data["Report"] = v.(LDAPSyncReport)
+	}
+	renderTemplate(w, r, "ldap", data)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mailer delivers plain-text notification mails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPConfig configures outgoing mail for a tenant (key "smtp" in config.json).
+// Without it the SMTP_HOST, SMTP_PORT, SMTP_USER, SMTP_PASSWORD and SMTP_FROM
+// environment variables are used.
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"` // default 25
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+type smtpMailer struct {
+	cfg SMTPConfig
+}
+
+func (m smtpMailer) Send(to, subject, body string) error {
+	port := m.cfg.Port
+	if port == 0 {
+		port = 25
+	}
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(net.JoinHostPort(m.cfg.Host, strconv.Itoa(port)), auth, m.cfg.From, []string{to}, []byte(msg.String()))
+}
+
+// logMailer only logs messages; used when no SMTP server is configured
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("mail (not sent, no SMTP configured) to=%s subject=%q\n%s", to, subject, body)
+	return nil
+}
+
+// mailerFor returns the tenant's mailer; ok is false when only the log fallback is available
+func mailerFor(r *http.Request) (m Mailer, ok bool) {
+	if cfg := tenantConfigFor(r).SMTP; cfg != nil && cfg.Host != "" {
+		return smtpMailer{cfg: *cfg}, true
+	}
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		return smtpMailer{cfg: SMTPConfig{
+			Host:     host,
+			Port:     atoiDefault(os.Getenv("SMTP_PORT"), 25),
+			Username: os.Getenv("SMTP_USER"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     getenv("SMTP_FROM", "workingtime@"+host),
+		}}, true
+	}
+	return logMailer{}, false
+}
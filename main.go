@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,7 +14,6 @@ import (
 	"time"
 
 	"github.com/gorilla/sessions"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // WorkHoursData is a struct that represents the data needed to display work hours
@@ -39,8 +39,13 @@ type AuthUser struct {
 
 // BulkClockRequest represents the JSON payload for bulk clocking via barcode
 type BulkClockRequest struct {
-	ActivityCode string   `json:"activityCode"`
-	UserCodes    []string `json:"userCodes"`
+	ActivityCode   string   `json:"activityCode"`
+	UserCodes      []string `json:"userCodes"`
+	Atomic         bool     `json:"atomic"`         // record nothing unless every card can be stamped
+	IdempotencyKey string   `json:"idempotencyKey"` // alternative to the Idempotency-Key header
+	Comment        string   `json:"comment"`        // stored on every entry of the batch
+	ProjectID      int      `json:"projectId"`      // optional project (or task) for every entry
+	TaskID         int      `json:"taskId"`
 }
 
 // Calendar data structures for the calendar view
@@ -53,12 +58,29 @@ type CalendarDay struct {
 	TotalHours   float64
 }
 
+// CommentTooltip lists the day's stamps that carry a comment, one per line
+func (d CalendarDay) CommentTooltip() string {
+	var lines []string
+	for _, e := range d.Entries {
+		if e.Comment == "" {
+			continue
+		}
+		at := e.Date
+		if len(at) >= 16 {
+			at = at[11:16]
+		}
+		lines = append(lines, fmt.Sprintf("%s %s – %s: %s", at, e.UserName, e.Activity, e.Comment))
+	}
+	return strings.Join(lines, "\n")
+}
+
 type CalendarEntry struct {
 	Date     string
 	UserName string
 	Activity string
 	Hours    float64
 	IsWork   bool
+	Comment  string
 }
 
 type CalendarWeek struct {
@@ -91,6 +113,7 @@ type WeekSegment struct {
 	WidthPct  float64 // 0..100
 	LeftCSS   string  // e.g., "12.5%"
 	WidthCSS  string  // e.g., "33.3%"
+	Title     string  // tooltip: user, activity, time and comment
 }
 
 // loadCredentials loads the credentials from a CSV file
@@ -173,10 +196,16 @@ func basicAuthMiddleware(_ map[string]AuthUser, next http.Handler) http.Handler
 
 func init() {
 	// ensure schema is in place
-	createDatabaseAndTables()
+	if !readerCommand() {
+		createDatabaseAndTables()
+	}
 }
 
 func main() {
+	if readerCommand() {
+		os.Exit(readerMain(os.Args[2:]))
+	}
+
 	// load auth users
 	log.Printf("Starting WorkingTime with %s…", dbBackend)
 	log.Printf("  DB_BACKEND = %s", dbBackend)
@@ -198,17 +227,37 @@ func main() {
 
 	// Login & Logout
 	mux.Handle("/login", loginHandler(users))
+	mux.HandleFunc("/login/2fa", loginTwoFactorHandler)
+	mux.HandleFunc("/login/oidc", oidcLoginHandler)
+	mux.HandleFunc("/login/oidc/callback", oidcCallbackHandler)
 	mux.HandleFunc("/logout", logoutHandler)
+	mux.Handle("/account/2fa", basicAuthMiddleware(users, http.HandlerFunc(twoFactorSettingsHandler)))
+	mux.Handle("/account/password", basicAuthMiddleware(users, http.HandlerFunc(changePasswordHandler)))
+	mux.HandleFunc("/resetPassword", resetPasswordHandler)
 	// Password-based stamping page
 	mux.HandleFunc("/passwordStamp", passwordStampHandler)
+	// mobile self-stamping with optional location
+	mux.Handle("/mobile", basicAuthMiddleware(users, http.HandlerFunc(mobileHandler)))
+	// Monthly timesheets: submit, approve (manager), lock (HR)
+	mux.Handle("/timesheets", basicAuthMiddleware(users, http.HandlerFunc(timesheetsHandler)))
 
 	// core pages (unprotected)
 	mux.Handle("/", basicAuthMiddleware(users, http.HandlerFunc(indexHandler)))
 	mux.Handle("/addUser", basicAuthMiddleware(users, http.HandlerFunc(addUserHandler)))
 	mux.Handle("/addActivity", basicAuthMiddleware(users, http.HandlerFunc(addActivityHandler)))
 	mux.Handle("/addDepartment", basicAuthMiddleware(users, http.HandlerFunc(addDepartmentHandler)))
-	mux.Handle("/clockInOutForm", http.HandlerFunc(clockInOutForm))
+	mux.Handle("/clockInOutForm", stampingOnly(true, http.HandlerFunc(clockInOutForm)))
 	mux.Handle("/current_status", basicAuthMiddleware(users, http.HandlerFunc(currentStatusHandler)))
+	// Live attendance board (Server-Sent Events), ?wall=1 for the fullscreen wallboard
+	mux.Handle("/board", boardAuth(users, http.HandlerFunc(boardHandler)))
+	mux.Handle("/board/events", boardAuth(users, http.HandlerFunc(boardEventsHandler)))
+	// Evacuation roll-call: snapshot of present staff, check-off by barcode scan, report
+	mux.Handle("/evacuation", basicAuthMiddleware(users, http.HandlerFunc(evacuationHandler)))
+	mux.Handle("/evacuation/start", basicAuthMiddleware(users, http.HandlerFunc(evacuationStartHandler)))
+	mux.Handle("/evacuation/check", basicAuthMiddleware(users, http.HandlerFunc(evacuationCheckHandler)))
+	mux.Handle("/evacuation/end", basicAuthMiddleware(users, http.HandlerFunc(evacuationEndHandler)))
+	mux.Handle("/evacuation/events", basicAuthMiddleware(users, http.HandlerFunc(evacuationEventsHandler)))
+	mux.Handle("/evacuation/report", basicAuthMiddleware(users, http.HandlerFunc(evacuationReportHandler)))
 
 	// protected actions
 	mux.Handle("/createUser", basicAuthMiddleware(users, http.HandlerFunc(createUserHandler)))
@@ -241,17 +290,52 @@ func main() {
 	// Admin downloads page
 	mux.Handle("/admin/downloads", adminOnly(http.HandlerFunc(adminDownloadsHandler)))
 
-	// Enhanced download endpoints with filtering
-	mux.Handle("/admin/download/entries", adminOnly(http.HandlerFunc(downloadEntriesEnhanced)))
-	mux.Handle("/admin/download/workhours", adminOnly(http.HandlerFunc(downloadWorkHoursEnhanced)))
-	mux.Handle("/admin/download/departments", adminOnly(http.HandlerFunc(downloadDepartmentSummary)))
-	mux.Handle("/admin/download/useractivity", adminOnly(http.HandlerFunc(downloadUserActivity)))
-	mux.Handle("/admin/download/trends", adminOnly(http.HandlerFunc(downloadTimeTrends)))
-	mux.Handle("/admin/download/entries.csv", adminOnly(http.HandlerFunc(downloadEntriesCSV)))
-	mux.Handle("/admin/download/work_hours.csv", adminOnly(http.HandlerFunc(downloadWorkHoursCSV)))
+	// Enhanced download endpoints with filtering (also reachable with an API token)
+	mux.Handle("/admin/download/entries", bearerOrSession("entries:read", adminOnly, http.HandlerFunc(downloadEntriesEnhanced)))
+	mux.Handle("/admin/download/workhours", bearerOrSession("reports:read", adminOnly, http.HandlerFunc(downloadWorkHoursEnhanced)))
+	mux.Handle("/admin/download/departments", bearerOrSession("reports:read", adminOnly, http.HandlerFunc(downloadDepartmentSummary)))
+	mux.Handle("/admin/download/useractivity", bearerOrSession("reports:read", adminOnly, http.HandlerFunc(downloadUserActivity)))
+	mux.Handle("/admin/download/trends", bearerOrSession("reports:read", adminOnly, http.HandlerFunc(downloadTimeTrends)))
+	mux.Handle("/admin/download/entries.csv", bearerOrSession("entries:read", adminOnly, http.HandlerFunc(downloadEntriesCSV)))
+	mux.Handle("/admin/download/work_hours.csv", bearerOrSession("reports:read", adminOnly, http.HandlerFunc(downloadWorkHoursCSV)))
+	mux.Handle("/admin/download/projects", bearerOrSession("reports:read", adminOnly, http.HandlerFunc(downloadProjectHours)))
+	mux.Handle("/admin/download/invoice", bearerOrSession("reports:read", adminOnly, http.HandlerFunc(downloadInvoiceLines)))
+
+	// LDAP / Active Directory sync
+	mux.Handle("/admin/ldap", adminOnly(http.HandlerFunc(ldapAdminHandler)))
+	startLDAPSyncScheduler()
+
+	// Locked accounts / IPs after failed logins
+	mux.Handle("/admin/lockouts", adminOnly(http.HandlerFunc(lockoutsHandler)))
+	// One-time password reset links
+	mux.Handle("/admin/passwordReset", adminOnly(http.HandlerFunc(adminPasswordResetHandler)))
+
+	// API tokens for scripts and terminals
+	mux.Handle("/admin/tokens", adminOnly(http.HandlerFunc(apiTokensHandler)))
+	// Registered terminals and their last sync
+	mux.Handle("/admin/terminals", adminOnly(http.HandlerFunc(terminalsHandler)))
+	// stamps outside their department's geofences, for review
+	mux.Handle("/admin/geoReview", basicAuthMiddleware(users, http.HandlerFunc(geoReviewHandler)))
+	mux.Handle("/admin/geofences", adminOnly(http.HandlerFunc(geofencesHandler)))
+	// Projects and tasks with hour reports and budget burn-down
+	mux.Handle("/admin/projects", adminOnly(http.HandlerFunc(projectsHandler)))
+	mux.Handle("/admin/project", adminOnly(http.HandlerFunc(projectHandler)))
+	// Cost centers, billing rates and invoice drafts
+	mux.Handle("/admin/billing", adminOnly(http.HandlerFunc(billingHandler)))
+	mux.Handle("/admin/invoice", adminOnly(http.HandlerFunc(invoiceHandler)))
+	// Webhook subscriptions and delivery log
+	mux.Handle("/admin/webhooks", adminOnly(http.HandlerFunc(webhooksHandler)))
+	startWebhookDispatcher()
+	startMQTT()
+
+	// JSON REST API (/api/v1, see openapi.json)
+	registerAPI(mux)
 
 	// User self history (no session required; verifies by email+password per request)
 	mux.HandleFunc("/myHistory", myHistoryHandler)
+	mux.HandleFunc("/myHistory/correction", myCorrectionHandler)
+	// Correction requests waiting for a manager
+	mux.Handle("/corrections", basicAuthMiddleware(users, http.HandlerFunc(correctionsHandler)))
 
 	// static files (CSS, JS, images) with tenant override
 	defaultStatic := http.StripPrefix("/static/", http.FileServer(http.Dir("static")))
@@ -262,7 +346,7 @@ func main() {
 			host = host[:idx]
 		}
 		safe := strings.ToLower(strings.ReplaceAll(host, "/", "-"))
-		tenantPath := filepath.Join("tenant", safe, "static", rel)
+		tenantPath := filepath.Join(tenantRoot(), safe, "static", rel)
 		if info, err := os.Stat(tenantPath); err == nil && !info.IsDir() {
 			http.ServeFile(w, r, tenantPath)
 			return
@@ -270,12 +354,25 @@ func main() {
 		defaultStatic.ServeHTTP(w, r)
 	})
 
+	// stamping for others needs a paired terminal (or an admin, or "openStamping")
+	mux.HandleFunc("/terminal/pair", terminalPairHandler)
+
 	// clock in/out via dropdown
-	mux.Handle("/clockInOut", http.HandlerFunc(clockInOut))
+	mux.Handle("/clockInOut", stampingOnly(true, http.HandlerFunc(clockInOut)))
 
 	// barcode-driven bulk clock
-	mux.Handle("/scan", http.HandlerFunc(scanHandler))
-	mux.Handle("/bulkClock", http.HandlerFunc(bulkClockHandler))
+	mux.Handle("/scan", stampingOnly(false, http.HandlerFunc(scanHandler)))
+	mux.Handle("/bulkClock", stampingOnly(false, http.HandlerFunc(bulkClockHandler)))
+	// toggle terminal: a single card scan stamps in or out
+	mux.Handle("/terminal", stampingOnly(false, http.HandlerFunc(terminalHandler)))
+	mux.Handle("/toggleClock", stampingOnly(false, http.HandlerFunc(toggleClockHandler)))
+	// offline terminal (PWA) for registered terminals, stamps are queued on the device
+	mux.Handle("/terminal/offline/", offlineTerminalHandler())
+	mux.HandleFunc("/terminal/offline/config", offlineConfigHandler)
+	mux.HandleFunc("/terminal/offline/sync", offlineSyncHandler)
+	// rotating QR code on a terminal, scanned by logged-in employees' phones
+	mux.Handle("/terminal/qr", stampingOnly(false, http.HandlerFunc(qrTerminalHandler)))
+	mux.HandleFunc("/qr/stamp", qrStampHandler)
 
 	log.Printf("App will listen on http://localhost:8083")
 	log.Printf("Starting server on :8083…")
@@ -324,15 +421,26 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 func loginHandler(users map[string]AuthUser) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		sso := tenantConfigFor(r).OIDC.buttonLabel()
 		if r.Method == http.MethodGet {
-			renderTemplate(w, r, "login", nil)
+			renderTemplate(w, r, "login", map[string]any{"SSO": sso})
 			return
 		}
 		// POST
 		username := r.FormValue("username")
 		password := r.FormValue("password")
+		if wait, blocked := loginBlocked(r, username); blocked {
+			tooManyAttempts(w, wait)
+			return
+		}
 		user, ok := users[username]
 		if ok && user.Password == password {
+			recordLoginSuccess(username)
+			// CSV users cannot enroll a second factor
+			if roleRequiresTwoFactor(r, user.Role) {
+				renderTemplate(w, r, "login", map[string]any{"Error": "Für diese Rolle ist Zwei-Faktor-Anmeldung Pflicht. Bitte mit einem Datenbank-Konto anmelden.", "SSO": sso})
+				return
+			}
 			session, _ := store.Get(r, "session")
 			session.Values["username"] = user.Username
 			session.Values["role"] = user.Role
@@ -342,22 +450,28 @@ func loginHandler(users map[string]AuthUser) http.HandlerFunc {
 			return
 		}
 
-		// Try DB users: treat username as email and set a normal session
-		if u, exists := getUserByEmail(username); exists && u.Password != "" {
-			if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err == nil {
-				session, _ := store.Get(r, "session")
-				// prefer displaying the DB user's name
-				session.Values["username"] = u.Name
-				session.Values["role"] = u.Role
-				session.Values["db_user_id"] = u.ID
-				session.Values["db_user_email"] = u.Email
-				session.Options = &sessions.Options{Path: "/", MaxAge: sessionDuration * 60, HttpOnly: true}
-				session.Save(r, w)
-				http.Redirect(w, r, "/", http.StatusFound)
+		// Try DB users: treat username as email and set a normal session;
+		// fall back to an LDAP bind if the tenant has a directory configured
+		u, exists := getUserByEmail(username)
+		authenticated := passwordMatches(u, exists, password)
+		if !authenticated {
+			u, authenticated = ldapLogin(r, username, password)
+		}
+		if authenticated && u.Active != 0 {
+			// role is only granted after the optional TOTP step; the counter
+			// is only cleared once both factors passed
+			if twoFactorRequired(r, u) {
+				beginTwoFactor(w, r, u)
+				http.Redirect(w, r, "/login/2fa", http.StatusFound)
 				return
 			}
+			recordLoginSuccess(username)
+			startUserSession(w, r, u)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
 		}
-		renderTemplate(w, r, "login", map[string]any{"Error": "Benutzername oder Passwort falsch."})
+		recordLoginFailure(r, username)
+		renderTemplate(w, r, "login", map[string]any{"Error": "Benutzername oder Passwort falsch.", "SSO": sso})
 	}
 }
 
@@ -401,6 +515,9 @@ type Entry struct {
 func clockInOutForm(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		users := getUsers()
+		if self := selfStampUser(r); self != 0 {
+			users = []User{getUser(strconv.Itoa(self))}
+		}
 		activities := getActivities()
 		type cur struct{ Status, Since string }
 		var current *cur
@@ -412,8 +529,9 @@ func clockInOutForm(w http.ResponseWriter, r *http.Request) {
 		data := struct {
 			Users      []User
 			Activities []Activity
+			Projects   []Project
 			Current    *cur
-		}{users, activities, current}
+		}{users, activities, stampProjects(time.Now()), current}
 		renderTemplate(w, r, "clockInOutForm", data)
 	}
 }
@@ -436,13 +554,26 @@ func editUserHandler(w http.ResponseWriter, r *http.Request) {
 		id := r.FormValue("id")
 		u := getUser(id)
 		depts := getDepartments()
+		debounce := ""
+		if secs, ok := getUserDebounce(id); ok {
+			debounce = strconv.Itoa(secs)
+		}
 		renderTemplate(w, r, "editUser", struct {
 			User        User
 			Departments []Department
-		}{u, depts})
+			Debounce    string
+			CostCenter  int
+			CostCenters []CostCenter
+		}{u, depts, debounce, getUserCostCenter(id), getCostCenters()})
 		return
 	} else if r.Method == http.MethodPost {
 		id := r.FormValue("id")
+		if pw := r.FormValue("password"); pw != "" {
+			if err := checkPasswordPolicy(r, User{Name: r.FormValue("name"), Email: r.FormValue("email")}, pw); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 		updateUser(id,
 			r.FormValue("name"),
 			r.FormValue("stampkey"),
@@ -454,6 +585,9 @@ func editUserHandler(w http.ResponseWriter, r *http.Request) {
 		)
 		// update auto-checkout flag
 		setUserAutoCheckout(id, r.FormValue("auto_checkout_midnight") == "on")
+		setUserActive(id, r.FormValue("active") == "on")
+		setUserDebounce(id, r.FormValue("debounce_seconds"))
+		setUserCostCenter(id, r.FormValue("cost_center_id"))
 	}
 	http.Redirect(w, r, "/addUser", http.StatusSeeOther)
 }
@@ -481,6 +615,12 @@ func addDepartmentHandler(w http.ResponseWriter, r *http.Request) {
 // createUserHandler processes adding a new user
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
+		if pw := r.FormValue("password"); pw != "" {
+			if err := checkPasswordPolicy(r, User{Name: r.FormValue("name"), Email: r.FormValue("email")}, pw); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 		createUser(
 			r.FormValue("name"),
 			r.FormValue("stampkey"),
@@ -667,9 +807,19 @@ func buildWeekDays(weekStart time.Time, entries []CalendarEntry) []WeekViewDay {
 					EndHour:   endTs.Sub(dayStart).Hours(),
 					IsWork:    ev.IsWork,
 				}
+				endLabel := endTs.Format("15:04")
+				if !endTs.Before(dayEnd) {
+					endLabel = "24:00"
+				}
+				seg.Title = fmt.Sprintf("%s: %s %s–%s", ev.UserName, ev.Activity, startTs.Format("15:04"), endLabel)
+				if ev.Comment != "" {
+					seg.Title += "\n" + ev.Comment
+				}
 				if seg.EndHour > seg.StartHour {
 					seg.LeftPct = (seg.StartHour / 24.0) * 100.0
 					seg.WidthPct = ((seg.EndHour - seg.StartHour) / 24.0) * 100.0
+					seg.LeftCSS = fmt.Sprintf("%.2f%%", seg.LeftPct)
+					seg.WidthCSS = fmt.Sprintf("%.2f%%", seg.WidthPct)
 					daySegs = append(daySegs, seg)
 					dur := seg.EndHour - seg.StartHour
 					if seg.IsWork {
@@ -805,11 +955,16 @@ func getCalendarData(targetDate time.Time, userFilter, activityFilter string) Ca
 // createActivityHandler processes adding a new activity
 func createActivityHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
-		createActivity(
+		id, err := createActivity(
 			r.FormValue("status"),
 			r.FormValue("work"),
 			r.FormValue("comment"),
+			r.FormValue("code"),
 		)
+		if err == nil {
+			setActivityCommentRequired(strconv.FormatInt(id, 10), r.FormValue("comment_required") == "1")
+			setActivityBillable(strconv.FormatInt(id, 10), r.FormValue("billable") == "1")
+		}
 	}
 	http.Redirect(w, r, "/addActivity", http.StatusSeeOther)
 }
@@ -842,8 +997,26 @@ func clockInOut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	if self := selfStampUser(r); self != 0 && userID != strconv.Itoa(self) {
+		http.Error(w, "Ohne Terminal können nur eigene Stempel gesetzt werden.", http.StatusForbidden)
+		return
+	}
 
-	createEntry(userID, activityID, time.Now())
+	now := time.Now()
+	details := stampDetailsFromForm(r)
+	if err := checkStampDetails(getActivity(activityID), &details, now); err != nil {
+		http.Error(w, stampErrorMessage(err), http.StatusUnprocessableEntity)
+		return
+	}
+	if _, _, err := stampEntry(userID, activityID, now, stampTerminal(r).ID, details); err != nil {
+		status := http.StatusInternalServerError
+		var rej *StampRejection
+		if errors.As(err, &rej) {
+			status = http.StatusConflict
+		}
+		http.Error(w, stampErrorMessage(err), status)
+		return
+	}
 
 	// Redirect back to the referring page
 	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther)
@@ -874,6 +1047,7 @@ func passwordStampHandler(w http.ResponseWriter, r *http.Request) {
 			renderTemplate(w, r, "passwordStamp", map[string]any{
 				"User":       u,
 				"Activities": activities,
+				"Projects":   stampProjects(time.Now()),
 				"Current":    current,
 			})
 			return
@@ -888,15 +1062,33 @@ func passwordStampHandler(w http.ResponseWriter, r *http.Request) {
 				renderTemplate(w, r, "passwordStamp", map[string]any{
 					"User":       u,
 					"Activities": activities,
+					"Projects":   stampProjects(time.Now()),
 					"Current":    current,
 				})
 				return
 			}
-			createEntry(strconv.Itoa(u.ID), activityID, time.Now())
+			now := time.Now()
+			details := stampDetailsFromForm(r)
+			err := checkStampDetails(getActivity(activityID), &details, now)
+			if err == nil {
+				_, _, err = stampEntry(strconv.Itoa(u.ID), activityID, now, 0, details)
+			}
 			var current any
 			if st, at, ok2 := getCurrentStatusForUserID(u.ID); ok2 {
 				current = map[string]string{"Status": st, "Since": humanizeDuration(time.Since(at))}
 			}
+			if err != nil {
+				renderTemplate(w, r, "passwordStamp", map[string]any{
+					"User":       u,
+					"Activities": getActivities(),
+					"Projects":   stampProjects(time.Now()),
+					"Current":    current,
+					"Comment":    details.Comment,
+					"Project":    r.FormValue("project"),
+					"Error":      stampErrorMessage(err),
+				})
+				return
+			}
 			renderTemplate(w, r, "passwordStamp", map[string]any{"User": u, "Success": true, "Current": current})
 			return
 		default:
@@ -913,15 +1105,17 @@ func passwordStampHandler(w http.ResponseWriter, r *http.Request) {
 		email := r.FormValue("email")
 		pwd := r.FormValue("pwd")
 		activityID := r.FormValue("activity_id")
-		u, ok := getUserByEmail(email)
-		if !ok || u.Password == "" {
-			renderTemplate(w, r, "passwordStamp", map[string]any{"Error": "Unbekannte E-Mail oder kein Passwort gesetzt."})
+		if wait, blocked := loginBlocked(r, email); blocked {
+			tooManyAttempts(w, wait)
 			return
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(pwd)); err != nil {
-			renderTemplate(w, r, "passwordStamp", map[string]any{"Error": "Falsches Passwort."})
+		u, ok := getUserByEmail(email)
+		if !passwordMatches(u, ok, pwd) {
+			recordLoginFailure(r, email)
+			renderTemplate(w, r, "passwordStamp", map[string]any{"Error": "E-Mail oder Passwort falsch."})
 			return
 		}
+		recordLoginSuccess(email)
 		if activityID == "" {
 			activities := getActivities()
 			var current any
@@ -931,16 +1125,35 @@ func passwordStampHandler(w http.ResponseWriter, r *http.Request) {
 			renderTemplate(w, r, "passwordStamp", map[string]any{
 				"User":       u,
 				"Activities": activities,
+				"Projects":   stampProjects(time.Now()),
 				"Pwd":        pwd,
 				"Current":    current,
 			})
 			return
 		}
-		createEntry(strconv.Itoa(u.ID), activityID, time.Now())
+		now := time.Now()
+		details := stampDetailsFromForm(r)
+		err := checkStampDetails(getActivity(activityID), &details, now)
+		if err == nil {
+			_, _, err = stampEntry(strconv.Itoa(u.ID), activityID, now, 0, details)
+		}
 		var current any
 		if st, at, ok2 := getCurrentStatusForUserID(u.ID); ok2 {
 			current = map[string]string{"Status": st, "Since": humanizeDuration(time.Since(at))}
 		}
+		if err != nil {
+			renderTemplate(w, r, "passwordStamp", map[string]any{
+				"User":       u,
+				"Activities": getActivities(),
+				"Projects":   stampProjects(time.Now()),
+				"Pwd":        pwd,
+				"Current":    current,
+				"Comment":    details.Comment,
+				"Project":    r.FormValue("project"),
+				"Error":      stampErrorMessage(err),
+			})
+			return
+		}
 		renderTemplate(w, r, "passwordStamp", map[string]any{"User": u, "Success": true, "Current": current})
 		return
 	default:
@@ -1048,53 +1261,12 @@ func currentStatusHandler(w http.ResponseWriter, r *http.Request) {
 // scanHandler serves the barcode-scanning page
 func scanHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		renderTemplate(w, r, "scan", nil)
+		renderTemplate(w, r, "scan", map[string]any{"Projects": stampProjects(time.Now())})
 		return
 	}
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
-// bulkClockHandler processes the JSON payload from the scan page
-func bulkClockHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	var req BulkClockRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Bad payload", http.StatusBadRequest)
-		return
-	}
-
-	db := getDB()
-	defer db.Close()
-
-	// look up activity by its code field (you must have added `code TEXT UNIQUE` to `type`)
-	var activityID int
-	if err := db.QueryRow("SELECT id FROM type WHERE code = ?", req.ActivityCode).Scan(&activityID); err != nil {
-		http.Error(w, "Unknown activity code", http.StatusBadRequest)
-		return
-	}
-
-	tx, _ := db.Begin()
-	stmt, _ := tx.Prepare("INSERT INTO entries(date, type_id, user_id) VALUES (?, ?, ?)")
-	defer stmt.Close()
-
-	now := time.Now().Format(time.RFC3339)
-	for _, code := range req.UserCodes {
-		var userID int
-		if err := db.QueryRow("SELECT id FROM users WHERE stampkey = ?", code).Scan(&userID); err != nil {
-			// skip unknown cards
-			continue
-		}
-		// auto checkout at midnight if flagged and necessary
-		ensureMidnightAutoCheckoutWithDB(db, userID, time.Now())
-		stmt.Exec(now, activityID, userID)
-	}
-	tx.Commit()
-	w.WriteHeader(http.StatusNoContent)
-}
-
 // Enhanced dashboard handler
 func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 	// Interaction parameters
@@ -1212,7 +1384,8 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 
 // Entries management handler
 func entriesHandler(w http.ResponseWriter, r *http.Request) {
-	entries := getEntriesWithDetails()
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	entries := getEntriesWithDetails(query)
 	users := getUsers()
 	activities := getActivities()
 
@@ -1220,10 +1393,12 @@ func entriesHandler(w http.ResponseWriter, r *http.Request) {
 		Entries    []EntryDetail
 		Users      []User
 		Activities []Activity
+		Query      string // comment search
 	}{
 		Entries:    entries,
 		Users:      users,
 		Activities: activities,
+		Query:      query,
 	}
 
 	renderTemplate(w, r, "entries", data)
@@ -1241,10 +1416,34 @@ func editEntryHandler(w http.ResponseWriter, r *http.Request) {
 			Entry      EntryDetail
 			Users      []User
 			Activities []Activity
+			Projects   []Project
+			Project    string // picker value of the entry's project/task
+			Terminal   string
+			Location   *EntryLocation
+			Locked     bool // month closed; changes need a correction reason
+			Audit      []EntryAudit
+			Correction int // request the entry was last changed by
 		}{
 			Entry:      entry,
 			Users:      users,
 			Activities: activities,
+			Projects:   getProjects(),
+			Terminal:   entryTerminalName(id),
+			Audit:      getEntryAudit(id),
+			Correction: entryCorrectionRequest(id),
+		}
+		if entry.ID != 0 {
+			db := getDB()
+			data.Locked = periodLocked(db, strconv.Itoa(entry.UserID), parseDBTimeInLoc(entry.Date, time.Local))
+			db.Close()
+		}
+		if entry.TaskID != 0 {
+			data.Project = fmt.Sprintf("%d:%d", entry.ProjectID, entry.TaskID)
+		} else if entry.ProjectID != 0 {
+			data.Project = strconv.Itoa(entry.ProjectID)
+		}
+		if l, ok := getEntryLocation(id); ok {
+			data.Location = &l
 		}
 
 		renderTemplate(w, r, "editEntry", data)
@@ -1257,8 +1456,21 @@ func editEntryHandler(w http.ResponseWriter, r *http.Request) {
 		activityID := r.FormValue("activity_id")
 		date := r.FormValue("date")
 		comment := r.FormValue("comment")
+		reason := r.FormValue("correction_reason")
 
-		updateEntry(id, userID, activityID, date, comment)
+		before := getEntry(id)
+		audit, err := authorizeEntryChange(before, userID, parseDBTimeInLoc(date, time.Local), sessionRole(r), reason)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		// corrections may book to closed projects and tasks
+		projectID, taskID := parseProjectChoice(r.FormValue("project"))
+		updateEntry(id, userID, activityID, date, comment, projectID, taskID)
+		if audit {
+			after := getEntry(id)
+			recordEntryAudit(after.ID, after.UserID, "update", reason, sessionUsername(r), entrySummary(before), entrySummary(after))
+		}
 		http.Redirect(w, r, "/entries", http.StatusSeeOther)
 		return
 	}
@@ -1281,7 +1493,10 @@ func editActivityHandler(w http.ResponseWriter, r *http.Request) {
 			r.FormValue("status"),
 			r.FormValue("work"),
 			r.FormValue("comment"),
+			r.FormValue("code"),
 		)
+		setActivityCommentRequired(id, r.FormValue("comment_required") == "1")
+		setActivityBillable(id, r.FormValue("billable") == "1")
 		http.Redirect(w, r, "/addActivity", http.StatusSeeOther)
 		return
 	}
@@ -1294,7 +1509,11 @@ func editDepartmentHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		id := r.FormValue("id")
 		dept := getDepartment(id)
-		renderTemplate(w, r, "editDepartment", dept)
+		renderTemplate(w, r, "editDepartment", struct {
+			Department
+			Activities []Activity
+			Geofences  []Geofence
+		}{dept, getActivities(), getGeofences(dept.ID)})
 		return
 	}
 
@@ -1302,6 +1521,7 @@ func editDepartmentHandler(w http.ResponseWriter, r *http.Request) {
 		id := r.FormValue("id")
 		name := r.FormValue("name")
 		updateDepartment(id, name)
+		setDepartmentToggle(id, atoiDefault(r.FormValue("toggle_work_type_id"), 0), atoiDefault(r.FormValue("toggle_off_type_id"), 0))
 		http.Redirect(w, r, "/addDepartment", http.StatusSeeOther)
 		return
 	}
@@ -1317,7 +1537,17 @@ func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id := r.FormValue("id")
+	e := getEntry(id)
+	reason := r.FormValue("correction_reason")
+	audit, err := authorizeEntryChange(e, "", time.Time{}, sessionRole(r), reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	deleteEntry(id)
+	if audit {
+		recordEntryAudit(e.ID, e.UserID, "delete", reason, sessionUsername(r), entrySummary(e), "")
+	}
 	http.Redirect(w, r, "/entries", http.StatusSeeOther)
 }
 
@@ -1360,7 +1590,7 @@ func downloadEntriesCSV(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Disposition", "attachment; filename=entries.csv")
 	enc := csv.NewWriter(w)
 	_ = enc.Write([]string{"ID", "User", "Department", "Activity", "Date", "Start", "End", "DurationHours", "Comment"})
-	for _, e := range getEntriesWithDetails() {
+	for _, e := range getEntriesWithDetails(r.URL.Query().Get("q")) {
 		enc.Write([]string{strconv.Itoa(e.ID), e.UserName, e.Department, e.Activity, e.Date, e.Start, e.End, strconv.FormatFloat(e.Duration, 'f', 2, 64), e.Comment})
 	}
 	enc.Flush()
@@ -1383,15 +1613,20 @@ func adminDownloadsHandler(w http.ResponseWriter, r *http.Request) {
 	users := getUsers()
 	activities := getActivities()
 	departments := getDepartments()
+	projects := getProjects()
 
 	data := struct {
 		Users       []User
 		Activities  []Activity
 		Departments []Department
+		Projects    []Project
+		Clients     []string
 	}{
 		Users:       users,
 		Activities:  activities,
 		Departments: departments,
+		Projects:    projects,
+		Clients:     clients(projects),
 	}
 
 	renderTemplate(w, r, "downloads", data)
@@ -1700,6 +1935,22 @@ func renderPreviewTableWorkHours(w http.ResponseWriter, workHours []WorkHoursDat
 	w.Write([]byte(html))
 }
 
+// myHistoryData is the page data of /myHistory for user u; Activities and
+// Corrections feed the correction request form
+func myHistoryData(u User, from, to string, withEntries bool) map[string]any {
+	data := map[string]any{
+		"User":        u,
+		"From":        from,
+		"To":          to,
+		"Activities":  getActivities(),
+		"Corrections": getCorrectionRequests(u.ID, 0, "", 10),
+	}
+	if withEntries {
+		data["Entries"] = getUserEntriesDetailed(u.ID, from, to)
+	}
+	return data
+}
+
 // myHistoryHandler lets a user view their own history by email+password with optional date range
 func myHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session")
@@ -1716,19 +1967,11 @@ func myHistoryHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		u := getUser(strconv.Itoa(uid))
 		if r.Method == http.MethodGet {
-			renderTemplate(w, r, "myHistory", map[string]any{"User": u})
+			renderTemplate(w, r, "myHistory", myHistoryData(u, "", "", false))
 			return
 		}
 		if r.Method == http.MethodPost {
-			from := r.FormValue("from")
-			to := r.FormValue("to")
-			entries := getUserEntriesDetailed(u.ID, from, to)
-			renderTemplate(w, r, "myHistory", map[string]any{
-				"User":    u,
-				"From":    from,
-				"To":      to,
-				"Entries": entries,
-			})
+			renderTemplate(w, r, "myHistory", myHistoryData(u, r.FormValue("from"), r.FormValue("to"), true))
 			return
 		}
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -1744,22 +1987,18 @@ func myHistoryHandler(w http.ResponseWriter, r *http.Request) {
 		pwd := r.FormValue("pwd")
 		from := r.FormValue("from")
 		to := r.FormValue("to")
-		u, ok := getUserByEmail(email)
-		if !ok || u.Password == "" {
-			renderTemplate(w, r, "myHistory", map[string]any{"Error": "Unknown email or no password set."})
+		if wait, blocked := loginBlocked(r, email); blocked {
+			tooManyAttempts(w, wait)
 			return
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(pwd)); err != nil {
-			renderTemplate(w, r, "myHistory", map[string]any{"Error": "Wrong password."})
+		u, ok := getUserByEmail(email)
+		if !passwordMatches(u, ok, pwd) {
+			recordLoginFailure(r, email)
+			renderTemplate(w, r, "myHistory", map[string]any{"Error": "Invalid email or password."})
 			return
 		}
-		entries := getUserEntriesDetailed(u.ID, from, to)
-		renderTemplate(w, r, "myHistory", map[string]any{
-			"User":    u,
-			"From":    from,
-			"To":      to,
-			"Entries": entries,
-		})
+		recordLoginSuccess(email)
+		renderTemplate(w, r, "myHistory", myHistoryData(u, from, to, true))
 		return
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
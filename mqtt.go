@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT integration for stamping hardware. With MQTT_BROKER set the server
+// subscribes to MQTT_TOPIC (default wtm/+/stamp, the + level is the device
+// id) for {"stampkey", "activityCode", "ts"} messages and stamps them like
+// the terminals do. Every message is answered on <device>/ack, the user's
+// new state goes to <device>/status. The broker's ACLs decide who may
+// publish stamps.
+
+const (
+	mqttDefaultTopic = "wtm/+/stamp"
+	mqttQoS          = 1
+	mqttPublishWait  = 5 * time.Second
+)
+
+type mqttConfig struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	Topic    string
+	Tenant   string // tenant host the stamps belong to (SQLite)
+}
+
+func mqttConfigFromEnv() (mqttConfig, bool) {
+	cfg := mqttConfig{
+		Broker:   strings.TrimSpace(os.Getenv("MQTT_BROKER")),
+		ClientID: getenv("MQTT_CLIENT_ID", "workingtime"),
+		Username: os.Getenv("MQTT_USER"),
+		Password: os.Getenv("MQTT_PASSWORD"),
+		Topic:    getenv("MQTT_TOPIC", mqttDefaultTopic),
+		Tenant:   getenv("MQTT_TENANT", "localhost"),
+	}
+	return cfg, cfg.Broker != ""
+}
+
+// MQTTStamp is a stamp message from a device. An empty activityCode
+// toggles like the terminal; ts is RFC 3339 or Unix seconds, missing for
+// devices without a clock.
+type MQTTStamp struct {
+	ID           string          `json:"id,omitempty"` // echoed in the ack
+	Stampkey     string          `json:"stampkey"`
+	ActivityCode string          `json:"activityCode"`
+	TS           json.RawMessage `json:"ts,omitempty"`
+}
+
+// MQTTAck answers a stamp message on the device's ack topic
+type MQTTAck struct {
+	ID       string `json:"id,omitempty"`
+	Result   string `json:"result"` // stamped, merged, invalid, unknown_card, unknown_activity, too_old, future, failed, StampRejection codes
+	Message  string `json:"message,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Activity string `json:"activity,omitempty"`
+	EntryID  int64  `json:"entryId,omitempty"`
+	At       string `json:"at,omitempty"` // RFC 3339
+}
+
+// MQTTStatus is the user's state after a stamp, for displays on the device
+type MQTTStatus struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Work       bool    `json:"work"`
+	Since      string  `json:"since"` // RFC 3339
+	TodayHours float64 `json:"todayHours"`
+}
+
+// startMQTT connects to the broker in the background; the client retries
+// and re-subscribes on its own after connection losses. Each message is
+// stamped on its own goroutine (order does not matter, so paho's router is
+// never blocked by the database) and acknowledged only after its handler
+// returned, so with the persistent session the broker keeps and redelivers
+// QoS 1 stamps that were not stored yet when the server went down. Stamps
+// of one user are serialized by stampEntry.
+func startMQTT() {
+	cfg, ok := mqttConfigFromEnv()
+	if !ok {
+		return
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("[MQTT] connection to %s lost: %v", cfg.Broker, err)
+	})
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Printf("[MQTT] connected to %s, subscribing to %s", cfg.Broker, cfg.Topic)
+		t := c.Subscribe(cfg.Topic, mqttQoS, func(c mqtt.Client, m mqtt.Message) {
+			handleMQTTStamp(c, cfg, m.Topic(), m.Payload())
+		})
+		go func() {
+			if t.WaitTimeout(mqttPublishWait) && t.Error() != nil {
+				log.Printf("[MQTT] subscribe %s failed: %v", cfg.Topic, t.Error())
+			}
+		}()
+	})
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	log.Printf("[MQTT] stamping via %s on %s (tenant %s)", cfg.Broker, cfg.Topic, cfg.Tenant)
+}
+
+// handleMQTTStamp stamps one message and answers the device
+func handleMQTTStamp(c mqtt.Client, cfg mqttConfig, topic string, payload []byte) {
+	if dbBackend == "sqlite" {
+		SetRequestHost(cfg.Tenant)
+		defer ClearRequestHost()
+		EnsureSchemaCurrent()
+	}
+	device := path.Dir(topic)
+	var msg MQTTStamp
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		mqttPublish(c, device+"/ack", MQTTAck{Result: "invalid", Message: "invalid JSON"})
+		return
+	}
+	ack, status := mqttStamp(msg, time.Now())
+	mqttPublish(c, device+"/ack", ack)
+	if status != nil {
+		mqttPublish(c, device+"/status", status)
+	}
+	log.Printf("[MQTT] %s %s: %s %s", topic, msg.Stampkey, ack.Result, ack.Message)
+}
+
+// mqttStamp records msg through stampEntry, so stamp rules, auto checkout,
+// webhooks and the board apply as for every other live stamp
+func mqttStamp(msg MQTTStamp, now time.Time) (MQTTAck, *MQTTStatus) {
+	ack := MQTTAck{ID: msg.ID}
+	at, err := parseMQTTTime(msg.TS, now)
+	switch {
+	case err != nil:
+		ack.Result, ack.Message = "invalid", err.Error()
+		return ack, nil
+	case at.After(now.Add(terminalSyncMaxSkew)):
+		ack.Result = "future"
+		return ack, nil
+	case now.Sub(at) > terminalSyncMaxAge:
+		ack.Result = "too_old"
+		return ack, nil
+	}
+	ack.At = at.Format(time.RFC3339)
+
+	userID := getUserIDFromStampKey(scannedCode(strings.TrimSpace(msg.Stampkey), "USR"))
+	if userID == "" {
+		ack.Result = "unknown_card"
+		return ack, nil
+	}
+	u := getUser(userID)
+	ack.Name = u.Name
+	var activity Activity
+	if code := strings.TrimSpace(msg.ActivityCode); code != "" {
+		activity, _ = getActivityByScan(code)
+	} else {
+		db := getDB()
+		activity, _ = toggleTarget(u, wasAtWork(db, userID, at))
+		db.Close()
+	}
+	if activity.ID == 0 {
+		ack.Result = "unknown_activity"
+		return ack, nil
+	}
+	ack.Activity = activity.Status
+
+	id, merged, err := stampEntry(userID, strconv.Itoa(activity.ID), at, 0, StampDetails{})
+	var rej *StampRejection
+	switch {
+	case errors.As(err, &rej):
+		ack.Result, ack.Message = rej.Code, rej.Message
+		return ack, nil
+	case err != nil:
+		log.Printf("[MQTT] stamp for %s failed: %v", u.Name, err)
+		ack.Result, ack.Message = "failed", "Stempeln fehlgeschlagen."
+		return ack, nil
+	case merged:
+		ack.Result = "merged"
+	default:
+		ack.Result = "stamped"
+	}
+	ack.EntryID = id
+	return ack, &MQTTStatus{
+		Name:       u.Name,
+		Status:     activity.Status,
+		Work:       activity.Work == 1,
+		Since:      at.Format(time.RFC3339),
+		TodayHours: dailyWorkHours(u.Name, at.Format("2006-01-02")),
+	}
+}
+
+// parseMQTTTime reads ts as RFC 3339 string or Unix seconds; devices
+// without a clock leave it out (or send 0) and get the receive time
+func parseMQTTTime(raw json.RawMessage, now time.Time) (time.Time, error) {
+	s := strings.TrimSpace(string(raw))
+	if s == "" || s == "null" || s == "0" || s == `""` {
+		return now, nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		var str string
+		if err := json.Unmarshal(raw, &str); err != nil {
+			return time.Time{}, err
+		}
+		return parseAPITime(str)
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid ts %s, use RFC 3339 or Unix seconds", s)
+	}
+	return time.Unix(0, int64(secs*float64(time.Second))), nil
+}
+
+func mqttPublish(c mqtt.Client, topic string, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[MQTT] encode %s: %v", topic, err)
+		return
+	}
+	if t := c.Publish(topic, mqttQoS, false, b); t.WaitTimeout(mqttPublishWait) && t.Error() != nil {
+		log.Printf("[MQTT] publish %s failed: %v", topic, t.Error())
+	}
+}
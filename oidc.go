@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig configures OpenID Connect single sign-on for a tenant
+// (key "oidc" in tenant/<host>/config.json).
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectUrl"` // optional; derived from the request host when empty
+	Scopes       []string `json:"scopes"`      // defaults to openid, email, profile
+	Label        string   `json:"label"`       // text of the login button
+	// GroupsClaim names the ID token claim carrying group names (default "groups")
+	GroupsClaim string `json:"groupsClaim"`
+	// GroupRoles maps IdP groups to app roles, e.g. {"wtm-admins": "admin"}
+	GroupRoles map[string]string `json:"groupRoles"`
+	// GroupDepartments maps IdP groups to department names
+	GroupDepartments map[string]string `json:"groupDepartments"`
+	// TrustIdPMFA skips the app's TOTP step for SSO logins, for identity
+	// providers that enforce MFA themselves; off by default
+	TrustIdPMFA bool `json:"trustIdPMFA"`
+}
+
+func (c *OIDCConfig) enabled() bool {
+	return c != nil && c.Issuer != "" && c.ClientID != ""
+}
+
+// buttonLabel returns the login button text; empty when SSO is not configured
+func (c *OIDCConfig) buttonLabel() string {
+	if !c.enabled() {
+		return ""
+	}
+	if c.Label != "" {
+		return c.Label
+	}
+	return "Single Sign-On"
+}
+
+var oidcProviders sync.Map // issuer -> *oidc.Provider
+
+// oidcProvider performs discovery once per issuer
+func oidcProvider(ctx context.Context, issuer string) (*oidc.Provider, error) {
+	if v, ok := oidcProviders.Load(issuer); ok {
+		return v.(*oidc.Provider), nil
+	}
+	p, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProviders.Store(issuer, p)
+	return p, nil
+}
+
+func oidcOAuthConfig(r *http.Request, cfg *OIDCConfig, p *oidc.Provider) *oauth2.Config {
+	redirect := cfg.RedirectURL
+	if redirect == "" {
+		scheme := "http"
+		if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			scheme = "https"
+		}
+		redirect = scheme + "://" + r.Host + "/login/oidc/callback"
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	return &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     p.Endpoint(),
+		RedirectURL:  redirect,
+		Scopes:       scopes,
+	}
+}
+
+func randomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("random token: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// oidcLoginHandler starts the authorization code flow (with PKCE)
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := tenantConfigFor(r).OIDC
+	if !cfg.enabled() {
+		renderNotFound(w)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	p, err := oidcProvider(ctx, cfg.Issuer)
+	if err != nil {
+		log.Printf("OIDC discovery %s failed: %v", cfg.Issuer, err)
+		renderServiceUnavailable(w, fmt.Errorf("identity provider not reachable"))
+		return
+	}
+	state, nonce, verifier := randomToken(16), randomToken(16), oauth2.GenerateVerifier()
+	session, _ := store.Get(r, "session")
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	session.Save(r, w)
+	url := oidcOAuthConfig(r, cfg, p).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// oidcCallbackHandler completes the flow, maps the email claim to a DB user and logs them in
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := tenantConfigFor(r).OIDC
+	if !cfg.enabled() {
+		renderNotFound(w)
+		return
+	}
+	loginError := func(msg string) {
+		renderTemplate(w, r, "login", map[string]any{"Error": msg, "SSO": cfg.buttonLabel()})
+	}
+	session, _ := store.Get(r, "session")
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	delete(session.Values, "oidc_state")
+	delete(session.Values, "oidc_nonce")
+	delete(session.Values, "oidc_verifier")
+	session.Save(r, w)
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		loginError("Single Sign-On abgebrochen: " + e)
+		return
+	}
+	if state == "" || r.URL.Query().Get("state") != state {
+		loginError("Single Sign-On fehlgeschlagen (ungültiger Status). Bitte erneut versuchen.")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	p, err := oidcProvider(ctx, cfg.Issuer)
+	if err != nil {
+		renderServiceUnavailable(w, fmt.Errorf("identity provider not reachable"))
+		return
+	}
+	tok, err := oidcOAuthConfig(r, cfg, p).Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		loginError("Single Sign-On fehlgeschlagen.")
+		return
+	}
+	rawID, ok := tok.Extra("id_token").(string)
+	if !ok {
+		loginError("Single Sign-On fehlgeschlagen (kein ID-Token).")
+		return
+	}
+	idToken, err := p.Verifier(&oidc.Config{ClientID: cfg.ClientID}).Verify(ctx, rawID)
+	if err != nil || idToken.Nonce != nonce {
+		log.Printf("OIDC id token rejected: %v", err)
+		loginError("Single Sign-On fehlgeschlagen (Token ungültig).")
+		return
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		loginError("Single Sign-On fehlgeschlagen.")
+		return
+	}
+	email, _ := claims["email"].(string)
+	if verified, present := claims["email_verified"].(bool); present && !verified {
+		email = ""
+	}
+	u, exists := getUserByEmail(strings.TrimSpace(email))
+	if email == "" || !exists || u.Active == 0 {
+		log.Printf("OIDC login for unknown email %q", email)
+		loginError("Kein Konto für diese Anmeldung vorhanden. Bitte an die Administration wenden.")
+		return
+	}
+	applyOIDCGroups(&u, cfg, claims)
+	// SSO logins pass the same second factor as password logins
+	if !cfg.TrustIdPMFA && twoFactorRequired(r, u) {
+		beginTwoFactor(w, r, u)
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+	startUserSession(w, r, u)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// oidcGroups reads the configured groups claim (array or single string)
+func oidcGroups(cfg *OIDCConfig, claims map[string]any) []string {
+	name := cfg.GroupsClaim
+	if name == "" {
+		name = "groups"
+	}
+	var out []string
+	switch v := claims[name].(type) {
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				out = append(out, s)
+			}
+		}
+	case string:
+		out = append(out, v)
+	}
+	return out
+}
+
+var roleRank = map[string]int{"user": 1, "manager": 2, "hr": 3, "admin": 4}
+
+// highestMappedRole returns the highest-ranked role mapped from groups, or "" if none matches
+func highestMappedRole(mapping map[string]string, groups []string) string {
+	role := ""
+	for _, g := range groups {
+		if mapped, ok := mapping[g]; ok && roleRank[strings.ToLower(mapped)] > roleRank[role] {
+			role = strings.ToLower(mapped)
+		}
+	}
+	return role
+}
+
+// applyOIDCGroups updates role and department from group claims if mappings are configured.
+// The highest mapped role wins; the first group with a department mapping sets the department.
+func applyOIDCGroups(u *User, cfg *OIDCConfig, claims map[string]any) {
+	if len(cfg.GroupRoles) == 0 && len(cfg.GroupDepartments) == 0 {
+		return
+	}
+	groups := oidcGroups(cfg, claims)
+	role, deptID := highestMappedRole(cfg.GroupRoles, groups), u.DepartmentID
+	deptSet := false
+	for _, g := range groups {
+		if name, ok := cfg.GroupDepartments[g]; ok && !deptSet {
+			if d, found := getDepartmentByName(name); found {
+				deptID, deptSet = d.ID, true
+			}
+		}
+	}
+	if len(cfg.GroupRoles) > 0 {
+		if role == "" {
+			role = "user"
+		}
+		u.Role = role
+	}
+	u.DepartmentID = deptID
+	setUserRoleAndDepartment(u.ID, u.Role, u.DepartmentID)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultPasswordMinLength = 10
+	passwordResetTTL         = 24 * time.Hour
+)
+
+//---------------------------------------------------------------------
+// Password policy
+//---------------------------------------------------------------------
+
+var breachedLists sync.Map // path -> map[string]struct{}
+
+var sha1Line = regexp.MustCompile(`^[0-9A-Fa-f]{40}(:\d+)?$`)
+
+// breachedPasswordsFile returns the tenant's list, falling back to
+// PASSWORD_BREACHED_LIST and breached_passwords.txt in the working directory
+func breachedPasswordsFile(r *http.Request) string {
+	if f := tenantConfigFor(r).BreachedPasswordsFile; f != "" {
+		return f
+	}
+	return getenv("PASSWORD_BREACHED_LIST", "breached_passwords.txt")
+}
+
+// loadBreachedList reads one password per line, or SHA-1 hashes in the
+// "HASH:count" format of the Have I Been Pwned downloads. A missing file disables the check.
+func loadBreachedList(path string) map[string]struct{} {
+	if v, ok := breachedLists.Load(path); ok {
+		return v.(map[string]struct{})
+	}
+	set := map[string]struct{}{}
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			switch {
+			case line == "" || strings.HasPrefix(line, "#"):
+			case sha1Line.MatchString(line):
+				set["sha1:"+strings.ToUpper(line[:40])] = struct{}{}
+			default:
+				set[strings.ToLower(line)] = struct{}{}
+			}
+		}
+		if err := sc.Err(); err != nil {
+			log.Printf("reading %s: %v", path, err)
+		}
+		log.Printf("loaded %d breached passwords from %s", len(set), path)
+	}
+	breachedLists.Store(path, set)
+	return set
+}
+
+func passwordBreached(r *http.Request, pw string) bool {
+	set := loadBreachedList(breachedPasswordsFile(r))
+	if len(set) == 0 {
+		return false
+	}
+	if _, ok := set[strings.ToLower(pw)]; ok {
+		return true
+	}
+	sum := sha1.Sum([]byte(pw))
+	_, ok := set["sha1:"+strings.ToUpper(hex.EncodeToString(sum[:]))]
+	return ok
+}
+
+// checkPasswordPolicy validates a new password for u; the error text is shown to the user
+func checkPasswordPolicy(r *http.Request, u User, pw string) error {
+	minLen := tenantConfigFor(r).PasswordMinLength
+	if minLen <= 0 {
+		minLen = defaultPasswordMinLength
+	}
+	if utf8.RuneCountInString(pw) < minLen {
+		return fmt.Errorf("Das Passwort muss mindestens %d Zeichen lang sein.", minLen)
+	}
+	// bcrypt only uses the first 72 bytes
+	if len(pw) > 72 {
+		return fmt.Errorf("Das Passwort darf höchstens 72 Bytes lang sein.")
+	}
+	if strings.EqualFold(pw, u.Email) || strings.EqualFold(pw, u.Name) {
+		return fmt.Errorf("Das Passwort darf nicht dem Namen oder der E-Mail-Adresse entsprechen.")
+	}
+	if passwordBreached(r, pw) {
+		return fmt.Errorf("Dieses Passwort ist aus Datenlecks bekannt. Bitte ein anderes wählen.")
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+// Reset tokens
+//---------------------------------------------------------------------
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createPasswordResetToken invalidates older tokens of the user and returns a new one
+func createPasswordResetToken(userID int, createdBy string) (string, time.Time) {
+	db := getDB()
+	defer db.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=@uid", tbl("password_reset_tokens")), sql.Named("uid", userID)); err != nil {
+		log.Printf("delete old reset tokens failed: %v", err)
+	}
+	token := randomToken(32)
+	expires := time.Now().Add(passwordResetTTL)
+	query := fmt.Sprintf("INSERT INTO %s (user_id, token_hash, expires_at, created_by) VALUES (@uid,@hash,@exp,@by)", tbl("password_reset_tokens"))
+	if _, err := db.Exec(query, sql.Named("uid", userID), sql.Named("hash", hashResetToken(token)), sql.Named("exp", expires.Unix()), sql.Named("by", createdBy)); err != nil {
+		log.Printf("createPasswordResetToken failed: %v", err)
+		return "", time.Time{}
+	}
+	return token, expires
+}
+
+// lookupPasswordResetToken returns the user of an unused, unexpired token
+func lookupPasswordResetToken(token string) (User, bool) {
+	if token == "" {
+		return User{}, false
+	}
+	db := getDB()
+	defer db.Close()
+
+	var userID int
+	query := fmt.Sprintf("SELECT user_id FROM %s WHERE token_hash=@hash AND used_at IS NULL AND expires_at > @now", tbl("password_reset_tokens"))
+	if err := db.QueryRow(query, sql.Named("hash", hashResetToken(token)), sql.Named("now", time.Now().Unix())).Scan(&userID); err != nil {
+		return User{}, false
+	}
+	u := getUser(fmt.Sprint(userID))
+	return u, u.ID != 0 && u.Active != 0
+}
+
+func markPasswordResetTokenUsed(token string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET used_at=@now WHERE token_hash=@hash", tbl("password_reset_tokens"))
+	if _, err := db.Exec(query, sql.Named("now", time.Now().Unix()), sql.Named("hash", hashResetToken(token))); err != nil {
+		log.Printf("markPasswordResetTokenUsed failed: %v", err)
+	}
+}
+
+func deletePasswordResetTokens(userID int) {
+	db := getDB()
+	defer db.Close()
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=@uid", tbl("password_reset_tokens")), sql.Named("uid", userID)); err != nil {
+		log.Printf("deletePasswordResetTokens failed: %v", err)
+	}
+}
+
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+//---------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------
+
+// changePasswordHandler lets a logged-in DB user change their own password
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := currentDBUserFromSession(r)
+	if !ok || u.ID == 0 {
+		renderTemplate(w, r, "changePassword", map[string]any{"Error": "Passwortänderung ist nur für Datenbank-Benutzer möglich."})
+		return
+	}
+	data := map[string]any{"User": u, "HasPassword": u.Password != ""}
+	if getUserLDAPDN(u.ID) != "" {
+		data["Managed"] = true
+		renderTemplate(w, r, "changePassword", data)
+		return
+	}
+	// a first password (e.g. for an SSO-only account) would outlive the
+	// session it was set from, so it needs an admin-issued reset link
+	if u.Password == "" {
+		renderTemplate(w, r, "changePassword", data)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if wait, blocked := loginBlocked(r, u.Email); blocked {
+			tooManyAttempts(w, wait)
+			return
+		}
+		current, newPwd := r.FormValue("current"), r.FormValue("new")
+		if !passwordMatches(u, true, current) {
+			recordLoginFailure(r, u.Email)
+			data["Error"] = "Aktuelles Passwort falsch."
+		} else if newPwd != r.FormValue("confirm") {
+			data["Error"] = "Die neuen Passwörter stimmen nicht überein."
+		} else if err := checkPasswordPolicy(r, u, newPwd); err != nil {
+			data["Error"] = err.Error()
+		} else {
+			setUserPassword(u.ID, newPwd)
+			deletePasswordResetTokens(u.ID)
+			recordLoginSuccess(u.Email)
+			data["Message"] = "Passwort geändert."
+			data["HasPassword"] = true
+		}
+	}
+	renderTemplate(w, r, "changePassword", data)
+}
+
+// adminPasswordResetHandler creates a one-time reset link for a user and shows or mails it
+func adminPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := getUser(r.FormValue("id"))
+	if u.ID == 0 {
+		renderNotFound(w)
+		return
+	}
+	session, _ := store.Get(r, "session")
+	admin, _ := session.Values["username"].(string)
+	token, expires := createPasswordResetToken(u.ID, admin)
+	if token == "" {
+		renderInternalServerError(w, fmt.Errorf("could not create reset token"))
+		return
+	}
+	link := baseURL(r) + "/resetPassword?token=" + token
+	data := map[string]any{"User": u, "Link": link, "Expires": expires}
+	if r.FormValue("action") == "mail" {
+		mailer, configured := mailerFor(r)
+		body := fmt.Sprintf("Hallo %s,\n\nüber folgenden Link können Sie ein neues Passwort für die Zeiterfassung festlegen:\n\n%s\n\nDer Link ist bis %s gültig und kann nur einmal verwendet werden.\n",
+			u.Name, link, expires.Format("02.01.2006 15:04"))
+		switch {
+		case u.Email == "":
+			data["MailError"] = "Für diesen Benutzer ist keine E-Mail-Adresse hinterlegt."
+		case !configured:
+			data["MailError"] = "Kein SMTP-Server konfiguriert."
+		default:
+			if err := mailer.Send(u.Email, "Passwort zurücksetzen", body); err != nil {
+				log.Printf("sending reset mail to %s failed: %v", u.Email, err)
+				data["MailError"] = "Versand fehlgeschlagen: " + err.Error()
+			} else {
+				data["Mailed"] = true
+			}
+		}
+	}
+	renderTemplate(w, r, "passwordResetLink", data)
+}
+
+// resetPasswordHandler sets a new password via a one-time token (no session required)
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if wait, blocked := loginBlocked(r, ""); blocked {
+		tooManyAttempts(w, wait)
+		return
+	}
+	token := r.FormValue("token")
+	u, ok := lookupPasswordResetToken(token)
+	if !ok {
+		if token != "" {
+			recordLoginFailure(r, "")
+		}
+		renderTemplate(w, r, "resetPassword", map[string]any{"Invalid": true})
+		return
+	}
+	data := map[string]any{"Token": token, "User": u}
+	if r.Method == http.MethodPost {
+		newPwd := r.FormValue("new")
+		if newPwd != r.FormValue("confirm") {
+			data["Error"] = "Die Passwörter stimmen nicht überein."
+		} else if err := checkPasswordPolicy(r, u, newPwd); err != nil {
+			data["Error"] = err.Error()
+		} else {
+			setUserPassword(u.ID, newPwd)
+			markPasswordResetTokenUsed(token)
+			recordLoginSuccess(u.Email)
+			renderTemplate(w, r, "resetPassword", map[string]any{"Done": true})
+			return
+		}
+	}
+	renderTemplate(w, r, "resetPassword", data)
+}
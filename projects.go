@@ -0,0 +1,665 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Projects and tasks: a stamp can be booked to a project (and one of its
+// tasks) next to its activity. Like the activity, the project of an entry
+// holds until the user's next stamp; only work activities count towards
+// project hours and budgets.
+
+// Project is a client project with an optional budget and active window
+type Project struct {
+	ID          int
+	Name        string
+	Client      string
+	BudgetHours float64 // 0: no budget
+	ActiveFrom  string  // YYYY-MM-DD, empty: open
+	ActiveTo    string  // YYYY-MM-DD, empty: open
+	CostCenter  int     // 0: none, invoices fall back to the user's
+	Tasks       []Task
+}
+
+// Task belongs to one project; inactive tasks are hidden from stamping
+type Task struct {
+	ID        int
+	ProjectID int
+	Name      string
+	Active    bool
+}
+
+// Label is shown in pickers and reports
+func (p Project) Label() string {
+	if p.Client != "" {
+		return p.Client + " · " + p.Name
+	}
+	return p.Name
+}
+
+// ActiveOn reports whether stamps may be booked to the project on t's day
+func (p Project) ActiveOn(t time.Time) bool {
+	day := t.Format("2006-01-02")
+	return (p.ActiveFrom == "" || day >= p.ActiveFrom) && (p.ActiveTo == "" || day <= p.ActiveTo)
+}
+
+var errProjectInUse = errors.New("project has booked entries")
+
+// refValue stores an optional reference, 0 as NULL
+func refValue(id int) any {
+	if id <= 0 {
+		return nil
+	}
+	return id
+}
+
+func dateValue(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+const projectColumns = "id, name, COALESCE(client, ''), COALESCE(budget_hours, 0), COALESCE(active_from, ''), COALESCE(active_to, ''), COALESCE(cost_center_id, 0)"
+
+func scanProject(scan func(...any) error) (Project, error) {
+	var p Project
+	err := scan(&p.ID, &p.Name, &p.Client, &p.BudgetHours, &p.ActiveFrom, &p.ActiveTo, &p.CostCenter)
+	return p, err
+}
+
+// getProjects returns all projects with all their tasks
+func getProjects() []Project {
+	db := getDB()
+	defer db.Close()
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY client, name", projectColumns, tbl("projects")))
+	if err != nil {
+		log.Printf("getProjects query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var list []Project
+	for rows.Next() {
+		p, err := scanProject(rows.Scan)
+		if err != nil {
+			log.Printf("getProjects scan failed: %v", err)
+			continue
+		}
+		list = append(list, p)
+	}
+	tasks := getTasks(db, 0)
+	for i := range list {
+		for _, t := range tasks {
+			if t.ProjectID == list[i].ID {
+				list[i].Tasks = append(list[i].Tasks, t)
+			}
+		}
+	}
+	return list
+}
+
+func getProject(id string) Project {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id=@id", projectColumns, tbl("projects"))
+	p, err := scanProject(db.QueryRow(query, sql.Named("id", id)).Scan)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("getProject failed: %v", err)
+		}
+		return Project{}
+	}
+	p.Tasks = getTasks(db, p.ID)
+	return p
+}
+
+// getTasks lists the tasks of a project, of all projects for 0
+func getTasks(db *sql.DB, projectID int) []Task {
+	query := fmt.Sprintf("SELECT id, project_id, name, COALESCE(active, 1) FROM %s", tbl("tasks"))
+	var args []any
+	if projectID != 0 {
+		query += " WHERE project_id=@pid"
+		args = append(args, sql.Named("pid", projectID))
+	}
+	rows, err := db.Query(query+" ORDER BY name", args...)
+	if err != nil {
+		log.Printf("getTasks query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var list []Task
+	for rows.Next() {
+		var t Task
+		if err := rows.Scan(&t.ID, &t.ProjectID, &t.Name, &t.Active); err != nil {
+			log.Printf("getTasks scan failed: %v", err)
+			continue
+		}
+		list = append(list, t)
+	}
+	return list
+}
+
+func getTask(id int) Task {
+	db := getDB()
+	defer db.Close()
+	var t Task
+	query := fmt.Sprintf("SELECT id, project_id, name, COALESCE(active, 1) FROM %s WHERE id=@id", tbl("tasks"))
+	if err := db.QueryRow(query, sql.Named("id", id)).Scan(&t.ID, &t.ProjectID, &t.Name, &t.Active); err != nil {
+		return Task{}
+	}
+	return t
+}
+
+// stampProjects are the projects open for stamping at now, with their active tasks
+func stampProjects(now time.Time) []Project {
+	var list []Project
+	for _, p := range getProjects() {
+		if !p.ActiveOn(now) {
+			continue
+		}
+		var tasks []Task
+		for _, t := range p.Tasks {
+			if t.Active {
+				tasks = append(tasks, t)
+			}
+		}
+		p.Tasks = tasks
+		list = append(list, p)
+	}
+	return list
+}
+
+func createProject(p Project) (int64, error) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`INSERT INTO %s (name, client, budget_hours, active_from, active_to, cost_center_id)
+	                      VALUES (@name, @client, @budget, @from, @to, @cc)`, tbl("projects"))
+	id, err := insertID(db, query, sql.Named("name", p.Name), sql.Named("client", p.Client), sql.Named("budget", p.BudgetHours),
+		sql.Named("from", dateValue(p.ActiveFrom)), sql.Named("to", dateValue(p.ActiveTo)), sql.Named("cc", refValue(p.CostCenter)))
+	if err != nil {
+		log.Printf("createProject failed: %v", err)
+	}
+	return id, err
+}
+
+func updateProject(p Project) error {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`UPDATE %s SET name=@name, client=@client, budget_hours=@budget, active_from=@from, active_to=@to,
+	                      cost_center_id=@cc WHERE id=@id`, tbl("projects"))
+	_, err := db.Exec(query, sql.Named("name", p.Name), sql.Named("client", p.Client), sql.Named("budget", p.BudgetHours),
+		sql.Named("from", dateValue(p.ActiveFrom)), sql.Named("to", dateValue(p.ActiveTo)), sql.Named("cc", refValue(p.CostCenter)),
+		sql.Named("id", p.ID))
+	if err != nil {
+		log.Printf("updateProject failed: %v", err)
+	}
+	return err
+}
+
+// deleteProject removes a project and its tasks unless entries are booked to it
+func deleteProject(id string) error {
+	db := getDB()
+	defer db.Close()
+	var n int
+	if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE project_id=@id", tbl("entries")), sql.Named("id", id)).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return errProjectInUse
+	}
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE project_id=@id", tbl("tasks")), sql.Named("id", id)); err != nil {
+		log.Printf("deleteProject tasks failed: %v", err)
+		return err
+	}
+	_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("projects")), sql.Named("id", id))
+	if err != nil {
+		log.Printf("deleteProject failed: %v", err)
+	}
+	return err
+}
+
+func addTask(projectID int, name string) error {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("INSERT INTO %s (project_id, name, active) VALUES (@pid, @name, 1)", tbl("tasks"))
+	_, err := db.Exec(query, sql.Named("pid", projectID), sql.Named("name", name))
+	if err != nil {
+		log.Printf("addTask failed: %v", err)
+	}
+	return err
+}
+
+// setTaskActive closes or reopens a task; booked entries keep it
+func setTaskActive(id, projectID string, active bool) {
+	db := getDB()
+	defer db.Close()
+	v := 0
+	if active {
+		v = 1
+	}
+	query := fmt.Sprintf("UPDATE %s SET active=@v WHERE id=@id AND project_id=@pid", tbl("tasks"))
+	if _, err := db.Exec(query, sql.Named("v", v), sql.Named("id", id), sql.Named("pid", projectID)); err != nil {
+		log.Printf("setTaskActive failed: %v", err)
+	}
+}
+
+// parseProjectChoice reads a picker value: "12" is project 12, "12:5" its task 5
+func parseProjectChoice(s string) (projectID, taskID int) {
+	p, t, _ := strings.Cut(strings.TrimSpace(s), ":")
+	return atoiDefault(p, 0), atoiDefault(t, 0)
+}
+
+// stampDetailsFromForm reads comment and project picker of the stamping forms
+func stampDetailsFromForm(r *http.Request) StampDetails {
+	d := StampDetails{Comment: r.FormValue("comment")}
+	d.ProjectID, d.TaskID = parseProjectChoice(r.FormValue("project"))
+	return d
+}
+
+// checkStampProject validates the project and task of a stamp at at; a task
+// alone selects its project
+func checkStampProject(d *StampDetails, at time.Time) error {
+	if d.TaskID != 0 {
+		t := getTask(d.TaskID)
+		if t.ID == 0 || !t.Active || (d.ProjectID != 0 && d.ProjectID != t.ProjectID) {
+			return &StampRejection{Code: "invalid_project", Message: "Unbekannte oder abgeschlossene Aufgabe."}
+		}
+		d.ProjectID = t.ProjectID
+	}
+	if d.ProjectID == 0 {
+		return nil
+	}
+	p := getProject(strconv.Itoa(d.ProjectID))
+	if p.ID == 0 {
+		return &StampRejection{Code: "invalid_project", Message: "Unbekanntes Projekt."}
+	}
+	if !p.ActiveOn(at) {
+		return &StampRejection{Code: "invalid_project",
+			Message: fmt.Sprintf("Projekt %s ist am %s nicht aktiv.", p.Label(), at.Format("02.01.2006"))}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+// Reports
+//---------------------------------------------------------------------
+
+// ProjectHours are the work hours of one user on one project in one ISO week
+type ProjectHours struct {
+	ProjectID int     `json:"projectId"`
+	Project   string  `json:"project"`
+	Client    string  `json:"client"`
+	UserID    int     `json:"userId"`
+	UserName  string  `json:"userName"`
+	Week      string  `json:"week"` // e.g. 2026-W42
+	Hours     float64 `json:"hours"`
+}
+
+// isoWeek formats the ISO week of t
+func isoWeek(t time.Time) string {
+	y, w := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", y, w)
+}
+
+// projectStamp is a stamp booked to a project as the reports see it
+type projectStamp struct {
+	UserID     int
+	UserName   string
+	At         time.Time
+	ActivityID int
+	Activity   string
+	Work       bool
+	Billable   bool
+	ProjectID  int
+	Project    string
+	Client     string
+	CostCenter string // the project's, else the user's
+}
+
+// walkProjectSpans calls fn for every stamp between from and to that is
+// booked to a project, with the hours it lasts: until the user's next stamp,
+// at most until to or now. Stamps without project only end the previous one.
+func walkProjectSpans(from, to time.Time, fn func(s projectStamp, hours float64)) {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf(`
+		SELECT e.user_id, u.name, e.date, e.type_id, t.status, t.work, COALESCE(t.billable, 0),
+		       COALESCE(e.project_id, 0), COALESCE(p.name, ''), COALESCE(p.client, ''),
+		       COALESCE(pc.code, uc.code, '')
+		FROM %s e
+		JOIN %s u ON u.id = e.user_id
+		JOIN %s t ON t.id = e.type_id
+		LEFT JOIN %s p ON p.id = e.project_id
+		LEFT JOIN %s pc ON pc.id = p.cost_center_id
+		LEFT JOIN %s uc ON uc.id = u.cost_center_id
+		WHERE e.date >= @from AND e.date < @to
+		ORDER BY e.user_id, e.date`, tbl("entries"), tbl("users"), tbl("type"), tbl("projects"), tbl("cost_centers"), tbl("cost_centers"))
+	rows, err := db.Query(query, sql.Named("from", from), sql.Named("to", to))
+	if err != nil {
+		log.Printf("walkProjectSpans query failed: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var stamps []projectStamp
+	for rows.Next() {
+		var s projectStamp
+		var work, billable int
+		if err := rows.Scan(&s.UserID, &s.UserName, &s.At, &s.ActivityID, &s.Activity, &work, &billable,
+			&s.ProjectID, &s.Project, &s.Client, &s.CostCenter); err != nil {
+			log.Printf("walkProjectSpans scan failed: %v", err)
+			continue
+		}
+		s.Work, s.Billable = work == 1, billable == 1
+		stamps = append(stamps, s)
+	}
+
+	limit := to
+	if now := time.Now(); now.Before(limit) {
+		limit = now
+	}
+	for i, s := range stamps {
+		if s.ProjectID == 0 {
+			continue
+		}
+		end := limit
+		if i+1 < len(stamps) && stamps[i+1].UserID == s.UserID {
+			end = stamps[i+1].At
+		}
+		if end.After(s.At) {
+			fn(s, end.Sub(s.At).Hours())
+		}
+	}
+}
+
+// projectHours sums work time booked to projects between from and to (0:
+// all projects). An entry counts in the week it started.
+func projectHours(from, to time.Time, projectID int) []ProjectHours {
+	type key struct {
+		project, user int
+		week          string
+	}
+	sums := map[key]*ProjectHours{}
+	var order []key
+	walkProjectSpans(from, to, func(s projectStamp, hours float64) {
+		if !s.Work || (projectID != 0 && s.ProjectID != projectID) {
+			return
+		}
+		k := key{s.ProjectID, s.UserID, isoWeek(s.At)}
+		if sums[k] == nil {
+			sums[k] = &ProjectHours{ProjectID: s.ProjectID, Project: s.Project, Client: s.Client,
+				UserID: s.UserID, UserName: s.UserName, Week: k.week}
+			order = append(order, k)
+		}
+		sums[k].Hours += hours
+	})
+
+	list := make([]ProjectHours, 0, len(order))
+	for _, k := range order {
+		list = append(list, *sums[k])
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		if a.Week != b.Week {
+			return a.Week < b.Week
+		}
+		return a.UserName < b.UserName
+	})
+	return list
+}
+
+// BurnDownWeek is one week of a project's budget burn-down
+type BurnDownWeek struct {
+	Week      string
+	Hours     float64
+	Total     float64 // booked up to and including this week
+	Remaining float64 // budget minus total, negative when over budget
+	Percent   float64 // total of budget, 0 without budget
+}
+
+// projectBurnDown accumulates a project's hours per week against its budget
+func projectBurnDown(p Project, hours []ProjectHours) []BurnDownWeek {
+	perWeek := map[string]float64{}
+	var weeks []string
+	for _, h := range hours {
+		if h.ProjectID != p.ID {
+			continue
+		}
+		if _, ok := perWeek[h.Week]; !ok {
+			weeks = append(weeks, h.Week)
+		}
+		perWeek[h.Week] += h.Hours
+	}
+	sort.Strings(weeks)
+	list := make([]BurnDownWeek, 0, len(weeks))
+	total := 0.0
+	for _, w := range weeks {
+		total += perWeek[w]
+		b := BurnDownWeek{Week: w, Hours: perWeek[w], Total: total, Remaining: p.BudgetHours - total}
+		if p.BudgetHours > 0 {
+			b.Percent = 100 * total / p.BudgetHours
+		}
+		list = append(list, b)
+	}
+	return list
+}
+
+// ProjectWeekRow is one week of the per-user table of a project
+type ProjectWeekRow struct {
+	Week  string
+	Hours []float64 // in the order of the user columns
+	Total float64
+}
+
+// pivotProjectHours turns the hours of one project into weeks × users
+func pivotProjectHours(hours []ProjectHours) (users []string, rows []ProjectWeekRow) {
+	col := map[string]int{}
+	for _, h := range hours {
+		if _, ok := col[h.UserName]; !ok {
+			col[h.UserName] = len(users)
+			users = append(users, h.UserName)
+		}
+	}
+	sort.Strings(users)
+	for i, u := range users {
+		col[u] = i
+	}
+	index := map[string]int{}
+	for _, h := range hours {
+		i, ok := index[h.Week]
+		if !ok {
+			i = len(rows)
+			index[h.Week] = i
+			rows = append(rows, ProjectWeekRow{Week: h.Week, Hours: make([]float64, len(users))})
+		}
+		rows[i].Hours[col[h.UserName]] += h.Hours
+		rows[i].Total += h.Hours
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Week < rows[j].Week })
+	return users, rows
+}
+
+// bookedHours sums the hours per project
+func bookedHours(hours []ProjectHours) map[int]float64 {
+	sums := map[int]float64{}
+	for _, h := range hours {
+		sums[h.ProjectID] += h.Hours
+	}
+	return sums
+}
+
+//---------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------
+
+// projectFromForm reads the project form; dates must be YYYY-MM-DD
+func projectFromForm(r *http.Request) (Project, error) {
+	p := Project{
+		ID:         atoiDefault(r.FormValue("id"), 0),
+		Name:       strings.TrimSpace(r.FormValue("name")),
+		Client:     strings.TrimSpace(r.FormValue("client")),
+		ActiveFrom: strings.TrimSpace(r.FormValue("active_from")),
+		ActiveTo:   strings.TrimSpace(r.FormValue("active_to")),
+		CostCenter: atoiDefault(r.FormValue("cost_center_id"), 0),
+	}
+	if p.Name == "" {
+		return p, errors.New("Name fehlt.")
+	}
+	if b := strings.TrimSpace(r.FormValue("budget_hours")); b != "" {
+		v, err := strconv.ParseFloat(strings.ReplaceAll(b, ",", "."), 64)
+		if err != nil || v < 0 {
+			return p, errors.New("Budget muss eine positive Stundenzahl sein.")
+		}
+		p.BudgetHours = v
+	}
+	for _, d := range []string{p.ActiveFrom, p.ActiveTo} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			return p, errors.New("Datum im Format JJJJ-MM-TT angeben.")
+		}
+	}
+	if p.ActiveFrom != "" && p.ActiveTo != "" && p.ActiveTo < p.ActiveFrom {
+		return p, errors.New("Das Ende liegt vor dem Beginn.")
+	}
+	return p, nil
+}
+
+// projectsHandler lists projects with their booked hours and adds new ones
+func projectsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		p, err := projectFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := createProject(p)
+		if err != nil {
+			http.Error(w, "Projekt konnte nicht angelegt werden.", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/admin/project?id=%d", id), http.StatusSeeOther)
+		return
+	}
+	projects := getProjects()
+	booked := bookedHours(projectHours(time.Time{}, time.Now().Add(time.Minute), 0))
+	type row struct {
+		Project
+		Booked  float64
+		Percent float64
+	}
+	rows := make([]row, 0, len(projects))
+	for _, p := range projects {
+		rw := row{Project: p, Booked: booked[p.ID]}
+		if p.BudgetHours > 0 {
+			rw.Percent = 100 * rw.Booked / p.BudgetHours
+		}
+		rows = append(rows, rw)
+	}
+	renderTemplate(w, r, "projects", map[string]any{"Projects": rows, "Today": time.Now(), "CostCenters": getCostCenters()})
+}
+
+// projectHandler edits one project and its tasks and shows its reports
+func projectHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	p := getProject(id)
+	if p.ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "add_task":
+			if name := strings.TrimSpace(r.FormValue("task")); name != "" {
+				addTask(p.ID, name)
+			}
+		case "close_task", "open_task":
+			setTaskActive(r.FormValue("task_id"), id, r.FormValue("action") == "open_task")
+		case "delete":
+			if err := deleteProject(id); err != nil {
+				if errors.Is(err, errProjectInUse) {
+					http.Error(w, "Auf das Projekt sind bereits Zeiten gebucht; stattdessen das Ende des Zeitraums setzen.", http.StatusConflict)
+					return
+				}
+				http.Error(w, "Löschen fehlgeschlagen.", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/admin/projects", http.StatusSeeOther)
+			return
+		default:
+			updated, err := projectFromForm(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			updated.ID = p.ID
+			if err := updateProject(updated); err != nil {
+				http.Error(w, "Speichern fehlgeschlagen.", http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Redirect(w, r, "/admin/project?id="+id, http.StatusSeeOther)
+		return
+	}
+
+	hours := projectHours(time.Time{}, time.Now().Add(time.Minute), p.ID)
+	burn := projectBurnDown(p, hours)
+	total := 0.0
+	if len(burn) > 0 {
+		total = burn[len(burn)-1].Total
+	}
+	users, weeks := pivotProjectHours(hours)
+	renderTemplate(w, r, "project", map[string]any{
+		"Project":  p,
+		"Users":    users,
+		"Weeks":    weeks,
+		"BurnDown": burn,
+		"Total":    total,
+
+		"CostCenters": getCostCenters(),
+	})
+}
+
+// downloadProjectHours exports hours per project, user and week as CSV or JSON;
+// from/to are dates (default: the last 12 weeks), project an optional id
+func downloadProjectHours(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.AddDate(0, 0, -7*12)
+	if t, err := time.ParseInLocation("2006-01-02", q.Get("from"), time.Local); err == nil {
+		from = t
+	}
+	if t, err := time.ParseInLocation("2006-01-02", q.Get("to"), time.Local); err == nil {
+		to = t.AddDate(0, 0, 1) // inclusive
+	}
+	hours := projectHours(from, to, atoiDefault(q.Get("project"), 0))
+	timestamp := time.Now().Format("2006-01-02_15-04-05")
+
+	switch q.Get("format") {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=project_hours_%s.json", timestamp))
+		json.NewEncoder(w).Encode(hours)
+	default: // csv
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=project_hours_%s.csv", timestamp))
+		enc := csv.NewWriter(w)
+		_ = enc.Write([]string{"Week", "Client", "Project", "User", "Hours"})
+		for _, h := range hours {
+			enc.Write([]string{h.Week, h.Client, h.Project, h.UserName, strconv.FormatFloat(h.Hours, 'f', 2, 64)})
+		}
+		enc.Flush()
+	}
+}
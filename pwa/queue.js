@@ -0,0 +1,77 @@
+// Stamp queue of the offline terminal, shared by the page and the service
+// worker. Stamps and the terminal settings live in IndexedDB so both can
+// reach them and they survive reloads and power cuts.
+const StampQueue = (function () {
+  const DB = 'wtm-offline-terminal';
+
+  function open() {
+    return new Promise(function (resolve, reject) {
+      const req = indexedDB.open(DB, 1);
+      req.onupgradeneeded = function () {
+        req.result.createObjectStore('stamps', { keyPath: 'id' });
+        req.result.createObjectStore('settings');
+      };
+      req.onsuccess = function () { resolve(req.result); };
+      req.onerror = function () { reject(req.error); };
+    });
+  }
+
+  // run fn against one object store and resolve with the request's result
+  function withStore(name, mode, fn) {
+    return open().then(function (db) {
+      return new Promise(function (resolve, reject) {
+        const tx = db.transaction(name, mode);
+        const req = fn(tx.objectStore(name));
+        tx.oncomplete = function () { db.close(); resolve(req ? req.result : undefined); };
+        tx.onerror = function () { db.close(); reject(tx.error); };
+      });
+    });
+  }
+
+  function get(key) {
+    return withStore('settings', 'readonly', function (s) { return s.get(key); });
+  }
+
+  function set(key, value) {
+    return withStore('settings', 'readwrite', function (s) { return s.put(value, key); });
+  }
+
+  function add(stamp) {
+    return withStore('stamps', 'readwrite', function (s) { return s.put(stamp); });
+  }
+
+  function all() {
+    return withStore('stamps', 'readonly', function (s) { return s.getAll(); });
+  }
+
+  function remove(ids) {
+    return withStore('stamps', 'readwrite', function (s) {
+      ids.forEach(function (id) { s.delete(id); });
+      return null;
+    });
+  }
+
+  // sync sends all queued stamps. Stamps with a final result are removed;
+  // "failed" ones stay queued for the next attempt.
+  let running = null;
+  function sync() {
+    if (running) return running;
+    running = Promise.all([get('token'), get('deviceId'), all()]).then(function ([token, deviceId, stamps]) {
+      if (!token || !stamps.length) return { stamped: 0, rejected: 0, results: [] };
+      return fetch('/terminal/offline/sync', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify({ deviceId: deviceId, stamps: stamps })
+      }).then(function (r) {
+        if (!r.ok) throw new Error('sync failed: ' + r.status);
+        return r.json();
+      }).then(function (res) {
+        const done = res.results.filter(function (x) { return x.result !== 'failed'; }).map(function (x) { return x.id; });
+        return remove(done).then(function () { return set('lastSync', new Date().toISOString()); }).then(function () { return res; });
+      });
+    }).finally(function () { running = null; });
+    return running;
+  }
+
+  return { get: get, set: set, add: add, all: all, sync: sync };
+})();
@@ -0,0 +1,44 @@
+// Service worker of the offline terminal: keeps the app shell and the last
+// terminal configuration available offline and flushes the stamp queue
+// when the browser reports connectivity again (Background Sync).
+importScripts('queue.js');
+
+const CACHE = 'wtm-offline-terminal-v1';
+const SHELL = ['./', 'queue.js', 'manifest.webmanifest', 'icon.svg'];
+
+self.addEventListener('install', function (event) {
+  event.waitUntil(caches.open(CACHE).then(function (c) { return c.addAll(SHELL); }).then(function () { return self.skipWaiting(); }));
+});
+
+self.addEventListener('activate', function (event) {
+  event.waitUntil(caches.keys().then(function (keys) {
+    return Promise.all(keys.filter(function (k) { return k !== CACHE; }).map(function (k) { return caches.delete(k); }));
+  }).then(function () { return self.clients.claim(); }));
+});
+
+self.addEventListener('fetch', function (event) {
+  const url = new URL(event.request.url);
+  if (event.request.method !== 'GET' || url.origin !== location.origin) return;
+  // the API calls carry the terminal credential; the page keeps its own copy
+  if (url.pathname.endsWith('/sync') || url.pathname.endsWith('/config')) return;
+  // network first, so updates and fresh configuration win when online
+  event.respondWith(fetch(event.request).then(function (res) {
+    if (res.ok) {
+      const copy = res.clone();
+      caches.open(CACHE).then(function (c) { c.put(event.request, copy); });
+    }
+    return res;
+  }).catch(function () {
+    return caches.match(event.request, { ignoreSearch: true });
+  }));
+});
+
+self.addEventListener('sync', function (event) {
+  if (event.tag === 'stamps') {
+    event.waitUntil(StampQueue.sync().then(function () {
+      return self.clients.matchAll().then(function (clients) {
+        clients.forEach(function (c) { c.postMessage('synced'); });
+      });
+    }));
+  }
+});
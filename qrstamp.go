@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Rotating QR codes against buddy punching. A paired terminal shows a QR
+// code that changes every qrStampStep (/terminal/qr). It links to
+// /qr/stamp with the terminal, the time step and an HMAC over both with the
+// terminal's secret, which lives in the tenant database. A logged-in
+// employee scans it with the phone; a fresh code lets that session stamp
+// itself in or out once, and the entry records the terminal. A photo of the
+// code is useless a few seconds later.
+
+const (
+	qrStampStep    = 15 * time.Second
+	qrStampSkew    = 1                // steps: the previous code is still accepted
+	qrStampConfirm = 60 * time.Second // time to tap the button after scanning
+	qrStampShowFor = 10 * time.Second // the display confirms stamps this long
+)
+
+// qrStampSecret returns the terminal's QR secret, creating it on first use
+func qrStampSecret(terminalID int) []byte {
+	db := getDB()
+	defer db.Close()
+
+	var secret string
+	query := fmt.Sprintf("SELECT COALESCE(qr_secret, '') FROM %s WHERE id=@id", tbl("terminals"))
+	if err := db.QueryRow(query, sql.Named("id", terminalID)).Scan(&secret); err != nil {
+		log.Printf("qrStampSecret failed: %v", err)
+		return nil
+	}
+	if secret == "" {
+		// concurrent displays of one terminal must end up with the same secret
+		update := fmt.Sprintf("UPDATE %s SET qr_secret=@secret WHERE id=@id AND qr_secret IS NULL", tbl("terminals"))
+		if _, err := db.Exec(update, sql.Named("secret", newTOTPSecret()), sql.Named("id", terminalID)); err != nil {
+			log.Printf("qrStampSecret update failed: %v", err)
+			return nil
+		}
+		if err := db.QueryRow(query, sql.Named("id", terminalID)).Scan(&secret); err != nil {
+			log.Printf("qrStampSecret failed: %v", err)
+			return nil
+		}
+	}
+	b, err := b32NoPad.DecodeString(secret)
+	if err != nil {
+		log.Printf("qrStampSecret decode failed: %v", err)
+		return nil
+	}
+	return b
+}
+
+// qrStampCode is the code of one terminal and time step
+func qrStampCode(secret []byte, terminalID int, step int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d:%d", terminalID, step)
+	return b32NoPad.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// qrStampURL is what the terminal's QR code currently encodes
+func qrStampURL(r *http.Request, terminalID int, now time.Time) (string, time.Duration) {
+	step := now.Unix() / int64(qrStampStep.Seconds())
+	q := url.Values{}
+	q.Set("t", strconv.Itoa(terminalID))
+	q.Set("s", strconv.FormatInt(step, 10))
+	q.Set("c", qrStampCode(qrStampSecret(terminalID), terminalID, step))
+	next := time.Unix((step+1)*int64(qrStampStep.Seconds()), 0)
+	return baseURL(r) + "/qr/stamp?" + q.Encode(), next.Sub(now)
+}
+
+// verifyQRStamp checks a scanned code and returns its terminal
+func verifyQRStamp(terminalID, step, code string, now time.Time) (Terminal, error) {
+	id, _ := strconv.Atoi(terminalID)
+	s, err := strconv.ParseInt(step, 10, 64)
+	if id == 0 || err != nil {
+		return Terminal{}, errors.New("Kein gültiger Stempel-Code.")
+	}
+	cur := now.Unix() / int64(qrStampStep.Seconds())
+	if s > cur || s < cur-qrStampSkew {
+		return Terminal{}, errors.New("Der QR-Code ist abgelaufen, bitte den aktuellen Code am Terminal scannen.")
+	}
+	secret := qrStampSecret(id)
+	if secret == nil || !hmac.Equal([]byte(qrStampCode(secret, id, s)), []byte(code)) {
+		return Terminal{}, errors.New("Kein gültiger Stempel-Code.")
+	}
+	t, ok := getTerminal(id)
+	if !ok || t.Revoked() || !t.Paired() {
+		return Terminal{}, errors.New("Dieses Terminal ist nicht mehr registriert.")
+	}
+	return t, nil
+}
+
+func getTerminal(id int) (Terminal, bool) {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id=@id", terminalColumns, tbl("terminals"))
+	t, err := scanTerminal(db.QueryRow(query, sql.Named("id", id)).Scan)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("getTerminal failed: %v", err)
+		}
+		return Terminal{}, false
+	}
+	return t, true
+}
+
+// qrLastStamp is the latest stamp recorded on a terminal, for the display
+type qrLastStamp struct {
+	Name     string `json:"name"`
+	Activity string `json:"activity"`
+	Work     bool   `json:"work"`
+	At       string `json:"at"` // RFC 3339
+}
+
+func terminalLastStamp(terminalID int, since time.Time) *qrLastStamp {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf(`SELECT u.name, t.status, t.work, e.date FROM %s e
+		JOIN %s u ON u.id = e.user_id JOIN %s t ON t.id = e.type_id
+		WHERE e.terminal_id=@tid AND e.date >= @since ORDER BY e.id DESC`, tbl("entries"), tbl("users"), tbl("type"))
+	var s qrLastStamp
+	var work int
+	var at time.Time
+	if err := db.QueryRow(query, sql.Named("tid", terminalID), sql.Named("since", since)).Scan(&s.Name, &s.Activity, &work, &at); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("terminalLastStamp failed: %v", err)
+		}
+		return nil
+	}
+	s.Work, s.At = work == 1, at.Format(time.RFC3339)
+	return &s
+}
+
+// qrTerminalHandler is the display mode of a paired terminal. The page
+// polls ?format=json for the next code and the latest stamp.
+func qrTerminalHandler(w http.ResponseWriter, r *http.Request) {
+	t := stampTerminal(r)
+	if t.ID == 0 {
+		renderTemplate(w, r, "qrTerminal", map[string]any{"Error": "Der QR-Modus läuft nur auf gekoppelten Terminals, die Codes gehören zum Standort des Terminals."})
+		return
+	}
+	now := time.Now()
+	link, valid := qrStampURL(r, t.ID, now)
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"url":       link,
+			"image":     qrDataURL(link, 320),
+			"expiresIn": valid.Milliseconds(),
+			"last":      terminalLastStamp(t.ID, now.Add(-qrStampShowFor)),
+		})
+		return
+	}
+	renderTemplate(w, r, "qrTerminal", map[string]any{
+		"Terminal":  t,
+		"URL":       link,
+		"Image":     qrDataURL(link, 320),
+		"ExpiresIn": valid.Milliseconds(),
+	})
+}
+
+// qrStampHandler: GET validates a scanned code and offers the stamp button,
+// POST stamps the session's user on the terminal the code came from
+func qrStampHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := currentDBUserFromSession(r)
+	if !ok || u.ID == 0 {
+		renderTemplate(w, r, "qrStamp", map[string]any{"Error": "Bitte zuerst anmelden und danach den Code am Terminal erneut scannen.", "Login": true})
+		return
+	}
+	session, _ := store.Get(r, "session")
+	now := time.Now()
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		t, err := verifyQRStamp(q.Get("t"), q.Get("s"), q.Get("c"), now)
+		if err != nil {
+			renderTemplate(w, r, "qrStamp", map[string]any{"Error": err.Error()})
+			return
+		}
+		session.Values["qr_stamp_terminal"] = t.ID
+		session.Values["qr_stamp_until"] = now.Add(qrStampConfirm).Unix()
+		session.Save(r, w)
+		work, off := toggleActivities(u)
+		next := work
+		if isAtWork(u.ID, now) {
+			next = off
+		}
+		renderTemplate(w, r, "qrStamp", map[string]any{"User": u, "Terminal": t, "Next": next})
+	case http.MethodPost:
+		// the confirmation from GET can be used once, by this session only
+		tid, _ := session.Values["qr_stamp_terminal"].(int)
+		until, _ := session.Values["qr_stamp_until"].(int64)
+		delete(session.Values, "qr_stamp_terminal")
+		delete(session.Values, "qr_stamp_until")
+		session.Save(r, w)
+		if tid == 0 || now.Unix() > until {
+			renderTemplate(w, r, "qrStamp", map[string]any{"Error": "Die Bestätigung ist abgelaufen, bitte den aktuellen Code am Terminal scannen."})
+			return
+		}
+		t, ok := getTerminal(tid)
+		if !ok || t.Revoked() {
+			renderTemplate(w, r, "qrStamp", map[string]any{"Error": "Dieses Terminal ist nicht mehr registriert."})
+			return
+		}
+		res, err := toggleStamp(u, now, t.ID)
+		var rej *StampRejection
+		switch {
+		case errors.As(err, &rej):
+			renderTemplate(w, r, "qrStamp", map[string]any{"Error": rej.Message, "Terminal": t})
+		case err != nil:
+			log.Printf("qr stamp for %s failed: %v", u.Name, err)
+			renderTemplate(w, r, "qrStamp", map[string]any{"Error": "Stempeln fehlgeschlagen.", "Terminal": t})
+		default:
+			renderTemplate(w, r, "qrStamp", map[string]any{"User": u, "Terminal": t, "Result": res})
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Card reader bridge: `workingtime reader` reads card UIDs from a serial
+// reader, a keyboard-emulating (HID) reader or a file/pipe, maps them to
+// users.stampkey and stamps with toggle semantics. Scans are written to a
+// local queue first and delivered either to a paired terminal's
+// /terminal/offline/sync endpoint or, with -direct, straight into the
+// database, so nothing is lost while the server is unreachable.
+
+const (
+	readerFlushEvery  = 15 * time.Second
+	readerHTTPTimeout = 10 * time.Second
+)
+
+// readerCommand reports whether the binary was started as `reader`; the
+// reader does not own the schema, so init skips creating it
+func readerCommand() bool {
+	return len(os.Args) > 1 && os.Args[1] == "reader"
+}
+
+// cardSource delivers raw card reads until it is exhausted or fails
+type cardSource func(out chan<- string) error
+
+// stampSink delivers queued stamps and returns the ids that are done with
+// (stamped or finally rejected); the rest stays queued
+type stampSink func(stamps []OfflineStamp) ([]string, error)
+
+func readerMain(args []string) int {
+	fs := flag.NewFlagSet("reader", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: workingtime reader [-server URL -token T | -direct] (-serial DEV | -input DEV | -file PATH)")
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", "", "base URL of the WorkingTime server, e.g. https://wtm.example.com")
+	token := fs.String("token", os.Getenv("WTM_TERMINAL_TOKEN"), "terminal credential (default $WTM_TERMINAL_TOKEN or the -credential file)")
+	pair := fs.String("pair", "", "redeem a pairing code from Admin → Terminals and store the credential")
+	credential := fs.String("credential", "reader-token", "file holding the terminal credential")
+	direct := fs.Bool("direct", false, "stamp directly into the database (DB_BACKEND/SQLITE_PATH/MSSQL_* as for the server)")
+	tenant := fs.String("tenant", "localhost", "tenant host for -direct with SQLite")
+	queuePath := fs.String("queue", "reader-queue.json", "file buffering scans until they are delivered")
+	device := fs.String("device", "", "device id reported to the server (default hostname)")
+	serial := fs.String("serial", "", "serial reader device, e.g. /dev/ttyUSB0")
+	baud := fs.Int("baud", 9600, "baud rate of the serial reader")
+	input := fs.String("input", "", "keyboard-emulating reader as input event device, e.g. /dev/input/by-id/...-event-kbd")
+	grab := fs.Bool("grab", true, "with -input: take the device exclusively so scans do not end up as keystrokes")
+	file := fs.String("file", "", "fake reader: one UID per line from a file, named pipe or - for stdin")
+	repeat := fs.Duration("repeat", 3*time.Second, "ignore the same card again within this time")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *device == "" {
+		*device, _ = os.Hostname()
+	}
+
+	if *pair != "" {
+		if *server == "" {
+			log.Printf("reader: -pair needs -server")
+			return 2
+		}
+		if err := pairReader(*server, *pair, *credential); err != nil {
+			log.Printf("reader: pairing failed: %v", err)
+			return 1
+		}
+		log.Printf("reader: paired, credential stored in %s", *credential)
+		if *serial == "" && *input == "" && *file == "" {
+			return 0
+		}
+	}
+
+	var src cardSource
+	switch {
+	case *serial != "":
+		src = serialSource(*serial, *baud)
+	case *input != "":
+		src = inputSource(*input, *grab)
+	case *file != "":
+		src = fileSource(*file)
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	var sink stampSink
+	switch {
+	case *direct:
+		if dbBackend == "sqlite" {
+			SetRequestHost(*tenant)
+			EnsureSchemaCurrent()
+		}
+		sink = directSink
+	case *server != "":
+		if *token == "" {
+			b, err := os.ReadFile(*credential)
+			if err != nil {
+				log.Printf("reader: no terminal credential, pair first with -pair CODE: %v", err)
+				return 2
+			}
+			*token = strings.TrimSpace(string(b))
+		}
+		sink = serverSink(strings.TrimRight(*server, "/"), *token, *device)
+	default:
+		log.Printf("reader: either -server or -direct is required")
+		return 2
+	}
+
+	q, err := loadReaderQueue(*queuePath)
+	if err != nil {
+		log.Printf("reader: %v", err)
+		return 1
+	}
+	if n := len(q.Stamps); n > 0 {
+		log.Printf("reader: %d buffered scans from an earlier run", n)
+	}
+	return runReader(src, sink, q, *repeat)
+}
+
+// runReader queues every card read and delivers the queue after each scan
+// and periodically. Delivery runs on this goroutine, which -direct relies on
+// for its tenant binding.
+func runReader(src cardSource, sink stampSink, q *readerQueue, repeat time.Duration) int {
+	codes := make(chan string)
+	done := make(chan error, 1)
+	go func() { done <- src(codes) }()
+
+	flush := func() {
+		if len(q.Stamps) == 0 {
+			return
+		}
+		ids, err := sink(q.Stamps)
+		if err != nil {
+			log.Printf("reader: delivery failed, %d scans stay buffered: %v", len(q.Stamps), err)
+		}
+		if err := q.remove(ids); err != nil {
+			log.Printf("reader: %v", err)
+		}
+	}
+
+	tick := time.NewTicker(readerFlushEvery)
+	defer tick.Stop()
+	lastUID, lastAt := "", time.Time{}
+	for {
+		select {
+		case raw := <-codes:
+			uid := normalizeCardUID(raw)
+			if uid == "" {
+				continue
+			}
+			now := time.Now()
+			if uid == lastUID && now.Sub(lastAt) < repeat {
+				continue
+			}
+			lastUID, lastAt = uid, now
+			s := OfflineStamp{
+				ID:   "rd-" + strconv.FormatInt(now.UnixNano(), 36),
+				Code: uid,
+				At:   now.Format(time.RFC3339Nano),
+			}
+			if err := q.add(s); err != nil {
+				log.Printf("reader: scan of %s not buffered: %v", uid, err)
+				continue
+			}
+			flush()
+		case <-tick.C:
+			flush()
+		case err := <-done:
+			flush()
+			if err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("reader: %v", err)
+				return 1
+			}
+			if n := len(q.Stamps); n > 0 {
+				log.Printf("reader: input ended, %d scans stay buffered", n)
+			}
+			return 0
+		}
+	}
+}
+
+// normalizeCardUID turns reader output like "UID: 04 a3 1f 22",
+// "Card ID 04:A3:1F:22" or "04a31f22" into the stampkey form "04A31F22"
+func normalizeCardUID(raw string) string {
+	u := strings.ToUpper(strings.TrimSpace(raw))
+	for _, label := range []string{"CARD ID", "UID"} {
+		u = strings.TrimPrefix(u, label)
+	}
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, u)
+}
+
+// fileSource is the fake reader: one UID per line. A regular file or stdin
+// ends at EOF, a named pipe is reopened so writers can come and go.
+func fileSource(path string) cardSource {
+	return func(out chan<- string) error {
+		if path == "-" {
+			return readLines(os.Stdin, out)
+		}
+		for {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			info, _ := f.Stat()
+			err = readLines(f, out)
+			f.Close()
+			if info == nil || info.Mode()&os.ModeNamedPipe == 0 || !errors.Is(err, io.EOF) {
+				return err
+			}
+		}
+	}
+}
+
+// readLines sends every non-empty line and returns io.EOF at the end
+func readLines(r io.Reader, out chan<- string) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			out <- line
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// readerQueue is the local buffer, a JSON file rewritten on every change
+type readerQueue struct {
+	path   string
+	Stamps []OfflineStamp `json:"stamps"`
+}
+
+func loadReaderQueue(path string) (*readerQueue, error) {
+	q := &readerQueue{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read queue %s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, q); err != nil {
+		return nil, fmt.Errorf("parse queue %s: %w", path, err)
+	}
+	return q, nil
+}
+
+func (q *readerQueue) add(s OfflineStamp) error {
+	q.Stamps = append(q.Stamps, s)
+	return q.save()
+}
+
+func (q *readerQueue) remove(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	gone := map[string]bool{}
+	for _, id := range ids {
+		gone[id] = true
+	}
+	kept := q.Stamps[:0]
+	for _, s := range q.Stamps {
+		if !gone[s.ID] {
+			kept = append(kept, s)
+		}
+	}
+	q.Stamps = kept
+	return q.save()
+}
+
+// save writes to a temporary file and renames it, so a power cut never
+// leaves a half-written queue
+func (q *readerQueue) save() error {
+	b, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), ".reader-queue-*")
+	if err != nil {
+		return fmt.Errorf("save queue: %w", err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("save queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("save queue: %w", err)
+	}
+	return os.Rename(tmp.Name(), q.path)
+}
+
+// pairReader redeems a pairing code like the offline terminal does and
+// stores the credential readable only by the current user
+func pairReader(server, code, credential string) error {
+	body, _ := json.Marshal(map[string]string{"code": code})
+	client := &http.Client{Timeout: readerHTTPTimeout}
+	resp, err := client.Post(strings.TrimRight(server, "/")+"/terminal/pair", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Token    string       `json:"token"`
+		Terminal string       `json:"terminal"`
+		Error    apiErrorBody `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, apiMaxBody)).Decode(&res); err != nil && resp.StatusCode == http.StatusOK {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || res.Token == "" {
+		return fmt.Errorf("%s %s", resp.Status, res.Error.Message)
+	}
+	log.Printf("reader: paired as terminal %q", res.Terminal)
+	return os.WriteFile(credential, []byte(res.Token+"\n"), 0o600)
+}
+
+// serverSink posts the queue to the offline sync endpoint, which toggles
+// every stamp without an activity at its original time
+func serverSink(server, token, device string) stampSink {
+	client := &http.Client{Timeout: readerHTTPTimeout}
+	return func(stamps []OfflineStamp) ([]string, error) {
+		if len(stamps) > terminalSyncMax {
+			stamps = stamps[:terminalSyncMax]
+		}
+		body, err := json.Marshal(offlineSyncRequest{DeviceID: device, Stamps: stamps})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, server+"/terminal/offline/sync", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, errors.New("credential rejected (terminal revoked or re-paired?), pair again with -pair CODE")
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("sync: %s", resp.Status)
+		}
+		var res offlineSyncResponse
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return nil, fmt.Errorf("sync: %w", err)
+		}
+		codes := map[string]string{}
+		for _, s := range stamps {
+			codes[s.ID] = s.Code
+		}
+		var done []string
+		for _, r := range res.Results {
+			logReaderResult(codes[r.ID], r)
+			if r.Result != "failed" {
+				done = append(done, r.ID)
+			}
+		}
+		return done, nil
+	}
+}
+
+// directSink toggles each stamp in the database at its original time. A
+// failing database keeps the rest queued.
+func directSink(stamps []OfflineStamp) ([]string, error) {
+	var done []string
+	for _, s := range stamps {
+		r := OfflineStampResult{ID: s.ID, Result: "stamped"}
+		at, err := time.Parse(time.RFC3339Nano, s.At)
+		if err != nil {
+			r.Result = "invalid"
+			logReaderResult(s.Code, r)
+			done = append(done, s.ID)
+			continue
+		}
+		userID := getUserIDFromStampKey(s.Code)
+		if userID == "" {
+			r.Result = "unknown_card"
+			logReaderResult(s.Code, r)
+			done = append(done, s.ID)
+			continue
+		}
+		u := getUser(userID)
+		r.Name = u.Name
+		db := getDB()
+		activity, state := toggleTarget(u, wasAtWork(db, userID, at))
+		db.Close()
+		if activity.ID == 0 {
+			r.Result = "unknown_activity"
+			r.Message = "no activity configured for stamping " + state
+			logReaderResult(s.Code, r)
+			done = append(done, s.ID)
+			continue
+		}
+		id, merged, err := stampEntry(userID, strconv.Itoa(activity.ID), at, 0, StampDetails{})
+		var rej *StampRejection
+		switch {
+		case errors.As(err, &rej):
+			r.Result, r.Message = rej.Code, rej.Message
+		case err != nil:
+			return done, err
+		case merged:
+			r.Result, r.EntryID = "merged", id
+		default:
+			r.EntryID = id
+		}
+		logReaderResult(s.Code, r)
+		done = append(done, s.ID)
+	}
+	return done, nil
+}
+
+func logReaderResult(uid string, r OfflineStampResult) {
+	switch r.Result {
+	case "stamped":
+		log.Printf("reader: %s %s stamped (entry %d)", uid, r.Name, r.EntryID)
+	case "duplicate":
+		// already delivered by an earlier, interrupted sync
+	default:
+		log.Printf("reader: %s %s: %s %s", uid, r.Name, r.Result, r.Message)
+	}
+}
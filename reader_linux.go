@@ -0,0 +1,120 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// serialSource reads one UID per line from a serial reader (RC522 bridges,
+// USB-serial readers) after switching the tty to raw mode at the given baud
+func serialSource(path string, baud int) cardSource {
+	return func(out chan<- string) error {
+		f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOCTTY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := setSerialRaw(int(f.Fd()), baud); err != nil {
+			return fmt.Errorf("configure %s: %w", path, err)
+		}
+		return readLines(f, out)
+	}
+}
+
+var serialBauds = map[int]uint32{
+	1200: unix.B1200, 2400: unix.B2400, 4800: unix.B4800, 9600: unix.B9600,
+	19200: unix.B19200, 38400: unix.B38400, 57600: unix.B57600, 115200: unix.B115200,
+}
+
+func setSerialRaw(fd, baud int) error {
+	speed, ok := serialBauds[baud]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	// like cfmakeraw: no echo, no line editing, 8N1, and read whole lines
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CBAUD
+	t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+	t.Ispeed, t.Ospeed = speed, speed
+	t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
+
+// inputEvent is struct input_event from linux/input.h
+type inputEvent struct {
+	Time  unix.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+const (
+	evKey      = 0x01
+	keyEnter   = 28
+	keyKPEnter = 96
+	evIOCGRAB  = 0x40044590 // _IOW('E', 0x90, int)
+)
+
+// evdevKeys maps key codes of a US layout to characters; card readers
+// only type digits and letters, followed by Enter
+var evdevKeys = func() map[uint16]rune {
+	m := map[uint16]rune{71: '7', 72: '8', 73: '9', 75: '4', 76: '5', 77: '6', 79: '1', 80: '2', 81: '3', 82: '0'}
+	for first, row := range map[uint16]string{2: "1234567890", 16: "QWERTYUIOP", 30: "ASDFGHJKL", 44: "ZXCVBNM"} {
+		for i, r := range row {
+			m[first+uint16(i)] = r
+		}
+	}
+	return m
+}()
+
+// inputSource reads a keyboard-emulating reader from its event device.
+// With grab the device is taken exclusively, so the UIDs are not typed into
+// whatever has the focus on that machine.
+func inputSource(path string, grab bool) cardSource {
+	return func(out chan<- string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if grab {
+			if err := unix.IoctlSetInt(int(f.Fd()), evIOCGRAB, 1); err != nil {
+				return fmt.Errorf("grab %s: %w", path, err)
+			}
+		}
+		r := bufio.NewReader(f)
+		var uid []rune
+		for {
+			var ev inputEvent
+			if err := binary.Read(r, binary.NativeEndian, &ev); err != nil {
+				return err
+			}
+			if ev.Type != evKey || ev.Value != 1 { // key presses only
+				continue
+			}
+			switch ev.Code {
+			case keyEnter, keyKPEnter:
+				if len(uid) > 0 {
+					out <- string(uid)
+				}
+				uid = uid[:0]
+			default:
+				if c, ok := evdevKeys[ev.Code]; ok {
+					uid = append(uid, c)
+				}
+			}
+		}
+	}
+}
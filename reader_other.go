@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Serial and input event readers are only implemented for Linux; elsewhere
+// pipe the reader's output into `reader -file -`.
+
+func serialSource(path string, baud int) cardSource {
+	return func(out chan<- string) error {
+		return errors.New("-serial is only supported on Linux, use -file")
+	}
+}
+
+func inputSource(path string, grab bool) cardSource {
+	return func(out chan<- string) error {
+		return errors.New("-input is only supported on Linux, use -file")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stamp rules guard live stamps from terminals, forms and the clock API
+// (not admin corrections): a debounce window against double scans, what to
+// do with the same status twice in a row on one day, and an optional
+// matrix of allowed transitions between activities (by name).
+
+// StampRules is configured per tenant as "stampRules" in config.json
+type StampRules struct {
+	// DebounceSeconds rejects any stamp this soon after the previous one,
+	// which catches double scans on toggling card readers; 0 (default) or
+	// a negative value disables it. Users can have their own window (edit
+	// user page).
+	DebounceSeconds int `json:"debounceSeconds"`
+	// RepeatedStatus handles a stamp with the current activity on the same
+	// day: "reject" (default), "merge" (keep the existing entry) or "allow"
+	RepeatedStatus string `json:"repeatedStatus"`
+	// Transitions maps an activity to the activities that may follow it on
+	// the same day, e.g. {"Break": ["Work"]}; unlisted activities are free
+	Transitions map[string][]string `json:"transitions"`
+}
+
+// StampRejection explains why a stamp was not recorded
+type StampRejection struct {
+	Code    string // debounced, repeated_status, transition_not_allowed, comment_required, invalid_project, period_locked
+	Message string
+}
+
+func (e *StampRejection) Error() string {
+	return e.Message
+}
+
+type previousStamp struct {
+	ID       int64
+	TypeID   int
+	Activity string
+	At       time.Time
+	Project  int
+	Task     int
+}
+
+func getPreviousStamp(q sqlRunner, userID string) (previousStamp, bool) {
+	query := fmt.Sprintf(`SELECT e.id, e.type_id, t.status, e.date, COALESCE(e.project_id, 0), COALESCE(e.task_id, 0)
+		FROM %s e JOIN %s t ON t.id = e.type_id
+		WHERE e.user_id=@uid ORDER BY e.date DESC, e.id DESC`, tbl("entries"), tbl("type"))
+	var p previousStamp
+	if err := q.QueryRow(query, sql.Named("uid", userID)).Scan(&p.ID, &p.TypeID, &p.Activity, &p.At, &p.Project, &p.Task); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("getPreviousStamp failed: %v", err)
+		}
+		return previousStamp{}, false
+	}
+	return p, true
+}
+
+// getUserDebounce returns the user's own debounce window, if set
+func getUserDebounce(userID string) (int, bool) {
+	db := getDB()
+	defer db.Close()
+	return userDebounce(db, userID)
+}
+
+func userDebounce(q sqlRunner, userID string) (int, bool) {
+	var v sql.NullInt64
+	query := fmt.Sprintf("SELECT debounce_seconds FROM %s WHERE id=@id", tbl("users"))
+	if err := q.QueryRow(query, sql.Named("id", userID)).Scan(&v); err != nil || !v.Valid {
+		return 0, false
+	}
+	return int(v.Int64), true
+}
+
+// setUserDebounce stores the user's debounce window; "" resets to the tenant default
+func setUserDebounce(id, seconds string) {
+	db := getDB()
+	defer db.Close()
+	var v any
+	if n, err := strconv.Atoi(strings.TrimSpace(seconds)); err == nil {
+		v = n
+	}
+	query := fmt.Sprintf("UPDATE %s SET debounce_seconds=@v WHERE id=@id", tbl("users"))
+	if _, err := db.Exec(query, sql.Named("v", v), sql.Named("id", id)); err != nil {
+		log.Printf("update debounce_seconds failed: %v", err)
+	}
+}
+
+func debounceWindow(q sqlRunner, rules StampRules, userID string) time.Duration {
+	secs := rules.DebounceSeconds
+	if own, ok := userDebounce(q, userID); ok {
+		secs = own
+	}
+	if secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// checkStamp applies the tenant's stamp rules. It returns the id of an
+// existing entry when the stamp is merged into it. q may be a transaction
+// that already holds earlier stamps of a batch. A stamp that names another
+// project or task than the previous one is a switch, not a repeated status.
+// Stamps into a locked timesheet month are always rejected.
+func checkStamp(q sqlRunner, userID string, activity Activity, at time.Time, details StampDetails) (int64, error) {
+	if err := checkPeriodOpen(q, userID, at); err != nil {
+		return 0, err
+	}
+	prev, ok := getPreviousStamp(q, userID)
+	if !ok || at.Before(prev.At) {
+		// nothing to compare with; stamps synced late by offline terminals
+		// are not checked against the ones recorded after them
+		return 0, nil
+	}
+	rules := loadTenantConfig(boundHost()).StampRules
+	if window := debounceWindow(q, rules, userID); window > 0 && at.Sub(prev.At) < window {
+		wait := int((window - at.Sub(prev.At)).Seconds()) + 1
+		return 0, &StampRejection{Code: "debounced",
+			Message: fmt.Sprintf("Bereits gestempelt (%s um %s), bitte %d s warten.", prev.Activity, prev.At.Format("15:04:05"), wait)}
+	}
+	if !sameDay(prev.At, at) {
+		return 0, nil
+	}
+	switched := details.ProjectID != 0 && (details.ProjectID != prev.Project || details.TaskID != prev.Task)
+	if prev.TypeID == activity.ID && !switched {
+		switch strings.ToLower(rules.RepeatedStatus) {
+		case "allow":
+		case "merge":
+			return prev.ID, nil
+		default:
+			return 0, &StampRejection{Code: "repeated_status",
+				Message: fmt.Sprintf("Status ist bereits %s (seit %s).", prev.Activity, prev.At.Format("15:04"))}
+		}
+	}
+	if allowed, ok := rules.Transitions[prev.Activity]; ok && !slices.ContainsFunc(allowed, func(s string) bool { return strings.EqualFold(s, activity.Status) }) {
+		return 0, &StampRejection{Code: "transition_not_allowed",
+			Message: fmt.Sprintf("Nach %s ist %s nicht erlaubt (erlaubt: %s).", prev.Activity, activity.Status, strings.Join(allowed, ", "))}
+	}
+	return 0, nil
+}
+
+// stampErrorMessage turns a stampEntry error into text for the stamping pages
+func stampErrorMessage(err error) string {
+	var rej *StampRejection
+	if errors.As(err, &rej) {
+		return rej.Message
+	}
+	return "Stempeln fehlgeschlagen."
+}
+
+// StampDetails is what a user may enter along with a stamp
+type StampDetails struct {
+	Comment   string
+	ProjectID int // 0: none
+	TaskID    int // 0: none; a task implies its project
+}
+
+// checkStampDetails validates the details of an interactive stamp at at: a
+// comment where the activity requires one, an open project and task
+func checkStampDetails(activity Activity, d *StampDetails, at time.Time) error {
+	if err := requireStampComment(activity, d.Comment); err != nil {
+		return err
+	}
+	return checkStampProject(d, at)
+}
+
+// requireStampComment rejects a stamp without a comment on an activity that
+// needs one. Only the interactive paths (forms, mobile, bulk and clock API)
+// check it; card readers, terminals and MQTT devices cannot ask for text.
+func requireStampComment(activity Activity, comment string) error {
+	if activity.CommentRequired && strings.TrimSpace(comment) == "" {
+		return &StampRejection{Code: "comment_required",
+			Message: fmt.Sprintf("Für %s ist ein Kommentar erforderlich.", activity.Status)}
+	}
+	return nil
+}
+
+// stampEntry records a live stamp after checking the stamp rules; merged
+// reports that an existing entry was kept instead of inserting a new one.
+// terminalID is the registered terminal it came from, 0 for none.
+func stampEntry(userID, activityID string, at time.Time, terminalID int, details StampDetails) (id int64, merged bool, err error) {
+	activity := getActivity(activityID)
+	if activity.ID == 0 {
+		return 0, false, fmt.Errorf("unknown activity %s", activityID)
+	}
+	// check and insert in one transaction that holds the user's row, so two
+	// scans of the same card cannot both pass the rules
+	db := getDB()
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	if err := lockUserStamps(tx, userID); err != nil {
+		return 0, false, err
+	}
+	existing, err := checkStamp(tx, userID, activity, at, details)
+	if err != nil {
+		return 0, false, err
+	}
+	if existing != 0 {
+		return existing, true, nil
+	}
+	if id, err = insertEntry(tx, userID, activityID, at, terminalID, details); err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	entryCreated(userID, id, at)
+	return id, false, nil
+}
+
+// lockUserStamps serializes stamps of one user: the no-op update takes the
+// write lock on SQLite and locks the user's row on MSSQL until tx ends
+func lockUserStamps(tx *sql.Tx, userID string) error {
+	query := fmt.Sprintf("UPDATE %s SET name=name WHERE id=@id", tbl("users"))
+	if _, err := tx.Exec(query, sql.Named("id", userID)); err != nil {
+		log.Printf("lockUserStamps failed: %v", err)
+		return err
+	}
+	return nil
+}
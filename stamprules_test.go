@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testDBSeq atomic.Int64
+
+// useTestDB binds the test to a fresh SQLite tenant in a temporary
+// TENANT_DIR whose config.json sets rules as stampRules
+func useTestDB(t *testing.T, rules StampRules) {
+	t.Helper()
+	oldBackend := dbBackend
+	dbBackend = "sqlite"
+	t.Setenv("TENANT_DIR", t.TempDir())
+	host := fmt.Sprintf("stamptest%d", testDBSeq.Add(1))
+	cfg, err := json.Marshal(map[string]any{"stampRules": rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(tenantRoot(), host)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), cfg, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	SetRequestHost(host)
+	EnsureSchemaCurrent()
+	t.Cleanup(func() {
+		ClearRequestHost()
+		tenantCfgCache.Delete(host)
+		dbBackend = oldBackend
+	})
+}
+
+func TestCheckStamp(t *testing.T) {
+	const work, brk, meeting = "1", "2", "3"
+	merge := StampRules{RepeatedStatus: "merge"}
+	matrix := StampRules{Transitions: map[string][]string{"Break": {"Work"}}}
+	base := time.Date(2026, 3, 10, 10, 0, 0, 0, time.Local)
+
+	type stamp struct {
+		activity string
+		at       time.Duration // offset from base
+	}
+	tests := []struct {
+		name     string
+		rules    StampRules
+		prior    []stamp
+		debounce string // the user's own window, "" for the tenant default (off)
+		locked   bool
+		stamp    stamp
+		wantCode string // "" when the stamp is accepted
+		merged   bool   // accepted into the last prior entry
+	}{
+		{name: "first stamp", stamp: stamp{work, 0}},
+		{name: "same activity live", prior: []stamp{{work, 0}}, stamp: stamp{work, time.Hour}, wantCode: "repeated_status"},
+		{name: "different activity live", prior: []stamp{{work, 0}}, stamp: stamp{brk, time.Hour}},
+		{name: "same activity back-dated", prior: []stamp{{work, 0}}, stamp: stamp{work, -time.Hour}},
+		{name: "same activity next day", prior: []stamp{{work, 0}}, stamp: stamp{work, 24 * time.Hour}},
+		{name: "same activity merged", rules: merge, prior: []stamp{{work, 0}}, stamp: stamp{work, time.Hour}, merged: true},
+		{name: "different activity not merged", rules: merge, prior: []stamp{{work, 0}}, stamp: stamp{brk, time.Hour}},
+		{name: "transition allowed", rules: matrix, prior: []stamp{{work, 0}, {brk, time.Hour}}, stamp: stamp{work, 2 * time.Hour}},
+		{name: "transition not allowed", rules: matrix, prior: []stamp{{work, 0}, {brk, time.Hour}}, stamp: stamp{meeting, 2 * time.Hour}, wantCode: "transition_not_allowed"},
+		{name: "unlisted activity free", rules: matrix, prior: []stamp{{work, 0}}, stamp: stamp{meeting, time.Hour}},
+		{name: "transition next day", rules: matrix, prior: []stamp{{brk, 0}}, stamp: stamp{meeting, 24 * time.Hour}},
+		{name: "debounce off by default", prior: []stamp{{work, 0}}, stamp: stamp{brk, 5 * time.Second}},
+		{name: "debounce within window", prior: []stamp{{work, 0}}, debounce: "60", stamp: stamp{brk, 10 * time.Second}, wantCode: "debounced"},
+		{name: "debounce after window", prior: []stamp{{work, 0}}, debounce: "60", stamp: stamp{brk, 2 * time.Minute}},
+		{name: "debounce back-dated", prior: []stamp{{work, 0}}, debounce: "60", stamp: stamp{brk, -10 * time.Second}},
+		{name: "locked month live", prior: []stamp{{work, 0}}, locked: true, stamp: stamp{brk, time.Hour}, wantCode: "period_locked"},
+		{name: "locked month back-dated", prior: []stamp{{work, 0}}, locked: true, stamp: stamp{brk, -time.Hour}, wantCode: "period_locked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t, tt.rules)
+			if _, err := createActivity("Meeting", "1", "", ""); err != nil {
+				t.Fatalf("createActivity: %v", err)
+			}
+			uid, err := createUser("Test User", "4711", "test@example.com", "", "user", "", "")
+			if err != nil {
+				t.Fatalf("createUser: %v", err)
+			}
+			userID := strconv.FormatInt(uid, 10)
+			var last int64
+			for _, p := range tt.prior {
+				if last, err = createEntryFrom(userID, p.activity, base.Add(p.at), 0, StampDetails{}); err != nil {
+					t.Fatalf("createEntryFrom: %v", err)
+				}
+			}
+			if tt.debounce != "" {
+				setUserDebounce(userID, tt.debounce)
+			}
+			if tt.locked {
+				if err := setTimesheetStatus(int(uid), periodOf(base), []string{""}, timesheetLocked, "hr", ""); err != nil {
+					t.Fatalf("lock timesheet: %v", err)
+				}
+			}
+
+			db := getDB()
+			defer db.Close()
+			existing, err := checkStamp(db, userID, getActivity(tt.stamp.activity), base.Add(tt.stamp.at), StampDetails{})
+			var rej *StampRejection
+			switch {
+			case tt.wantCode == "" && err != nil:
+				t.Fatalf("checkStamp rejected: %v", err)
+			case tt.wantCode != "" && !errors.As(err, &rej):
+				t.Fatalf("checkStamp = %v, want rejection %q", err, tt.wantCode)
+			case tt.wantCode != "" && rej.Code != tt.wantCode:
+				t.Fatalf("checkStamp rejected with %q, want %q", rej.Code, tt.wantCode)
+			case tt.merged && existing != last:
+				t.Fatalf("checkStamp merged into %d, want entry %d", existing, last)
+			case !tt.merged && existing != 0:
+				t.Fatalf("checkStamp merged into %d, want a new entry", existing)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"embed"
 	"encoding/json"
 	"html/template"
+	"log"
 	"net/http"
 	"os"
 	"path"
@@ -22,6 +23,30 @@ var tenantCfgCache sync.Map // host -> TenantConfig
 
 type TenantConfig struct {
 	DateTimeFormat string `json:"dateTimeFormat"`
+	// TwoFactorRoles lists roles (e.g. "admin") that must pass a TOTP check on login
+	TwoFactorRoles []string `json:"twoFactorRoles"`
+	// OIDC enables single sign-on next to the form login
+	OIDC *OIDCConfig `json:"oidc"`
+	// LDAP enables directory logins and the scheduled user sync
+	LDAP *LDAPConfig `json:"ldap"`
+	// SMTP configures outgoing mail (password reset links)
+	SMTP *SMTPConfig `json:"smtp"`
+	// PasswordMinLength defaults to 10; BreachedPasswordsFile overrides PASSWORD_BREACHED_LIST
+	PasswordMinLength     int    `json:"passwordMinLength"`
+	BreachedPasswordsFile string `json:"breachedPasswordsFile"`
+	// MaxDailyHours triggers the compliance.violation webhook, default 10
+	MaxDailyHours float64 `json:"maxDailyHours"`
+	// StampRules configures debounce and sequence checks for live stamps
+	StampRules StampRules `json:"stampRules"`
+	// OpenStamping lets any client use the stamping pages, not only paired terminals
+	OpenStamping bool `json:"openStamping"`
+	// Billing sets currency, VAT and sender of the invoice drafts
+	Billing BillingConfig `json:"billing"`
+}
+
+// tenantRoot is the directory holding one subdirectory per tenant host
+func tenantRoot() string {
+	return getenv("TENANT_DIR", "tenant")
 }
 
 func loadTenantConfig(host string) TenantConfig {
@@ -32,21 +57,37 @@ func loadTenantConfig(host string) TenantConfig {
 		return v.(TenantConfig)
 	}
 	safe := strings.ToLower(strings.ReplaceAll(host, "/", "-"))
-	tenantDir := getenv("TENANT_DIR", "tenant")
-	path := filepath.Join(tenantDir, safe, "config.json")
+	path := filepath.Join(tenantRoot(), safe, "config.json")
 	cfg := TenantConfig{DateTimeFormat: "YYYY-MM-DD HH:MM:SS"}
 	if data, err := os.ReadFile(path); err == nil {
-		var tm map[string]any
-		if json.Unmarshal(data, &tm) == nil {
-			if v, ok := tm["dateTimeFormat"].(string); ok && strings.TrimSpace(v) != "" {
-				cfg.DateTimeFormat = v
-			}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			log.Printf("tenant config %s invalid: %v", path, err)
+		}
+		if strings.TrimSpace(cfg.DateTimeFormat) == "" {
+			cfg.DateTimeFormat = "YYYY-MM-DD HH:MM:SS"
 		}
 	}
 	tenantCfgCache.Store(host, cfg)
 	return cfg
 }
 
+// tenantConfigFor returns the tenant configuration for the request's host
+func tenantConfigFor(r *http.Request) TenantConfig {
+	return loadTenantConfig(requestHost(r))
+}
+
+// requestHost returns the request host without port
+func requestHost(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	host := r.Host
+	if idx := strings.IndexByte(host, ':'); idx >= 0 {
+		host = host[:idx]
+	}
+	return host
+}
+
 // Map friendly tokens (YYYY, DD, HH:MM[:SS]) to Go's time layout tokens.
 func goLayoutFromTenant(spec string) string {
 	if strings.TrimSpace(spec) == "" {
@@ -186,7 +227,7 @@ func renderTemplate(w http.ResponseWriter, r *http.Request, page string, data in
 	// Parse tenant overrides for base/header/footer if present
 	if safeHost != "" {
 		for _, name := range []string{"base", "header", "footer"} {
-			tf := filepath.Join("tenant", safeHost, "templates", name+".html")
+			tf := filepath.Join(tenantRoot(), safeHost, "templates", name+".html")
 			if exists(tf) {
 				if _, err := tmpl.ParseFiles(tf); err != nil {
 					http.Error(w, "template parse error: "+err.Error(), http.StatusInternalServerError)
@@ -201,7 +242,7 @@ func renderTemplate(w http.ResponseWriter, r *http.Request, page string, data in
 	// else parse from embedded FS
 
 	if safeHost != "" {
-		tenantPage := filepath.Join("tenant", safeHost, "templates", page+".html")
+		tenantPage := filepath.Join(tenantRoot(), safeHost, "templates", page+".html")
 		if exists(tenantPage) {
 			tmpl, err = tmpl.ParseFiles(tenantPage)
 		} else if info, statErr := os.Stat("templates"); statErr == nil && info.IsDir() {
@@ -290,7 +331,7 @@ func renderHTMLTable(w http.ResponseWriter, r *http.Request, title string, td Ta
 	}
 	if safeHost != "" {
 		for _, name := range []string{"base", "header", "footer"} {
-			tf := filepath.Join("tenant", safeHost, "templates", name+".html")
+			tf := filepath.Join(tenantRoot(), safeHost, "templates", name+".html")
 			if exists(tf) {
 				tmpl, err = tmpl.ParseFiles(tf)
 				if err != nil {
@@ -299,7 +340,7 @@ func renderHTMLTable(w http.ResponseWriter, r *http.Request, title string, td Ta
 				}
 			}
 		}
-		tenantPage := filepath.Join("tenant", safeHost, "templates", "table.html")
+		tenantPage := filepath.Join(tenantRoot(), safeHost, "templates", "table.html")
 		if exists(tenantPage) {
 			tmpl, err = tmpl.ParseFiles(tenantPage)
 		} else if info, statErr := os.Stat("templates"); statErr == nil && info.IsDir() {
@@ -331,12 +372,18 @@ func renderHTMLTable(w http.ResponseWriter, r *http.Request, title string, td Ta
 }
 
 func renderError(w http.ResponseWriter, status int, message string) {
+	// execute a clone: html/template refuses to Clone base once it has executed
+	tmpl, err := base.Clone()
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
 	w.WriteHeader(status)
 	vm := ViewModel{Meta: MetaInfo{Title: "Error"}, Content: map[string]interface{}{
 		"Status":  status,
 		"Message": message,
 	}}
-	if err := base.ExecuteTemplate(w, "base", vm); err != nil {
+	if err := tmpl.ExecuteTemplate(w, "base", vm); err != nil {
 		http.Error(w, "template execute error: "+err.Error(), http.StatusInternalServerError)
 	}
 }
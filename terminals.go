@@ -0,0 +1,747 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Registered terminals are the devices allowed to stamp for others. An admin
+// creates a terminal and gets a short pairing code; entering it on the
+// device (/terminal/pair) hands out a long-lived credential that is only
+// good for stamping: a cookie for the browser terminals (/terminal, /scan,
+// /clockInOutForm) and a bearer token for the offline terminal. Stamps
+// record the terminal that produced them (entries.terminal_id).
+//
+// The offline terminal is a PWA under /terminal/offline/. It queues stamps
+// in IndexedDB with their original time and pushes them to
+// /terminal/offline/sync whenever it is online. Each stamp carries a client
+// id, so a batch that is sent again after a lost response is not recorded
+// twice.
+
+//go:embed pwa
+var pwaFiles embed.FS
+
+const (
+	terminalTokenPrefix = "wtt_"
+	terminalCookie      = "wtm_terminal"
+	terminalCookieAge   = 400 * 24 * time.Hour // longest lifetime browsers accept
+	terminalPairingTTL  = 15 * time.Minute
+	pairingAlphabet     = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O, 1/I
+	terminalSyncMaxAge  = 7 * 24 * time.Hour                 // older queued stamps are rejected
+	terminalSyncMaxSkew = 5 * time.Minute                    // tolerated device clock drift into the future
+	terminalSyncMax     = 1000                               // stamps per sync request
+	terminalStaleAfter  = time.Hour                          // admin page flags terminals silent for longer
+)
+
+type Terminal struct {
+	ID               int
+	Name             string
+	Prefix           string
+	CreatedBy        string
+	CreatedAt        time.Time
+	RevokedAt        time.Time
+	PairedAt         time.Time
+	PairingExpiresAt time.Time // an unused pairing code is open until then
+	DeviceID         string
+	LastSyncAt       time.Time
+	LastSyncIP       string
+	LastSyncCount    int
+	LastSyncRejected int
+	LastStampAt      time.Time
+}
+
+func (t Terminal) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// Paired reports a terminal that has a credential; until then the stored
+// hash belongs to a placeholder nobody knows
+func (t Terminal) Paired() bool {
+	return t.Prefix != ""
+}
+
+// Pairing reports an open pairing code
+func (t Terminal) Pairing() bool {
+	return !t.Revoked() && t.PairingExpiresAt.After(time.Now())
+}
+
+// Stale reports a terminal that has synced before but not recently
+func (t Terminal) Stale() bool {
+	return !t.LastSyncAt.IsZero() && time.Since(t.LastSyncAt) > terminalStaleAfter
+}
+
+//---------------------------------------------------------------------
+// Storage
+//---------------------------------------------------------------------
+
+// newPairingCode returns a code like "K7QX-M2PD"
+func newPairingCode() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("pairing code: %v", err)
+	}
+	code := make([]byte, 0, 9)
+	for i, b := range buf {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, pairingAlphabet[int(b)%len(pairingAlphabet)])
+	}
+	return string(code)
+}
+
+// normalizePairingCode ignores case, spaces and dashes
+func normalizePairingCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		if strings.ContainsRune(pairingAlphabet, r) {
+			return r
+		}
+		return -1
+	}, code)
+}
+
+// createTerminal stores a new, not yet paired terminal and returns its
+// pairing code in clear text
+func createTerminal(name, by string) (string, error) {
+	db := getDB()
+	defer db.Close()
+
+	// the device gets its real credential when it pairs
+	placeholder := terminalTokenPrefix + randomToken(24)
+	code := newPairingCode()
+	query := fmt.Sprintf(`INSERT INTO %s (name, token_hash, prefix, created_by, created_at, pairing_hash, pairing_expires_at)
+	                      VALUES (@name,@hash,'',@by,@now,@pairing,@expires)`, tbl("terminals"))
+	_, err := db.Exec(query,
+		sql.Named("name", name),
+		sql.Named("hash", hashAPIToken(placeholder)),
+		sql.Named("by", by),
+		sql.Named("now", time.Now().Unix()),
+		sql.Named("pairing", hashAPIToken(normalizePairingCode(code))),
+		sql.Named("expires", time.Now().Add(terminalPairingTTL).Unix()),
+	)
+	if err != nil {
+		log.Printf("createTerminal failed: %v", err)
+		return "", err
+	}
+	return code, nil
+}
+
+// renewPairingCode opens a new pairing for a terminal, e.g. a replaced device;
+// the old credential stays valid until the new device has paired
+func renewPairingCode(id string) (string, error) {
+	db := getDB()
+	defer db.Close()
+
+	code := newPairingCode()
+	query := fmt.Sprintf("UPDATE %s SET pairing_hash=@pairing, pairing_expires_at=@expires WHERE id=@id AND revoked_at IS NULL", tbl("terminals"))
+	res, err := db.Exec(query,
+		sql.Named("pairing", hashAPIToken(normalizePairingCode(code))),
+		sql.Named("expires", time.Now().Add(terminalPairingTTL).Unix()),
+		sql.Named("id", id),
+	)
+	if err != nil {
+		log.Printf("renewPairingCode failed: %v", err)
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", fmt.Errorf("terminal %s not found or revoked", id)
+	}
+	return code, nil
+}
+
+// pairTerminal redeems a pairing code and returns the terminal's new
+// credential; the previous credential of the terminal stops working
+func pairTerminal(code string) (Terminal, string, error) {
+	db := getDB()
+	defer db.Close()
+
+	pairing := hashAPIToken(normalizePairingCode(code))
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE pairing_hash=@pairing AND pairing_expires_at > @now AND revoked_at IS NULL", terminalColumns, tbl("terminals"))
+	t, err := scanTerminal(db.QueryRow(query, sql.Named("pairing", pairing), sql.Named("now", time.Now().Unix())).Scan)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("pairTerminal lookup failed: %v", err)
+		}
+		return Terminal{}, "", fmt.Errorf("invalid or expired pairing code")
+	}
+
+	token := terminalTokenPrefix + randomToken(24)
+	update := fmt.Sprintf(`UPDATE %s SET token_hash=@hash, prefix=@prefix, paired_at=@now, pairing_hash=NULL, pairing_expires_at=NULL
+	                       WHERE id=@id AND pairing_hash=@pairing`, tbl("terminals"))
+	res, err := db.Exec(update,
+		sql.Named("hash", hashAPIToken(token)),
+		sql.Named("prefix", token[:len(terminalTokenPrefix)+8]),
+		sql.Named("now", time.Now().Unix()),
+		sql.Named("id", t.ID),
+		sql.Named("pairing", pairing),
+	)
+	if err != nil {
+		log.Printf("pairTerminal update failed: %v", err)
+		return Terminal{}, "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// redeemed concurrently
+		return Terminal{}, "", fmt.Errorf("invalid or expired pairing code")
+	}
+	return t, token, nil
+}
+
+const terminalColumns = "id, name, prefix, COALESCE(created_by, ''), created_at, revoked_at, paired_at, pairing_expires_at, COALESCE(device_id, ''), last_sync_at, COALESCE(last_sync_ip, ''), last_sync_count, last_sync_rejected, last_stamp_at"
+
+func scanTerminal(scan func(...any) error) (Terminal, error) {
+	var t Terminal
+	var created, revoked, paired, pairing, synced, stamped sql.NullInt64
+	err := scan(&t.ID, &t.Name, &t.Prefix, &t.CreatedBy, &created, &revoked, &paired, &pairing, &t.DeviceID, &synced, &t.LastSyncIP, &t.LastSyncCount, &t.LastSyncRejected, &stamped)
+	if err != nil {
+		return t, err
+	}
+	t.CreatedAt, t.RevokedAt, t.PairedAt, t.PairingExpiresAt = fromUnix(created), fromUnix(revoked), fromUnix(paired), fromUnix(pairing)
+	t.LastSyncAt, t.LastStampAt = fromUnix(synced), fromUnix(stamped)
+	return t, nil
+}
+
+func lookupTerminal(token string) (Terminal, bool) {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE token_hash=@hash", terminalColumns, tbl("terminals"))
+	t, err := scanTerminal(db.QueryRow(query, sql.Named("hash", hashAPIToken(token))).Scan)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("lookupTerminal failed: %v", err)
+		}
+		return Terminal{}, false
+	}
+	return t, true
+}
+
+func getTerminals() []Terminal {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY revoked_at, name", terminalColumns, tbl("terminals"))
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Printf("getTerminals query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []Terminal
+	for rows.Next() {
+		t, err := scanTerminal(rows.Scan)
+		if err != nil {
+			log.Printf("getTerminals scan failed: %v", err)
+			continue
+		}
+		list = append(list, t)
+	}
+	return list
+}
+
+func revokeTerminal(id string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET revoked_at=@now, pairing_hash=NULL, pairing_expires_at=NULL WHERE id=@id AND revoked_at IS NULL", tbl("terminals"))
+	if _, err := db.Exec(query, sql.Named("now", time.Now().Unix()), sql.Named("id", id)); err != nil {
+		log.Printf("revokeTerminal failed: %v", err)
+	}
+}
+
+// recordTerminalSync stores what the admin page shows about a terminal's last sync
+func recordTerminalSync(q sqlRunner, t Terminal, deviceID, ip string, stamped, rejected int, lastStamp time.Time) error {
+	var last any
+	if !lastStamp.IsZero() {
+		last = lastStamp.Unix()
+	}
+	query := fmt.Sprintf(`UPDATE %s SET device_id=@device, last_sync_at=@now, last_sync_ip=@ip, last_sync_count=@count,
+	                      last_sync_rejected=@rejected, last_stamp_at=COALESCE(@last, last_stamp_at) WHERE id=@id`, tbl("terminals"))
+	_, err := q.Exec(query,
+		sql.Named("device", deviceID),
+		sql.Named("now", time.Now().Unix()),
+		sql.Named("ip", ip),
+		sql.Named("count", stamped),
+		sql.Named("rejected", rejected),
+		sql.Named("last", last),
+		sql.Named("id", t.ID),
+	)
+	return err
+}
+
+//---------------------------------------------------------------------
+// Authentication
+//---------------------------------------------------------------------
+
+// terminalIDValue stores 0 (no terminal) as NULL
+func terminalIDValue(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// entryTerminalName names the terminal an entry was stamped on, if any
+func entryTerminalName(entryID string) string {
+	db := getDB()
+	defer db.Close()
+	var name string
+	query := fmt.Sprintf("SELECT t.name FROM %s e JOIN %s t ON t.id = e.terminal_id WHERE e.id=@id", tbl("entries"), tbl("terminals"))
+	if err := db.QueryRow(query, sql.Named("id", entryID)).Scan(&name); err != nil && err != sql.ErrNoRows {
+		log.Printf("entryTerminalName failed: %v", err)
+	}
+	return name
+}
+
+// requestTerminal returns the paired terminal behind r, identified by its
+// credential as bearer token or cookie
+func requestTerminal(r *http.Request) (Terminal, bool) {
+	raw, ok := bearerToken(r)
+	if !ok {
+		c, err := r.Cookie(terminalCookie)
+		if err != nil {
+			return Terminal{}, false
+		}
+		raw = c.Value
+	}
+	if !strings.HasPrefix(raw, terminalTokenPrefix) {
+		return Terminal{}, false
+	}
+	t, ok := lookupTerminal(raw)
+	return t, ok && !t.Revoked() && t.Paired()
+}
+
+const (
+	terminalKey apiCtxKey = iota + 1
+	selfStampKey
+)
+
+// stampTerminal is the terminal a stamping request came from, if any
+func stampTerminal(r *http.Request) Terminal {
+	t, _ := r.Context().Value(terminalKey).(Terminal)
+	return t
+}
+
+// selfStampUser is set when a logged-in user without a terminal may only
+// stamp themselves
+func selfStampUser(r *http.Request) int {
+	id, _ := r.Context().Value(selfStampKey).(int)
+	return id
+}
+
+// stampingOnly guards the pages and endpoints that stamp for any user:
+// paired terminals, admins and, when the tenant sets "openStamping", every
+// client may use them. With self, logged-in users may stamp themselves.
+// Other clients are sent to the pairing page (GET) or rejected.
+func stampingOnly(self bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t, ok := requestTerminal(r); ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), terminalKey, t)))
+			return
+		}
+		session, _ := store.Get(r, "session")
+		role, _ := session.Values["role"].(string)
+		if strings.EqualFold(role, "admin") || tenantConfigFor(r).OpenStamping {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if self {
+			if u, ok := currentDBUserFromSession(r); ok && u.ID != 0 {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), selfStampKey, u.ID)))
+				return
+			}
+		}
+		if r.Method == http.MethodGet {
+			http.Redirect(w, r, "/terminal/pair?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Dieses Gerät ist nicht als Terminal registriert.", http.StatusForbidden)
+	})
+}
+
+// terminalAuth requires a terminal credential (Authorization: Bearer wtt_…)
+// and answers the request itself when the caller is rejected
+func terminalAuth(w http.ResponseWriter, r *http.Request) (Terminal, bool) {
+	if wait, blocked := loginBlocked(r, ""); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		apiError(w, http.StatusTooManyRequests, "too_many_requests", "too many failed attempts")
+		return Terminal{}, false
+	}
+	raw, ok := bearerToken(r)
+	if !ok || !strings.HasPrefix(raw, terminalTokenPrefix) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiError(w, http.StatusUnauthorized, "unauthorized", "terminal credential required")
+		return Terminal{}, false
+	}
+	t, ok := lookupTerminal(raw)
+	if !ok || t.Revoked() || !t.Paired() {
+		recordLoginFailure(r, "")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		apiError(w, http.StatusUnauthorized, "invalid_token", "unknown or revoked terminal")
+		return Terminal{}, false
+	}
+	return t, true
+}
+
+//---------------------------------------------------------------------
+// Sync
+//---------------------------------------------------------------------
+
+// OfflineStamp is one queued stamp; ID is generated on the device
+type OfflineStamp struct {
+	ID       string `json:"id"`
+	Code     string `json:"code"`     // scanned user card
+	Activity string `json:"activity"` // activity id or barcode, empty: toggle in/out
+	At       string `json:"at"`       // RFC 3339, time of the scan on the device
+}
+
+// OfflineStampResult tells the device what happened to a stamp. Everything
+// except "failed" is final and can be dropped from the queue.
+type OfflineStampResult struct {
+	ID string `json:"id"`
+	// stamped, merged, duplicate (synced before), unknown_card,
+	// unknown_activity, invalid, too_old, future, a stamp rule code or failed
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+	Name    string `json:"name,omitempty"`
+	EntryID int64  `json:"entryId,omitempty"`
+}
+
+type offlineSyncRequest struct {
+	DeviceID string         `json:"deviceId"`
+	Stamps   []OfflineStamp `json:"stamps"`
+}
+
+type offlineSyncResponse struct {
+	Terminal string               `json:"terminal"`
+	Stamped  int                  `json:"stamped"`
+	Rejected int                  `json:"rejected"`
+	Results  []OfflineStampResult `json:"results"`
+}
+
+// syncOfflineStamps records queued stamps in time order inside one transaction
+func syncOfflineStamps(t Terminal, req offlineSyncRequest, ip string) (offlineSyncResponse, error) {
+	resp := offlineSyncResponse{Terminal: t.Name, Results: []OfflineStampResult{}}
+	stamps := append([]OfflineStamp(nil), req.Stamps...)
+	sort.SliceStable(stamps, func(i, j int) bool {
+		a, _ := time.Parse(time.RFC3339, stamps[i].At)
+		b, _ := time.Parse(time.RFC3339, stamps[j].At)
+		return a.Before(b)
+	})
+
+	activities := map[string]Activity{}
+	activityFor := func(code string) Activity {
+		if a, ok := activities[code]; ok {
+			return a
+		}
+		a, _ := getActivityByScan(code)
+		activities[code] = a
+		return a
+	}
+
+	db := getDB()
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return resp, err
+	}
+	defer tx.Rollback()
+
+	insert := fmt.Sprintf("INSERT INTO %s (date, type_id, user_id, terminal_id) VALUES (@date, @aid, @uid, @tid)", tbl("entries"))
+	seen := fmt.Sprintf("SELECT entry_id FROM %s WHERE terminal_id=@tid AND client_id=@cid", tbl("terminal_stamps"))
+	remember := fmt.Sprintf("INSERT INTO %s (terminal_id, client_id, entry_id, received_at) VALUES (@tid, @cid, @eid, @now)", tbl("terminal_stamps"))
+	now := time.Now()
+	var lastStamp time.Time
+	type created struct {
+		id     int64
+		userID string
+		at     time.Time
+	}
+	var stamped []created
+	for _, s := range stamps {
+		item := OfflineStampResult{ID: strings.TrimSpace(s.ID)}
+		at, perr := time.Parse(time.RFC3339, s.At)
+		at = at.In(time.Local)
+		var existing int64
+		switch {
+		case item.ID == "" || len(item.ID) > 64 || perr != nil:
+			item.Result, item.Message = "invalid", "Stempel ohne gültige ID oder Zeit."
+		case tx.QueryRow(seen, sql.Named("tid", t.ID), sql.Named("cid", item.ID)).Scan(&existing) == nil:
+			item.Result, item.EntryID = "duplicate", existing
+		case at.After(now.Add(terminalSyncMaxSkew)):
+			item.Result, item.Message = "future", "Zeitpunkt liegt in der Zukunft – Uhr des Terminals prüfen."
+		case now.Sub(at) > terminalSyncMaxAge:
+			item.Result, item.Message = "too_old", fmt.Sprintf("Älter als %d Tage, bitte als Korrektur erfassen.", int(terminalSyncMaxAge.Hours()/24))
+		}
+		if item.Result != "" {
+			resp.Results = append(resp.Results, item)
+			continue
+		}
+
+		userID, name := stampKeyUser(tx, scannedCode(strings.TrimSpace(s.Code), "USR"))
+		item.Name = name
+		if userID == "" {
+			item.Result = "unknown_card"
+			resp.Results = append(resp.Results, item)
+			continue
+		}
+		var activity Activity
+		if code := strings.TrimSpace(s.Activity); code != "" {
+			activity = activityFor(code)
+		} else {
+			// card readers only know the card: flip the state at that time
+			activity, _ = toggleTarget(getUser(userID), wasAtWork(tx, userID, at))
+		}
+		if activity.ID == 0 {
+			item.Result = "unknown_activity"
+			resp.Results = append(resp.Results, item)
+			continue
+		}
+
+		mergedID, err := checkStamp(tx, userID, activity, at, StampDetails{})
+		var rej *StampRejection
+		switch {
+		case errors.As(err, &rej):
+			item.Result, item.Message = rej.Code, rej.Message
+		case err != nil:
+			item.Result, item.Message = "failed", stampErrorMessage(err)
+		case mergedID != 0:
+			item.Result, item.EntryID = "merged", mergedID
+		default:
+			id, err := insertID(tx, insert, sql.Named("date", at), sql.Named("aid", activity.ID), sql.Named("uid", userID), sql.Named("tid", t.ID))
+			if err != nil {
+				log.Printf("terminal sync insert for user %s failed: %v", userID, err)
+				item.Result, item.Message = "failed", "Stempeln fehlgeschlagen."
+				break
+			}
+			item.Result, item.EntryID = "stamped", id
+			stamped = append(stamped, created{id, userID, at})
+		}
+		if item.EntryID != 0 {
+			if _, err := tx.Exec(remember, sql.Named("tid", t.ID), sql.Named("cid", item.ID), sql.Named("eid", item.EntryID), sql.Named("now", now.Unix())); err != nil {
+				return resp, err
+			}
+			if at.After(lastStamp) {
+				lastStamp = at
+			}
+		}
+		resp.Results = append(resp.Results, item)
+	}
+
+	for _, item := range resp.Results {
+		switch item.Result {
+		case "stamped", "merged", "duplicate":
+			resp.Stamped++
+		default:
+			resp.Rejected++
+		}
+	}
+	if err := recordTerminalSync(tx, t, strings.TrimSpace(req.DeviceID), ip, resp.Stamped, resp.Rejected, lastStamp); err != nil {
+		return resp, err
+	}
+	if err := tx.Commit(); err != nil {
+		return resp, err
+	}
+
+	if len(stamped) > 0 {
+		notifyStatusChange()
+	}
+	for _, c := range stamped {
+		emitEntryEvent("entry.created", c.id)
+		checkDailyHours(c.userID, c.at)
+	}
+	return resp, nil
+}
+
+//---------------------------------------------------------------------
+// Handlers
+//---------------------------------------------------------------------
+
+// offlineTerminalHandler serves the PWA (page, service worker, manifest)
+func offlineTerminalHandler() http.Handler {
+	sub, err := fs.Sub(pwaFiles, "pwa")
+	if err != nil {
+		log.Fatalf("pwa files: %v", err)
+	}
+	files := http.StripPrefix("/terminal/offline/", http.FileServer(http.FS(sub)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// the service worker decides what is cached; always revalidate
+		w.Header().Set("Cache-Control", "no-cache")
+		if strings.HasSuffix(r.URL.Path, ".webmanifest") {
+			w.Header().Set("Content-Type", "application/manifest+json")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// offlineConfigHandler gives a terminal its name and the activities to offer
+func offlineConfigHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := terminalAuth(w, r)
+	if !ok {
+		return
+	}
+	type activity struct {
+		ID     int    `json:"id"`
+		Status string `json:"status"`
+		Work   bool   `json:"work"`
+		Code   string `json:"code,omitempty"`
+	}
+	list := []activity{}
+	for _, a := range getActivities() {
+		list = append(list, activity{ID: a.ID, Status: a.Status, Work: a.Work == 1, Code: a.Code})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"terminal": t.Name, "activities": list})
+}
+
+// offlineSyncHandler accepts the queued stamps of a registered terminal
+func offlineSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "POST required")
+		return
+	}
+	t, ok := terminalAuth(w, r)
+	if !ok {
+		return
+	}
+	var req offlineSyncRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiMaxBody)).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_body", "invalid JSON body")
+		return
+	}
+	if len(req.Stamps) > terminalSyncMax {
+		apiError(w, http.StatusRequestEntityTooLarge, "too_many_stamps", fmt.Sprintf("at most %d stamps per request", terminalSyncMax))
+		return
+	}
+	resp, err := syncOfflineStamps(t, req, clientIP(r))
+	if err != nil {
+		log.Printf("terminal sync for %s failed: %v", t.Name, err)
+		apiError(w, http.StatusInternalServerError, "sync_failed", "stamps could not be stored, please retry")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// terminalPairHandler redeems a pairing code. Browsers get the credential as
+// cookie and continue to ?next=; JSON clients ({"code": "..."}, the offline
+// terminal) get {"token", "terminal"}.
+func terminalPairHandler(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/terminal"
+	}
+	if r.Method == http.MethodGet {
+		renderTemplate(w, r, "terminalPair", map[string]any{"Next": next})
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	asJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	code := r.FormValue("code")
+	if asJSON {
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, apiMaxBody)).Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_body", "invalid JSON body")
+			return
+		}
+		code = req.Code
+	}
+
+	fail := func(status int, code, message string) {
+		if asJSON {
+			apiError(w, status, code, message)
+			return
+		}
+		renderTemplate(w, r, "terminalPair", map[string]any{"Next": next, "Error": message})
+	}
+	if wait, blocked := loginBlocked(r, ""); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		fail(http.StatusTooManyRequests, "too_many_requests", "Zu viele Fehlversuche, bitte später erneut versuchen.")
+		return
+	}
+	t, token, err := pairTerminal(code)
+	if err != nil {
+		recordLoginFailure(r, "")
+		fail(http.StatusBadRequest, "invalid_code", "Kopplungscode ungültig oder abgelaufen.")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     terminalCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(terminalCookieAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if asJSON {
+		writeJSON(w, http.StatusOK, map[string]string{"token": token, "terminal": t.Name})
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// terminalsHandler lists terminals with their last sync and lets admins
+// register, re-pair and revoke them
+func terminalsHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{}
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "revoke":
+			revokeTerminal(r.FormValue("id"))
+			http.Redirect(w, r, "/admin/terminals", http.StatusSeeOther)
+			return
+		case "pair":
+			code, err := renewPairingCode(r.FormValue("id"))
+			if err != nil {
+				data["Error"] = "Kopplungscode konnte nicht erzeugt werden."
+				break
+			}
+			for _, t := range getTerminals() {
+				if strconv.Itoa(t.ID) == r.FormValue("id") {
+					data["PairingCode"], data["PairingName"] = code, t.Name
+				}
+			}
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" {
+				data["Error"] = "Bitte einen Namen angeben."
+				break
+			}
+			code, err := createTerminal(name, sessionUsername(r))
+			if err != nil {
+				data["Error"] = "Terminal konnte nicht angelegt werden."
+				break
+			}
+			data["PairingCode"], data["PairingName"] = code, name
+		}
+	}
+	data["Terminals"] = getTerminals()
+	data["PairingMinutes"] = int(terminalPairingTTL.Minutes())
+	data["OpenStamping"] = tenantConfigFor(r).OpenStamping
+	renderTemplate(w, r, "terminals", data)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed password checks are counted per account (login name / email) and per
+// client IP. Once the free attempts are used up the subject is locked for
+// throttleBaseDelay, doubling with every further failure up to throttleMaxLockout.
+// Counters expire after throttleWindow without failures.
+const (
+	accountFreeFailures = 3
+	ipFreeFailures      = 20
+	throttleBaseDelay   = 5 * time.Second
+	throttleMaxLockout  = 15 * time.Minute
+	throttleWindow      = 24 * time.Hour
+)
+
+// dummyPasswordHash keeps the response time for unknown accounts close to known ones
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-password"), bcrypt.DefaultCost)
+
+type ThrottleEntry struct {
+	ID          int
+	Scope       string // account or ip
+	Subject     string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+func (t ThrottleEntry) Locked() bool {
+	return t.LockedUntil.After(time.Now())
+}
+
+// passwordMatches checks password against u in constant-ish time, whether or not the user exists
+func passwordMatches(u User, found bool, password string) bool {
+	hash := dummyPasswordHash
+	if found && u.Password != "" {
+		hash = []byte(u.Password)
+	}
+	ok := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	return ok && found && u.Password != "" && u.Active != 0
+}
+
+// clientIP returns the remote address; X-Forwarded-For is only honoured with TRUST_PROXY_HEADERS=1
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "1" {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func accountKey(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+func lockoutFor(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	d := throttleBaseDelay << uint(min(failures-free, 20))
+	return min(d, throttleMaxLockout)
+}
+
+// loginBlocked reports whether the account or the client IP is currently locked out
+func loginBlocked(r *http.Request, login string) (time.Duration, bool) {
+	var wait time.Duration
+	for _, t := range []ThrottleEntry{getThrottle("account", accountKey(login)), getThrottle("ip", clientIP(r))} {
+		if t.Locked() {
+			wait = max(wait, time.Until(t.LockedUntil))
+		}
+	}
+	return wait, wait > 0
+}
+
+// recordLoginFailure counts a failed attempt for the account and the client IP
+func recordLoginFailure(r *http.Request, login string) {
+	if login = accountKey(login); login != "" {
+		bumpThrottle("account", login, accountFreeFailures)
+	}
+	bumpThrottle("ip", clientIP(r), ipFreeFailures)
+}
+
+// recordLoginSuccess clears the account counter; the IP counter keeps running
+// so one valid account cannot be used to reset guessing on others
+func recordLoginSuccess(login string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("DELETE FROM %s WHERE scope='account' AND subject=@subject", tbl("login_throttle"))
+	if _, err := db.Exec(query, sql.Named("subject", accountKey(login))); err != nil {
+		log.Printf("recordLoginSuccess failed: %v", err)
+	}
+}
+
+// tooManyAttempts answers a locked-out request with 429 and Retry-After
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	wait = wait.Round(time.Second)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+	renderTooManyRequests(w, fmt.Errorf("zu viele fehlgeschlagene Anmeldeversuche, bitte in %s erneut versuchen", wait))
+}
+
+//---------------------------------------------------------------------
+// Storage
+//---------------------------------------------------------------------
+
+func getThrottle(scope, subject string) ThrottleEntry {
+	db := getDB()
+	defer db.Close()
+
+	t := ThrottleEntry{Scope: scope, Subject: subject}
+	var last, locked int64
+	query := fmt.Sprintf("SELECT id, failures, last_failure, locked_until FROM %s WHERE scope=@scope AND subject=@subject", tbl("login_throttle"))
+	if err := db.QueryRow(query, sql.Named("scope", scope), sql.Named("subject", subject)).Scan(&t.ID, &t.Failures, &last, &locked); err != nil {
+		return t
+	}
+	t.LastFailure, t.LockedUntil = time.Unix(last, 0), time.Unix(locked, 0)
+	return t
+}
+
+func bumpThrottle(scope, subject string, free int) {
+	t := getThrottle(scope, subject)
+	now := time.Now()
+	if now.Sub(t.LastFailure) > throttleWindow {
+		t.Failures = 0
+	}
+	t.Failures++
+	lockedUntil := int64(0)
+	if d := lockoutFor(t.Failures, free); d > 0 {
+		lockedUntil = now.Add(d).Unix()
+	}
+
+	db := getDB()
+	defer db.Close()
+	var err error
+	if t.ID > 0 {
+		query := fmt.Sprintf("UPDATE %s SET failures=@failures, last_failure=@last, locked_until=@locked WHERE id=@id", tbl("login_throttle"))
+		_, err = db.Exec(query, sql.Named("failures", t.Failures), sql.Named("last", now.Unix()), sql.Named("locked", lockedUntil), sql.Named("id", t.ID))
+	} else {
+		query := fmt.Sprintf("INSERT INTO %s (scope, subject, failures, last_failure, locked_until) VALUES (@scope,@subject,@failures,@last,@locked)", tbl("login_throttle"))
+		_, err = db.Exec(query, sql.Named("scope", scope), sql.Named("subject", subject), sql.Named("failures", t.Failures), sql.Named("last", now.Unix()), sql.Named("locked", lockedUntil))
+	}
+	if err != nil {
+		log.Printf("bumpThrottle %s/%s failed: %v", scope, subject, err)
+	}
+	if lockedUntil > 0 {
+		log.Printf("login throttle: %s %q locked after %d failures", scope, subject, t.Failures)
+	}
+}
+
+// getThrottles lists counters that saw a failure within throttleWindow
+func getThrottles() []ThrottleEntry {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT id, scope, subject, failures, last_failure, locked_until FROM %s WHERE last_failure >= @since ORDER BY locked_until DESC, last_failure DESC", tbl("login_throttle"))
+	rows, err := db.Query(query, sql.Named("since", time.Now().Add(-throttleWindow).Unix()))
+	if err != nil {
+		log.Printf("getThrottles query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []ThrottleEntry
+	for rows.Next() {
+		var t ThrottleEntry
+		var last, locked int64
+		if err := rows.Scan(&t.ID, &t.Scope, &t.Subject, &t.Failures, &last, &locked); err != nil {
+			log.Printf("getThrottles scan failed: %v", err)
+			continue
+		}
+		t.LastFailure, t.LockedUntil = time.Unix(last, 0), time.Unix(locked, 0)
+		list = append(list, t)
+	}
+	return list
+}
+
+func deleteThrottle(id string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("login_throttle"))
+	if _, err := db.Exec(query, sql.Named("id", id)); err != nil {
+		log.Printf("deleteThrottle failed: %v", err)
+	}
+}
+
+// lockoutsHandler lists failed-login counters and lets admins unlock them
+func lockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		deleteThrottle(r.FormValue("id"))
+		http.Redirect(w, r, "/admin/lockouts", http.StatusSeeOther)
+		return
+	}
+	renderTemplate(w, r, "lockouts", map[string]any{"Entries": getThrottles()})
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Monthly timesheets: the employee submits a month, a manager of the same
+// department (or an admin) approves or rejects it and HR (or an admin) locks
+// it. Entries of a locked month can only be changed by a privileged
+// correction with a reason, which is kept in the entry audit, and stamps
+// into a locked month are rejected.
+
+const (
+	timesheetSubmitted = "submitted"
+	timesheetRejected  = "rejected"
+	timesheetApproved  = "approved"
+	timesheetLocked    = "locked"
+)
+
+// Timesheet is one user's month; an empty Status means open
+type Timesheet struct {
+	UserID     int
+	UserName   string
+	Department string
+	Period     string // YYYY-MM
+	Status     string
+	Note       string // reason of a rejection
+	DecidedBy  string
+	LockedBy   string
+	Hours      float64
+}
+
+// Label formats the period as MM/YYYY
+func (t Timesheet) Label() string {
+	if p, err := time.Parse("2006-01", t.Period); err == nil {
+		return p.Format("01/2006")
+	}
+	return t.Period
+}
+
+func (t Timesheet) Submittable() bool {
+	return t.Status == "" || t.Status == timesheetRejected
+}
+
+var errTimesheetState = errors.New("timesheet is not in the expected state")
+
+// periodOf is the timesheet month a stamp at t belongs to
+func periodOf(t time.Time) string {
+	return t.In(time.Local).Format("2006-01")
+}
+
+func isRole(role string, names ...string) bool {
+	return slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(role, n) })
+}
+
+func sessionRole(r *http.Request) string {
+	session, _ := store.Get(r, "session")
+	role, _ := session.Values["role"].(string)
+	return role
+}
+
+// canApprove: admins approve everyone, managers the other members of their department
+func canApprove(role string, viewer, target User) bool {
+	if isRole(role, "admin") {
+		return true
+	}
+	return isRole(role, "manager") && viewer.ID != 0 && viewer.ID != target.ID &&
+		viewer.DepartmentID != 0 && viewer.DepartmentID == target.DepartmentID
+}
+
+// canLock also allows privileged corrections inside locked months
+func canLock(role string) bool {
+	return isRole(role, "admin", "hr")
+}
+
+// periodLocked reports whether the user's month containing at is locked
+func periodLocked(q sqlRunner, userID string, at time.Time) bool {
+	var n int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id=@uid AND period=@p AND status=@s", tbl("timesheets"))
+	if err := q.QueryRow(query, sql.Named("uid", userID), sql.Named("p", periodOf(at)), sql.Named("s", timesheetLocked)).Scan(&n); err != nil {
+		log.Printf("periodLocked failed: %v", err)
+		return false
+	}
+	return n > 0
+}
+
+// checkPeriodOpen rejects a stamp or change at at in a locked month
+func checkPeriodOpen(q sqlRunner, userID string, at time.Time) error {
+	if periodLocked(q, userID, at) {
+		return &StampRejection{Code: "period_locked",
+			Message: fmt.Sprintf("Der Zeitraum %s ist abgeschlossen und gesperrt.", at.In(time.Local).Format("01/2006"))}
+	}
+	return nil
+}
+
+// authorizeEntryChange checks an edit of entry e against locked months; with
+// newUserID "" it is a delete, with an empty e a new entry. Inside a locked
+// month only HR and admins may correct, and only with a reason; audit
+// reports that they did.
+func authorizeEntryChange(e EntryDetail, newUserID string, newDate time.Time, role, reason string) (audit bool, err error) {
+	db := getDB()
+	defer db.Close()
+	if e.ID != 0 {
+		err = checkPeriodOpen(db, strconv.Itoa(e.UserID), parseDBTimeInLoc(e.Date, time.Local))
+	}
+	if err == nil && newUserID != "" {
+		err = checkPeriodOpen(db, newUserID, newDate)
+	}
+	if err == nil {
+		return false, nil
+	}
+	if !canLock(role) {
+		return false, err
+	}
+	if strings.TrimSpace(reason) == "" {
+		return false, &StampRejection{Code: "period_locked", Message: err.Error() + " Korrekturen nur mit Begründung."}
+	}
+	return true, nil
+}
+
+//---------------------------------------------------------------------
+// Storage
+//---------------------------------------------------------------------
+
+func getTimesheetStatus(q sqlRunner, userID int, period string) (status string) {
+	query := fmt.Sprintf("SELECT status FROM %s WHERE user_id=@uid AND period=@p", tbl("timesheets"))
+	if err := q.QueryRow(query, sql.Named("uid", userID), sql.Named("p", period)).Scan(&status); err != nil && err != sql.ErrNoRows {
+		log.Printf("getTimesheetStatus failed: %v", err)
+	}
+	return status
+}
+
+// setTimesheetStatus moves a timesheet from one of the states in from ("" =
+// open) to status, recording who did it
+func setTimesheetStatus(userID int, period string, from []string, status, by, note string) error {
+	db := getDB()
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	current := getTimesheetStatus(tx, userID, period)
+	if !slices.Contains(from, current) {
+		return errTimesheetState
+	}
+	if current == "" {
+		query := fmt.Sprintf("INSERT INTO %s (user_id, period, status) VALUES (@uid, @p, @s)", tbl("timesheets"))
+		if _, err := tx.Exec(query, sql.Named("uid", userID), sql.Named("p", period), sql.Named("s", status)); err != nil {
+			log.Printf("setTimesheetStatus insert failed: %v", err)
+			return err
+		}
+	}
+	args := []any{sql.Named("uid", userID), sql.Named("p", period), sql.Named("s", status), sql.Named("now", time.Now().Unix())}
+	var set string
+	switch status {
+	case timesheetSubmitted:
+		set = "submitted_at=@now, note=NULL"
+	case timesheetLocked:
+		set = "locked_by=@by, locked_at=@now"
+		args = append(args, sql.Named("by", by))
+	default: // approved, rejected
+		set = "decided_by=@by, decided_at=@now, note=@note"
+		args = append(args, sql.Named("by", by), sql.Named("note", note))
+	}
+	query := fmt.Sprintf("UPDATE %s SET status=@s, %s WHERE user_id=@uid AND period=@p", tbl("timesheets"), set)
+	if _, err := tx.Exec(query, args...); err != nil {
+		log.Printf("setTimesheetStatus failed: %v", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// getTimesheets lists the timesheets in status, newest month first;
+// departmentID limits them to one department (0: all)
+func getTimesheets(status string, departmentID int) []Timesheet {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`SELECT s.user_id, u.name, COALESCE(d.name, ''), s.period, s.status, COALESCE(s.note, ''),
+		COALESCE(s.decided_by, ''), COALESCE(s.locked_by, '')
+		FROM %s s
+		JOIN %s u ON u.id = s.user_id
+		LEFT JOIN %s d ON d.id = u.department_id
+		WHERE s.status=@s`, tbl("timesheets"), tbl("users"), tbl("departments"))
+	args := []any{sql.Named("s", status)}
+	if departmentID != 0 {
+		query += " AND u.department_id=@dep"
+		args = append(args, sql.Named("dep", departmentID))
+	}
+	rows, err := db.Query(query+" ORDER BY s.period DESC, u.name", args...)
+	if err != nil {
+		log.Printf("getTimesheets query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var list []Timesheet
+	for rows.Next() {
+		var t Timesheet
+		if err := rows.Scan(&t.UserID, &t.UserName, &t.Department, &t.Period, &t.Status, &t.Note, &t.DecidedBy, &t.LockedBy); err != nil {
+			log.Printf("getTimesheets scan failed: %v", err)
+			continue
+		}
+		list = append(list, t)
+	}
+	for i := range list {
+		list[i].Hours = monthHours(list[i].UserName, list[i].Period)
+	}
+	return list
+}
+
+// userTimesheets returns the user's last months, the current one first
+func userTimesheets(u User, months int) []Timesheet {
+	db := getDB()
+	defer db.Close()
+	byPeriod := map[string]Timesheet{}
+	query := fmt.Sprintf(`SELECT period, status, COALESCE(note, ''), COALESCE(decided_by, ''), COALESCE(locked_by, '')
+		FROM %s WHERE user_id=@uid`, tbl("timesheets"))
+	rows, err := db.Query(query, sql.Named("uid", u.ID))
+	if err != nil {
+		log.Printf("userTimesheets query failed: %v", err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var t Timesheet
+			if err := rows.Scan(&t.Period, &t.Status, &t.Note, &t.DecidedBy, &t.LockedBy); err != nil {
+				log.Printf("userTimesheets scan failed: %v", err)
+				continue
+			}
+			byPeriod[t.Period] = t
+		}
+	}
+	hours := map[string]float64{}
+	for _, d := range getWorkHoursDataForUser(u.Name) {
+		if len(d.WorkDate) >= 7 {
+			hours[d.WorkDate[:7]] += d.WorkHours
+		}
+	}
+	now := time.Now()
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	list := make([]Timesheet, 0, months)
+	for i := 0; i < months; i++ {
+		period := first.AddDate(0, -i, 0).Format("2006-01")
+		t := byPeriod[period]
+		t.UserID, t.UserName, t.Period, t.Hours = u.ID, u.Name, period, hours[period]
+		list = append(list, t)
+	}
+	return list
+}
+
+// monthHours sums a user's work hours in a YYYY-MM period
+func monthHours(userName, period string) float64 {
+	total := 0.0
+	for _, d := range getWorkHoursDataForUser(userName) {
+		if strings.HasPrefix(d.WorkDate, period) {
+			total += d.WorkHours
+		}
+	}
+	return total
+}
+
+// EntryAudit is one privileged correction of an entry in a locked month
+type EntryAudit struct {
+	Action    string // update, delete
+	Reason    string
+	ChangedBy string
+	ChangedAt time.Time
+	OldValue  string
+	NewValue  string
+}
+
+func recordEntryAudit(entryID, userID int, action, reason, by, oldValue, newValue string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`INSERT INTO %s (entry_id, user_id, action, reason, changed_by, changed_at, old_value, new_value)
+		VALUES (@eid, @uid, @action, @reason, @by, @at, @old, @new)`, tbl("entry_audit"))
+	if _, err := db.Exec(query, sql.Named("eid", entryID), sql.Named("uid", userID), sql.Named("action", action),
+		sql.Named("reason", reason), sql.Named("by", by), sql.Named("at", time.Now().Unix()),
+		sql.Named("old", oldValue), sql.Named("new", newValue)); err != nil {
+		log.Printf("recordEntryAudit failed: %v", err)
+	}
+}
+
+func getEntryAudit(entryID string) []EntryAudit {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`SELECT action, COALESCE(reason, ''), COALESCE(changed_by, ''), changed_at, COALESCE(old_value, ''), COALESCE(new_value, '')
+		FROM %s WHERE entry_id=@eid ORDER BY changed_at DESC, id DESC`, tbl("entry_audit"))
+	rows, err := db.Query(query, sql.Named("eid", entryID))
+	if err != nil {
+		log.Printf("getEntryAudit query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var list []EntryAudit
+	for rows.Next() {
+		var a EntryAudit
+		var at int64
+		if err := rows.Scan(&a.Action, &a.Reason, &a.ChangedBy, &at, &a.OldValue, &a.NewValue); err != nil {
+			log.Printf("getEntryAudit scan failed: %v", err)
+			continue
+		}
+		a.ChangedAt = time.Unix(at, 0)
+		list = append(list, a)
+	}
+	return list
+}
+
+// entrySummary describes an entry for the audit trail
+func entrySummary(e EntryDetail) string {
+	s := fmt.Sprintf("%s %s %s", e.UserName, parseDBTimeInLoc(e.Date, time.Local).Format("2006-01-02 15:04"), e.Activity)
+	if e.Project != "" {
+		s += " · " + e.Project
+	}
+	if e.Comment != "" {
+		s += " (" + e.Comment + ")"
+	}
+	return s
+}
+
+//---------------------------------------------------------------------
+// Handler
+//---------------------------------------------------------------------
+
+// timesheetsHandler shows the user's own months and, for managers and HR,
+// the timesheets waiting for them
+func timesheetsHandler(w http.ResponseWriter, r *http.Request) {
+	role := sessionRole(r)
+	viewer, isDBUser := currentDBUserFromSession(r)
+	by := sessionUsername(r)
+
+	if r.Method == http.MethodPost {
+		period := r.FormValue("period")
+		if _, err := time.Parse("2006-01", period); err != nil {
+			http.Error(w, "Ungültiger Monat.", http.StatusBadRequest)
+			return
+		}
+		target := viewer
+		if id := r.FormValue("user_id"); id != "" {
+			target = getUser(id)
+		}
+		if target.ID == 0 {
+			http.Error(w, "Unbekannter Mitarbeiter.", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch r.FormValue("action") {
+		case "submit":
+			if !isDBUser || target.ID != viewer.ID {
+				http.Error(w, "Nur der eigene Stundenzettel kann eingereicht werden.", http.StatusForbidden)
+				return
+			}
+			if period > periodOf(time.Now()) {
+				http.Error(w, "Künftige Monate können nicht eingereicht werden.", http.StatusBadRequest)
+				return
+			}
+			err = setTimesheetStatus(target.ID, period, []string{"", timesheetRejected}, timesheetSubmitted, by, "")
+		case "approve", "reject":
+			if !canApprove(role, viewer, target) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			status, note := timesheetApproved, ""
+			if r.FormValue("action") == "reject" {
+				status, note = timesheetRejected, strings.TrimSpace(r.FormValue("note"))
+			}
+			err = setTimesheetStatus(target.ID, period, []string{timesheetSubmitted}, status, by, note)
+		case "lock":
+			if !canLock(role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			err = setTimesheetStatus(target.ID, period, []string{timesheetApproved}, timesheetLocked, by, "")
+		default:
+			http.Error(w, "Unbekannte Aktion.", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errTimesheetState) {
+			http.Error(w, "Der Stundenzettel hat inzwischen einen anderen Status.", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Speichern fehlgeschlagen.", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/timesheets", http.StatusSeeOther)
+		return
+	}
+
+	data := map[string]any{"CanLock": canLock(role), "CanApprove": isRole(role, "admin", "manager")}
+	if isDBUser && viewer.ID != 0 {
+		data["Own"] = userTimesheets(viewer, 6)
+	}
+	switch {
+	case isRole(role, "admin"):
+		data["Pending"] = getTimesheets(timesheetSubmitted, 0)
+	case isRole(role, "manager") && viewer.DepartmentID != 0:
+		var pending []Timesheet
+		for _, t := range getTimesheets(timesheetSubmitted, viewer.DepartmentID) {
+			if t.UserID != viewer.ID {
+				pending = append(pending, t)
+			}
+		}
+		data["Pending"] = pending
+	}
+	if canLock(role) {
+		data["Approved"] = getTimesheets(timesheetApproved, 0)
+		locked := getTimesheets(timesheetLocked, 0)
+		data["Locked"] = locked[:min(len(locked), 50)]
+	}
+	renderTemplate(w, r, "timesheets", data)
+}
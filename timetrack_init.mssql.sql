@@ -56,6 +56,261 @@ CREATE TABLE [dbo].[entries] (
     FOREIGN KEY ([user_id]) REFERENCES [dbo].[users] ([id])
 );
 
+-- Tabelle: user_recovery_codes (2FA)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.user_recovery_codes', 'U') IS NULL
+CREATE TABLE [dbo].[user_recovery_codes] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [user_id] INT NOT NULL,
+    [code_hash] NVARCHAR(255) NOT NULL,
+    [used_at] DATETIME NULL,
+    FOREIGN KEY ([user_id]) REFERENCES [dbo].[users] ([id])
+);
+
+-- Tabelle: login_throttle (failed login counters, unix timestamps)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.login_throttle', 'U') IS NULL
+CREATE TABLE [dbo].[login_throttle] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [scope] NVARCHAR(16) NOT NULL,
+    [subject] NVARCHAR(255) NOT NULL,
+    [failures] INT NOT NULL DEFAULT 0,
+    [last_failure] BIGINT NOT NULL DEFAULT 0,
+    [locked_until] BIGINT NOT NULL DEFAULT 0,
+    CONSTRAINT [UQ_login_throttle] UNIQUE ([scope], [subject])
+);
+
+-- Tabelle: password_reset_tokens (one-time reset links, unix timestamps)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.password_reset_tokens', 'U') IS NULL
+CREATE TABLE [dbo].[password_reset_tokens] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [user_id] INT NOT NULL,
+    [token_hash] NVARCHAR(64) NOT NULL UNIQUE,
+    [expires_at] BIGINT NOT NULL,
+    [used_at] BIGINT NULL,
+    [created_by] NVARCHAR(255) NULL,
+    FOREIGN KEY ([user_id]) REFERENCES [dbo].[users] ([id])
+);
+
+-- Tabelle: api_tokens (bearer tokens, SHA-256 hashed, unix timestamps)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.api_tokens', 'U') IS NULL
+CREATE TABLE [dbo].[api_tokens] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [name] NVARCHAR(255) NOT NULL,
+    [token_hash] NVARCHAR(64) NOT NULL UNIQUE,
+    [prefix] NVARCHAR(16) NOT NULL,
+    [user_id] INT NULL,
+    [scopes] NVARCHAR(1000) NOT NULL,
+    [tenant] NVARCHAR(255) NULL,
+    [allowed_ips] NVARCHAR(1000) NULL,
+    [expires_at] BIGINT NOT NULL DEFAULT 0,
+    [created_by] NVARCHAR(255) NULL,
+    [created_at] BIGINT NOT NULL,
+    [last_used_at] BIGINT NULL,
+    [last_used_ip] NVARCHAR(64) NULL,
+    [revoked_at] BIGINT NULL,
+    FOREIGN KEY ([user_id]) REFERENCES [dbo].[users] ([id])
+);
+
+-- Tabelle: webhooks (outgoing webhook subscriptions)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.webhooks', 'U') IS NULL
+CREATE TABLE [dbo].[webhooks] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [url] NVARCHAR(2000) NOT NULL,
+    [secret] NVARCHAR(255) NOT NULL,
+    [events] NVARCHAR(1000) NOT NULL,
+    [active] INT NOT NULL DEFAULT 1,
+    [description] NVARCHAR(255) NULL,
+    [created_at] BIGINT NOT NULL
+);
+
+-- Tabelle: webhook_deliveries (delivery queue and log, unix timestamps)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.webhook_deliveries', 'U') IS NULL
+CREATE TABLE [dbo].[webhook_deliveries] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [webhook_id] INT NOT NULL,
+    [event] NVARCHAR(64) NOT NULL,
+    [payload] NVARCHAR(MAX) NOT NULL,
+    [status] NVARCHAR(16) NOT NULL DEFAULT 'pending',
+    [attempts] INT NOT NULL DEFAULT 0,
+    [next_attempt_at] BIGINT NOT NULL,
+    [last_status] INT NULL,
+    [last_error] NVARCHAR(1000) NULL,
+    [created_at] BIGINT NOT NULL,
+    [delivered_at] BIGINT NULL,
+    FOREIGN KEY ([webhook_id]) REFERENCES [dbo].[webhooks] ([id])
+);
+
+-- Tabelle: evacuations (evacuation roll-calls, unix timestamps)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.evacuations', 'U') IS NULL
+CREATE TABLE [dbo].[evacuations] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [started_at] BIGINT NOT NULL,
+    [started_by] NVARCHAR(255) NULL,
+    [ended_at] BIGINT NULL,
+    [ended_by] NVARCHAR(255) NULL
+);
+
+-- Tabelle: evacuation_persons (roll-call snapshot and check-offs)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.evacuation_persons', 'U') IS NULL
+CREATE TABLE [dbo].[evacuation_persons] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [evacuation_id] INT NOT NULL,
+    [user_id] INT NOT NULL,
+    [user_name] NVARCHAR(255) NOT NULL,
+    [department] NVARCHAR(255) NULL,
+    [activity] NVARCHAR(255) NULL,
+    [since] BIGINT NULL,
+    [in_snapshot] INT NOT NULL DEFAULT 1,
+    [checked_at] BIGINT NULL,
+    [checked_by] NVARCHAR(255) NULL,
+    [method] NVARCHAR(16) NULL,
+    FOREIGN KEY ([evacuation_id]) REFERENCES [dbo].[evacuations] ([id])
+);
+
+-- Tabelle: idempotency_keys (stored responses for retried requests, unix timestamps)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.idempotency_keys', 'U') IS NULL
+CREATE TABLE [dbo].[idempotency_keys] (
+    [idempotency_key] NVARCHAR(128) NOT NULL PRIMARY KEY,
+    [endpoint] NVARCHAR(64) NOT NULL,
+    [request_hash] NVARCHAR(64) NOT NULL,
+    [status] INT NOT NULL,
+    [response] NVARCHAR(MAX) NOT NULL,
+    [created_at] BIGINT NOT NULL
+);
+
+-- Tabelle: terminals (registered stamping terminals, unix timestamps)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.terminals', 'U') IS NULL
+CREATE TABLE [dbo].[terminals] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [name] NVARCHAR(255) NOT NULL,
+    [token_hash] NVARCHAR(64) NOT NULL UNIQUE,
+    [prefix] NVARCHAR(32) NOT NULL,
+    [created_by] NVARCHAR(255) NULL,
+    [created_at] BIGINT NOT NULL,
+    [revoked_at] BIGINT NULL,
+    [device_id] NVARCHAR(64) NULL,
+    [last_sync_at] BIGINT NULL,
+    [last_sync_ip] NVARCHAR(64) NULL,
+    [last_sync_count] INT NOT NULL DEFAULT 0,
+    [last_sync_rejected] INT NOT NULL DEFAULT 0,
+    [last_stamp_at] BIGINT NULL
+);
+
+-- Tabelle: terminal_stamps (stamps synced by terminals, for duplicate detection)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.terminal_stamps', 'U') IS NULL
+CREATE TABLE [dbo].[terminal_stamps] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [terminal_id] INT NOT NULL,
+    [client_id] NVARCHAR(64) NOT NULL,
+    [entry_id] INT NOT NULL,
+    [received_at] BIGINT NOT NULL,
+    CONSTRAINT [UQ_terminal_stamps_client] UNIQUE ([terminal_id], [client_id]),
+    FOREIGN KEY ([terminal_id]) REFERENCES [dbo].[terminals] ([id])
+);
+
+-- Tabelle: geofences (allowed stamping areas per department, radius in metres)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.geofences', 'U') IS NULL
+CREATE TABLE [dbo].[geofences] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [department_id] INT NOT NULL,
+    [name] NVARCHAR(255) NOT NULL,
+    [latitude] FLOAT NOT NULL,
+    [longitude] FLOAT NOT NULL,
+    [radius] FLOAT NOT NULL,
+    FOREIGN KEY ([department_id]) REFERENCES [dbo].[departments] ([id])
+);
+
+-- Tabelle: projects (active_from/active_to as YYYY-MM-DD, NULL = open)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.projects', 'U') IS NULL
+CREATE TABLE [dbo].[projects] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [name] NVARCHAR(255) NOT NULL,
+    [client] NVARCHAR(255) NULL,
+    [budget_hours] FLOAT NULL,
+    [active_from] NVARCHAR(10) NULL,
+    [active_to] NVARCHAR(10) NULL
+);
+
+-- Tabelle: tasks (per project)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.tasks', 'U') IS NULL
+CREATE TABLE [dbo].[tasks] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [project_id] INT NOT NULL,
+    [name] NVARCHAR(255) NOT NULL,
+    [active] INT NOT NULL DEFAULT 1,
+    FOREIGN KEY ([project_id]) REFERENCES [dbo].[projects] ([id])
+);
+
+-- Tabelle: cost_centers
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.cost_centers', 'U') IS NULL
+CREATE TABLE [dbo].[cost_centers] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [code] NVARCHAR(64) NOT NULL UNIQUE,
+    [name] NVARCHAR(255) NOT NULL
+);
+
+-- Tabelle: billing_rates (hourly rate; NULL user/activity/project = any)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.billing_rates', 'U') IS NULL
+CREATE TABLE [dbo].[billing_rates] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [user_id] INT NULL,
+    [activity_id] INT NULL,
+    [project_id] INT NULL,
+    [rate] FLOAT NOT NULL,
+    FOREIGN KEY ([user_id]) REFERENCES [dbo].[users] ([id]),
+    FOREIGN KEY ([activity_id]) REFERENCES [dbo].[type] ([id]),
+    FOREIGN KEY ([project_id]) REFERENCES [dbo].[projects] ([id])
+);
+
+-- Tabelle: timesheets (period YYYY-MM; submitted, rejected, approved, locked)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.timesheets', 'U') IS NULL
+CREATE TABLE [dbo].[timesheets] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [user_id] INT NOT NULL,
+    [period] NVARCHAR(7) NOT NULL,
+    [status] NVARCHAR(16) NOT NULL,
+    [note] NVARCHAR(MAX) NULL,
+    [submitted_at] BIGINT NULL,
+    [decided_by] NVARCHAR(255) NULL,
+    [decided_at] BIGINT NULL,
+    [locked_by] NVARCHAR(255) NULL,
+    [locked_at] BIGINT NULL,
+    CONSTRAINT [UQ_timesheets] UNIQUE ([user_id], [period]),
+    FOREIGN KEY ([user_id]) REFERENCES [dbo].[users] ([id])
+);
+
+-- Tabelle: entry_audit (corrections in locked months; no FK, deleted entries stay audited)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.entry_audit', 'U') IS NULL
+CREATE TABLE [dbo].[entry_audit] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [entry_id] INT NOT NULL,
+    [user_id] INT NULL,
+    [action] NVARCHAR(16) NOT NULL,
+    [reason] NVARCHAR(MAX) NULL,
+    [changed_by] NVARCHAR(255) NULL,
+    [changed_at] BIGINT NOT NULL,
+    [old_value] NVARCHAR(MAX) NULL,
+    [new_value] NVARCHAR(MAX) NULL
+);
+
+-- Tabelle: correction_requests (kind add, time, activity; pending, approved, rejected)
+IF OBJECT_ID(QUOTENAME(@SchemaName) + '.correction_requests', 'U') IS NULL
+CREATE TABLE [dbo].[correction_requests] (
+    [id] INT IDENTITY(1,1) PRIMARY KEY,
+    [user_id] INT NOT NULL,
+    [kind] NVARCHAR(16) NOT NULL,
+    [entry_id] INT NULL,
+    [activity_id] INT NULL,
+    [requested_at] BIGINT NULL,
+    [reason] NVARCHAR(MAX) NOT NULL,
+    [status] NVARCHAR(16) NOT NULL,
+    [note] NVARCHAR(MAX) NULL,
+    [created_at] BIGINT NOT NULL,
+    [decided_by] NVARCHAR(255) NULL,
+    [decided_at] BIGINT NULL,
+    [applied_entry_id] INT NULL,
+    FOREIGN KEY ([user_id]) REFERENCES [dbo].[users] ([id])
+);
+
 -- View: work_hours
 IF OBJECT_ID(QUOTENAME(@SchemaName) + '.work_hours', 'V') IS NOT NULL
     DROP VIEW [dbo].[work_hours];
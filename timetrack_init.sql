@@ -37,6 +37,225 @@ CREATE TABLE IF NOT EXISTS "departments" (
 	"name" TEXT UNIQUE NOT NULL
 );
 
+CREATE TABLE IF NOT EXISTS "user_recovery_codes" (
+	"id" INTEGER PRIMARY KEY,
+	"user_id" INTEGER NOT NULL,
+	"code_hash" TEXT NOT NULL,
+	"used_at" DATETIME,
+	FOREIGN KEY("user_id") REFERENCES "users"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "login_throttle" (
+	"id" INTEGER PRIMARY KEY,
+	"scope" TEXT NOT NULL,
+	"subject" TEXT NOT NULL,
+	"failures" INTEGER NOT NULL DEFAULT 0,
+	"last_failure" INTEGER NOT NULL DEFAULT 0,
+	"locked_until" INTEGER NOT NULL DEFAULT 0,
+	UNIQUE("scope", "subject")
+);
+
+CREATE TABLE IF NOT EXISTS "password_reset_tokens" (
+	"id" INTEGER PRIMARY KEY,
+	"user_id" INTEGER NOT NULL,
+	"token_hash" TEXT UNIQUE NOT NULL,
+	"expires_at" INTEGER NOT NULL,
+	"used_at" INTEGER,
+	"created_by" TEXT,
+	FOREIGN KEY("user_id") REFERENCES "users"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "api_tokens" (
+	"id" INTEGER PRIMARY KEY,
+	"name" TEXT NOT NULL,
+	"token_hash" TEXT UNIQUE NOT NULL,
+	"prefix" TEXT NOT NULL,
+	"user_id" INTEGER,
+	"scopes" TEXT NOT NULL,
+	"tenant" TEXT,
+	"allowed_ips" TEXT,
+	"expires_at" INTEGER NOT NULL DEFAULT 0,
+	"created_by" TEXT,
+	"created_at" INTEGER NOT NULL,
+	"last_used_at" INTEGER,
+	"last_used_ip" TEXT,
+	"revoked_at" INTEGER,
+	FOREIGN KEY("user_id") REFERENCES "users"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "webhooks" (
+	"id" INTEGER PRIMARY KEY,
+	"url" TEXT NOT NULL,
+	"secret" TEXT NOT NULL,
+	"events" TEXT NOT NULL,
+	"active" INTEGER NOT NULL DEFAULT 1,
+	"description" TEXT,
+	"created_at" INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "webhook_deliveries" (
+	"id" INTEGER PRIMARY KEY,
+	"webhook_id" INTEGER NOT NULL,
+	"event" TEXT NOT NULL,
+	"payload" TEXT NOT NULL,
+	"status" TEXT NOT NULL DEFAULT 'pending',
+	"attempts" INTEGER NOT NULL DEFAULT 0,
+	"next_attempt_at" INTEGER NOT NULL,
+	"last_status" INTEGER,
+	"last_error" TEXT,
+	"created_at" INTEGER NOT NULL,
+	"delivered_at" INTEGER,
+	FOREIGN KEY("webhook_id") REFERENCES "webhooks"("id")
+);
+
+CREATE INDEX IF NOT EXISTS "idx_webhook_deliveries_due" ON "webhook_deliveries" ("status", "next_attempt_at");
+
+CREATE TABLE IF NOT EXISTS "evacuations" (
+	"id" INTEGER PRIMARY KEY,
+	"started_at" INTEGER NOT NULL,
+	"started_by" TEXT,
+	"ended_at" INTEGER,
+	"ended_by" TEXT
+);
+
+CREATE TABLE IF NOT EXISTS "evacuation_persons" (
+	"id" INTEGER PRIMARY KEY,
+	"evacuation_id" INTEGER NOT NULL,
+	"user_id" INTEGER NOT NULL,
+	"user_name" TEXT NOT NULL,
+	"department" TEXT,
+	"activity" TEXT,
+	"since" INTEGER,
+	"in_snapshot" INTEGER NOT NULL DEFAULT 1,
+	"checked_at" INTEGER,
+	"checked_by" TEXT,
+	"method" TEXT,
+	FOREIGN KEY("evacuation_id") REFERENCES "evacuations"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "idempotency_keys" (
+	"idempotency_key" TEXT PRIMARY KEY,
+	"endpoint" TEXT NOT NULL,
+	"request_hash" TEXT NOT NULL,
+	"status" INTEGER NOT NULL,
+	"response" TEXT NOT NULL,
+	"created_at" INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "terminals" (
+	"id" INTEGER PRIMARY KEY,
+	"name" TEXT NOT NULL,
+	"token_hash" TEXT NOT NULL UNIQUE,
+	"prefix" TEXT NOT NULL,
+	"created_by" TEXT,
+	"created_at" INTEGER NOT NULL,
+	"revoked_at" INTEGER,
+	"device_id" TEXT,
+	"last_sync_at" INTEGER,
+	"last_sync_ip" TEXT,
+	"last_sync_count" INTEGER NOT NULL DEFAULT 0,
+	"last_sync_rejected" INTEGER NOT NULL DEFAULT 0,
+	"last_stamp_at" INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS "terminal_stamps" (
+	"id" INTEGER PRIMARY KEY,
+	"terminal_id" INTEGER NOT NULL,
+	"client_id" TEXT NOT NULL,
+	"entry_id" INTEGER NOT NULL,
+	"received_at" INTEGER NOT NULL,
+	UNIQUE("terminal_id", "client_id"),
+	FOREIGN KEY("terminal_id") REFERENCES "terminals"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "geofences" (
+	"id" INTEGER PRIMARY KEY,
+	"department_id" INTEGER NOT NULL,
+	"name" TEXT NOT NULL,
+	"latitude" REAL NOT NULL,
+	"longitude" REAL NOT NULL,
+	"radius" REAL NOT NULL,
+	FOREIGN KEY("department_id") REFERENCES "departments"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "projects" (
+	"id" INTEGER PRIMARY KEY,
+	"name" TEXT NOT NULL,
+	"client" TEXT,
+	"budget_hours" REAL,
+	"active_from" TEXT,
+	"active_to" TEXT
+);
+
+CREATE TABLE IF NOT EXISTS "tasks" (
+	"id" INTEGER PRIMARY KEY,
+	"project_id" INTEGER NOT NULL,
+	"name" TEXT NOT NULL,
+	"active" INTEGER DEFAULT 1,
+	FOREIGN KEY("project_id") REFERENCES "projects"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "cost_centers" (
+	"id" INTEGER PRIMARY KEY,
+	"code" TEXT UNIQUE NOT NULL,
+	"name" TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "billing_rates" (
+	"id" INTEGER PRIMARY KEY,
+	"user_id" INTEGER,
+	"activity_id" INTEGER,
+	"project_id" INTEGER,
+	"rate" REAL NOT NULL,
+	FOREIGN KEY("user_id") REFERENCES "users"("id"),
+	FOREIGN KEY("activity_id") REFERENCES "type"("id"),
+	FOREIGN KEY("project_id") REFERENCES "projects"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "timesheets" (
+	"id" INTEGER PRIMARY KEY,
+	"user_id" INTEGER NOT NULL,
+	"period" TEXT NOT NULL,
+	"status" TEXT NOT NULL,
+	"note" TEXT,
+	"submitted_at" INTEGER,
+	"decided_by" TEXT,
+	"decided_at" INTEGER,
+	"locked_by" TEXT,
+	"locked_at" INTEGER,
+	UNIQUE("user_id", "period"),
+	FOREIGN KEY("user_id") REFERENCES "users"("id")
+);
+
+CREATE TABLE IF NOT EXISTS "entry_audit" (
+	"id" INTEGER PRIMARY KEY,
+	"entry_id" INTEGER NOT NULL,
+	"user_id" INTEGER,
+	"action" TEXT NOT NULL,
+	"reason" TEXT,
+	"changed_by" TEXT,
+	"changed_at" INTEGER NOT NULL,
+	"old_value" TEXT,
+	"new_value" TEXT
+);
+
+CREATE TABLE IF NOT EXISTS "correction_requests" (
+	"id" INTEGER PRIMARY KEY,
+	"user_id" INTEGER NOT NULL,
+	"kind" TEXT NOT NULL,
+	"entry_id" INTEGER,
+	"activity_id" INTEGER,
+	"requested_at" INTEGER,
+	"reason" TEXT NOT NULL,
+	"status" TEXT NOT NULL,
+	"note" TEXT,
+	"created_at" INTEGER NOT NULL,
+	"decided_by" TEXT,
+	"decided_at" INTEGER,
+	"applied_entry_id" INTEGER,
+	FOREIGN KEY("user_id") REFERENCES "users"("id")
+);
+
 CREATE VIEW IF NOT EXISTS "work_hours" AS
 WITH work_intervals AS (
 	SELECT
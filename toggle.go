@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Toggle stamping: a terminal only scans the stampkey. Somebody who is at
+// work gets the department's "off" activity, everybody else its work
+// activity. Departments without their own choice use the tenant defaults
+// (first work activity, and "Break" or the first non-work activity).
+
+type ToggleResult struct {
+	Result     string  `json:"result"`         // stamped, unknown, rejected
+	Code       string  `json:"code,omitempty"` // StampRejection code
+	Message    string  `json:"message,omitempty"`
+	Name       string  `json:"name,omitempty"`
+	State      string  `json:"state,omitempty"` // in, out
+	Activity   string  `json:"activity,omitempty"`
+	At         string  `json:"at,omitempty"` // RFC 3339
+	TodayHours float64 `json:"todayHours"`
+}
+
+// defaultToggleActivities picks the tenant-wide toggle activities
+func defaultToggleActivities(activities []Activity) (work, off Activity) {
+	sort.Slice(activities, func(i, j int) bool { return activities[i].ID < activities[j].ID })
+	for _, a := range activities {
+		switch {
+		case a.Work == 1 && work.ID == 0:
+			work = a
+		case a.Work == 0 && (off.ID == 0 || strings.EqualFold(a.Status, "Break") && !strings.EqualFold(off.Status, "Break")):
+			off = a
+		}
+	}
+	return work, off
+}
+
+// toggleActivities returns the in/out activities for a user's department
+func toggleActivities(u User) (work, off Activity) {
+	activities := getActivities()
+	work, off = defaultToggleActivities(activities)
+	if u.DepartmentID == 0 {
+		return work, off
+	}
+	d := getDepartment(strconv.Itoa(u.DepartmentID))
+	for _, a := range activities {
+		if a.ID == d.ToggleWorkID && a.Work == 1 {
+			work = a
+		}
+		if a.ID == d.ToggleOffID && a.Work == 0 {
+			off = a
+		}
+	}
+	return work, off
+}
+
+// isAtWork reports whether the user's current status (as in
+// getCurrentStatusForUserID) is a work activity; a forgotten check-out older
+// than boardPresentMaxSpan does not count
+func isAtWork(userID int, now time.Time) bool {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf(`SELECT t.work, cs.date FROM %s cs JOIN %s t ON t.id = cs.type_id WHERE cs.user_id=@id`,
+		tbl("current_status"), tbl("type"))
+	var work int
+	var at time.Time
+	if err := db.QueryRow(query, sql.Named("id", userID)).Scan(&work, &at); err != nil {
+		return false
+	}
+	return work == 1 && now.Sub(at) < boardPresentMaxSpan
+}
+
+// wasAtWork is isAtWork for a past moment, judged by the last stamp before
+// at; readers syncing buffered stamps use it inside their transaction
+func wasAtWork(q sqlRunner, userID string, at time.Time) bool {
+	query := fmt.Sprintf(`SELECT t.work, e.date FROM %s e JOIN %s t ON t.id = e.type_id
+		WHERE e.user_id=@uid AND e.date <= @at ORDER BY e.date DESC, e.id DESC`, tbl("entries"), tbl("type"))
+	var work int
+	var last time.Time
+	if err := q.QueryRow(query, sql.Named("uid", userID), sql.Named("at", at)).Scan(&work, &last); err != nil {
+		return false
+	}
+	return work == 1 && at.Sub(last) < boardPresentMaxSpan
+}
+
+// toggleTarget picks the activity that flips the user's state
+func toggleTarget(u User, atWork bool) (Activity, string) {
+	work, off := toggleActivities(u)
+	if atWork {
+		return off, "out"
+	}
+	return work, "in"
+}
+
+// toggleStamp records the opposite of the user's current state
+func toggleStamp(u User, now time.Time, terminalID int) (ToggleResult, error) {
+	target, state := toggleTarget(u, isAtWork(u.ID, now))
+	if target.ID == 0 {
+		return ToggleResult{}, fmt.Errorf("no activity configured for stamping %s", state)
+	}
+	if _, _, err := stampEntry(strconv.Itoa(u.ID), strconv.Itoa(target.ID), now, terminalID, StampDetails{}); err != nil {
+		return ToggleResult{}, err
+	}
+	return ToggleResult{
+		Result:     "stamped",
+		Name:       u.Name,
+		State:      state,
+		Activity:   target.Status,
+		At:         now.Format(time.RFC3339),
+		TodayHours: dailyWorkHours(u.Name, now.Format("2006-01-02")),
+	}, nil
+}
+
+// terminalHandler serves the toggle terminal page
+func terminalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	renderTemplate(w, r, "terminal", nil)
+}
+
+// toggleClockHandler stamps the user behind a scanned stampkey in or out.
+// It accepts {"code": "..."} as JSON or a "code" form value.
+func toggleClockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code := r.FormValue("code")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad payload", http.StatusBadRequest)
+			return
+		}
+		code = req.Code
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		http.Error(w, "Missing code", http.StatusBadRequest)
+		return
+	}
+	userID := getUserIDFromStampKey(scannedCode(code, "USR"))
+	if userID == "" {
+		writeJSON(w, http.StatusNotFound, ToggleResult{Result: "unknown"})
+		return
+	}
+	u := getUser(userID)
+	res, err := toggleStamp(u, time.Now(), stampTerminal(r).ID)
+	var rej *StampRejection
+	if errors.As(err, &rej) {
+		writeJSON(w, http.StatusConflict, ToggleResult{Result: "rejected", Code: rej.Code, Message: rej.Message, Name: u.Name})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"result": "error", "message": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
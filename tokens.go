@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API tokens authenticate scripts and terminals with "Authorization: Bearer <token>".
+// Only a SHA-256 hash is stored; the token itself is shown once when it is created.
+// Personal tokens belong to a user and never grant more than that user's role,
+// service tokens (no user) act on their own with exactly the granted scopes.
+const (
+	apiTokenPrefix    = "wtm_"
+	apiTokenTouchStep = time.Minute // last-used is written at most this often
+)
+
+type APIToken struct {
+	ID         int
+	Name       string
+	Prefix     string // first characters, to recognise a token without storing it
+	UserID     int    // 0 for service tokens
+	UserName   string
+	Scopes     []string
+	Tenant     string   // host the token is restricted to, empty for any
+	AllowedIPs []string // IPs or CIDRs, empty for any
+	ExpiresAt  time.Time
+	CreatedBy  string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	LastUsedIP string
+	RevokedAt  time.Time
+}
+
+func (t APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && t.ExpiresAt.Before(time.Now())
+}
+
+func (t APIToken) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ipAllowed reports whether ip matches one of the IPs or CIDR ranges in list
+func ipAllowed(list []string, ip string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	for _, entry := range list {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if addr != nil && network.Contains(addr) {
+				return true
+			}
+		} else if other := net.ParseIP(entry); other != nil && addr != nil && other.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits on commas, whitespace and newlines and drops empty items
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' })
+}
+
+func fromUnix(v sql.NullInt64) time.Time {
+	if !v.Valid || v.Int64 == 0 {
+		return time.Time{}
+	}
+	return time.Unix(v.Int64, 0)
+}
+
+//---------------------------------------------------------------------
+// Authentication
+//---------------------------------------------------------------------
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+// tokenPrincipal validates the bearer token of r. The error text is returned to the client.
+func tokenPrincipal(r *http.Request, raw string) (apiPrincipal, error) {
+	invalid := fmt.Errorf("invalid or expired token")
+	if !strings.HasPrefix(raw, apiTokenPrefix) {
+		return apiPrincipal{}, invalid
+	}
+	t, ok := lookupAPIToken(raw)
+	if !ok || t.Revoked() || t.Expired() {
+		return apiPrincipal{}, invalid
+	}
+	if t.Tenant != "" && !strings.EqualFold(t.Tenant, requestHost(r)) {
+		return apiPrincipal{}, invalid
+	}
+	ip := clientIP(r)
+	if !ipAllowed(t.AllowedIPs, ip) {
+		return apiPrincipal{}, fmt.Errorf("token not allowed from %s", ip)
+	}
+
+	p := apiPrincipal{Name: "token:" + t.Name, Role: "service", Service: true, Scopes: map[string]bool{}}
+	var owner apiPrincipal
+	if t.UserID != 0 {
+		u := getUser(strconv.Itoa(t.UserID))
+		if u.ID == 0 || u.Active == 0 {
+			return apiPrincipal{}, invalid
+		}
+		owner = apiPrincipal{Role: u.Role}
+		p = apiPrincipal{Name: u.Email, Role: u.Role, UserID: u.ID, Scopes: map[string]bool{}}
+	}
+	for _, s := range t.Scopes {
+		if t.UserID == 0 || owner.can(s) {
+			p.Scopes[s] = true
+		}
+	}
+	if time.Since(t.LastUsedAt) > apiTokenTouchStep {
+		touchAPIToken(t.ID, ip)
+	}
+	return p, nil
+}
+
+// authenticateBearer checks the token and the failure throttle and answers
+// the request itself (JSON) when the caller is rejected
+func authenticateBearer(w http.ResponseWriter, r *http.Request, raw, scope string) (apiPrincipal, bool) {
+	if wait, blocked := loginBlocked(r, ""); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		apiError(w, http.StatusTooManyRequests, "too_many_requests", "too many failed attempts")
+		return apiPrincipal{}, false
+	}
+	p, err := tokenPrincipal(r, raw)
+	if err != nil {
+		recordLoginFailure(r, "")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		apiError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return apiPrincipal{}, false
+	}
+	if !p.can(scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		apiError(w, http.StatusForbidden, "forbidden", "missing permission "+scope)
+		return apiPrincipal{}, false
+	}
+	return p, true
+}
+
+// bearerAuthMiddleware requires a valid API token holding scope
+func bearerAuthMiddleware(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, http.StatusUnauthorized, "unauthorized", "bearer token required")
+			return
+		}
+		if _, ok := authenticateBearer(w, r, raw, scope); ok {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// bearerOrSession uses bearerAuthMiddleware when the request carries a bearer
+// token and the given session middleware (basicAuthMiddleware, adminOnly) otherwise
+func bearerOrSession(scope string, session func(http.Handler) http.Handler, next http.Handler) http.Handler {
+	withToken, withSession := bearerAuthMiddleware(scope, next), session(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok {
+			withToken.ServeHTTP(w, r)
+			return
+		}
+		withSession.ServeHTTP(w, r)
+	})
+}
+
+//---------------------------------------------------------------------
+// Storage
+//---------------------------------------------------------------------
+
+// createAPIToken stores a new token and returns it in clear text
+func createAPIToken(t APIToken) (string, error) {
+	db := getDB()
+	defer db.Close()
+
+	token := apiTokenPrefix + randomToken(24)
+	var expires int64
+	if !t.ExpiresAt.IsZero() {
+		expires = t.ExpiresAt.Unix()
+	}
+	var userID any
+	if t.UserID != 0 {
+		userID = t.UserID
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (name, token_hash, prefix, user_id, scopes, tenant, allowed_ips, expires_at, created_by, created_at)
+	                      VALUES (@name,@hash,@prefix,@uid,@scopes,@tenant,@ips,@exp,@by,@now)`, tbl("api_tokens"))
+	_, err := db.Exec(query,
+		sql.Named("name", t.Name),
+		sql.Named("hash", hashAPIToken(token)),
+		sql.Named("prefix", token[:len(apiTokenPrefix)+8]),
+		sql.Named("uid", userID),
+		sql.Named("scopes", strings.Join(t.Scopes, " ")),
+		sql.Named("tenant", t.Tenant),
+		sql.Named("ips", strings.Join(t.AllowedIPs, ",")),
+		sql.Named("exp", expires),
+		sql.Named("by", t.CreatedBy),
+		sql.Named("now", time.Now().Unix()),
+	)
+	if err != nil {
+		log.Printf("createAPIToken failed: %v", err)
+		return "", err
+	}
+	return token, nil
+}
+
+const apiTokenColumns = "t.id, t.name, t.prefix, COALESCE(t.user_id, 0), COALESCE(u.name, ''), t.scopes, COALESCE(t.tenant, ''), COALESCE(t.allowed_ips, ''), t.expires_at, COALESCE(t.created_by, ''), t.created_at, t.last_used_at, COALESCE(t.last_used_ip, ''), t.revoked_at"
+
+func scanAPIToken(scan func(...any) error) (APIToken, error) {
+	var t APIToken
+	var scopes, ips string
+	var expires, created, used, revoked sql.NullInt64
+	err := scan(&t.ID, &t.Name, &t.Prefix, &t.UserID, &t.UserName, &scopes, &t.Tenant, &ips, &expires, &t.CreatedBy, &created, &used, &t.LastUsedIP, &revoked)
+	if err != nil {
+		return t, err
+	}
+	t.Scopes, t.AllowedIPs = strings.Fields(scopes), splitList(ips)
+	t.ExpiresAt, t.CreatedAt, t.LastUsedAt, t.RevokedAt = fromUnix(expires), fromUnix(created), fromUnix(used), fromUnix(revoked)
+	return t, nil
+}
+
+func lookupAPIToken(token string) (APIToken, bool) {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT %s FROM %s t LEFT JOIN %s u ON u.id = t.user_id WHERE t.token_hash=@hash", apiTokenColumns, tbl("api_tokens"), tbl("users"))
+	t, err := scanAPIToken(db.QueryRow(query, sql.Named("hash", hashAPIToken(token))).Scan)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("lookupAPIToken failed: %v", err)
+		}
+		return APIToken{}, false
+	}
+	return t, true
+}
+
+func getAPITokens() []APIToken {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT %s FROM %s t LEFT JOIN %s u ON u.id = t.user_id ORDER BY t.revoked_at, t.created_at DESC", apiTokenColumns, tbl("api_tokens"), tbl("users"))
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Printf("getAPITokens query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows.Scan)
+		if err != nil {
+			log.Printf("getAPITokens scan failed: %v", err)
+			continue
+		}
+		list = append(list, t)
+	}
+	return list
+}
+
+func touchAPIToken(id int, ip string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET last_used_at=@now, last_used_ip=@ip WHERE id=@id", tbl("api_tokens"))
+	if _, err := db.Exec(query, sql.Named("now", time.Now().Unix()), sql.Named("ip", ip), sql.Named("id", id)); err != nil {
+		log.Printf("touchAPIToken failed: %v", err)
+	}
+}
+
+func revokeAPIToken(id string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET revoked_at=@now WHERE id=@id AND revoked_at IS NULL", tbl("api_tokens"))
+	if _, err := db.Exec(query, sql.Named("now", time.Now().Unix()), sql.Named("id", id)); err != nil {
+		log.Printf("revokeAPIToken failed: %v", err)
+	}
+}
+
+// deleteUserAPITokens removes the personal tokens of a deleted user
+func deleteUserAPITokens(userID int) {
+	db := getDB()
+	defer db.Close()
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=@uid", tbl("api_tokens")), sql.Named("uid", userID)); err != nil {
+		log.Printf("deleteUserAPITokens failed: %v", err)
+	}
+}
+
+//---------------------------------------------------------------------
+// Admin page
+//---------------------------------------------------------------------
+
+// apiTokensHandler lists tokens and lets admins create and revoke them
+func apiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{"Scopes": apiScopes, "Users": getAllUsers(), "Host": requestHost(r)}
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "revoke":
+			revokeAPIToken(r.FormValue("id"))
+			http.Redirect(w, r, "/admin/tokens", http.StatusSeeOther)
+			return
+		case "create":
+			t, err := apiTokenFromForm(r)
+			if err == nil {
+				session, _ := store.Get(r, "session")
+				t.CreatedBy, _ = session.Values["username"].(string)
+				var token string
+				if token, err = createAPIToken(t); err == nil {
+					data["NewToken"], data["NewTokenName"] = token, t.Name
+				}
+			}
+			if err != nil {
+				data["Error"] = err.Error()
+			}
+		}
+	}
+	data["Tokens"] = getAPITokens()
+	renderTemplate(w, r, "apiTokens", data)
+}
+
+func apiTokenFromForm(r *http.Request) (APIToken, error) {
+	t := APIToken{
+		Name:       strings.TrimSpace(r.FormValue("name")),
+		UserID:     atoiDefault(r.FormValue("user_id"), 0),
+		Tenant:     strings.TrimSpace(r.FormValue("tenant")),
+		AllowedIPs: splitList(r.FormValue("allowed_ips")),
+	}
+	if t.Name == "" {
+		return t, fmt.Errorf("Bitte einen Namen angeben.")
+	}
+	for _, s := range r.Form["scopes"] {
+		if slices.Contains(apiScopes, s) {
+			t.Scopes = append(t.Scopes, s)
+		}
+	}
+	if len(t.Scopes) == 0 {
+		return t, fmt.Errorf("Bitte mindestens eine Berechtigung auswählen.")
+	}
+	for _, ip := range t.AllowedIPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			return t, fmt.Errorf("Ungültige IP-Adresse oder ungültiges Netz: %s", ip)
+		}
+	}
+	if t.UserID != 0 && getUser(strconv.Itoa(t.UserID)).ID == 0 {
+		return t, fmt.Errorf("Unbekannter Benutzer.")
+	}
+	if days := atoiDefault(r.FormValue("expires_days"), 0); days > 0 {
+		t.ExpiresAt = time.Now().AddDate(0, 0, days)
+	}
+	return t, nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//---------------------------------------------------------------------
+// TOTP (RFC 6238): 6 digits, 30 second steps, HMAC-SHA1 – works with
+// every common authenticator app without network access
+//---------------------------------------------------------------------
+
+const (
+	totpStep          = 30
+	totpDigits        = 6
+	totpSkew          = 1 // accept one step before/after to tolerate clock drift
+	recoveryCodeCount = 10
+	pendingLoginTTL   = 5 * time.Minute
+)
+
+var b32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160 bit secret, base32 encoded
+func newTOTPSecret() string {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("totp secret: %v", err)
+	}
+	return b32NoPad.EncodeToString(buf)
+}
+
+// totpCode computes the code for the given secret and time step
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := (uint32(sum[off])&0x7f)<<24 | uint32(sum[off+1])<<16 | uint32(sum[off+2])<<8 | uint32(sum[off+3])
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// verifyTOTP checks code against the secret around now. Steps <= lastStep are
+// rejected so a code cannot be replayed. Returns the matched step.
+func verifyTOTP(secretB32, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	secret, err := b32NoPad.DecodeString(strings.ToUpper(secretB32))
+	if err != nil || len(secret) == 0 {
+		return 0, false
+	}
+	cur := now.Unix() / totpStep
+	for d := -totpSkew; d <= totpSkew; d++ {
+		step := cur + int64(d)
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI builds the otpauth:// provisioning URI understood by authenticator apps
+func totpURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpStep))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// qrDataURL renders content as PNG QR code and returns it as data: URL for <img src>
+func qrDataURL(content string, size int) template.URL {
+	png, err := qrcode.Encode(content, qrcode.Medium, size)
+	if err != nil {
+		log.Printf("qr encode failed: %v", err)
+		return ""
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+}
+
+//---------------------------------------------------------------------
+// DB access
+//---------------------------------------------------------------------
+
+// getUserTOTP returns the stored secret, whether 2FA is active and the last accepted step
+func getUserTOTP(userID int) (secret string, enabled bool, lastStep int64) {
+	db := getDB()
+	defer db.Close()
+	var en int
+	query := fmt.Sprintf("SELECT COALESCE(totp_secret,''), COALESCE(totp_enabled,0), COALESCE(totp_last_step,0) FROM %s WHERE id=@id", tbl("users"))
+	if err := db.QueryRow(query, sql.Named("id", userID)).Scan(&secret, &en, &lastStep); err != nil {
+		return "", false, 0
+	}
+	return secret, en == 1 && secret != "", lastStep
+}
+
+func setUserTOTP(userID int, secret string, enabled bool) {
+	db := getDB()
+	defer db.Close()
+	val := 0
+	if enabled {
+		val = 1
+	}
+	query := fmt.Sprintf("UPDATE %s SET totp_secret=@secret, totp_enabled=@en, totp_last_step=0 WHERE id=@id", tbl("users"))
+	if _, err := db.Exec(query, sql.Named("secret", secret), sql.Named("en", val), sql.Named("id", userID)); err != nil {
+		log.Printf("setUserTOTP failed: %v", err)
+	}
+}
+
+// claimTOTPStep records step as used unless the same or a later one already
+// was; of concurrent logins with one code only the first gets true
+func claimTOTPStep(userID int, step int64) bool {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET totp_last_step=@step WHERE id=@id AND COALESCE(totp_last_step, 0) < @step", tbl("users"))
+	res, err := db.Exec(query, sql.Named("step", step), sql.Named("id", userID))
+	if err != nil {
+		log.Printf("claimTOTPStep failed: %v", err)
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1
+}
+
+func setUserTOTPLastStep(userID int, step int64) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET totp_last_step=@step WHERE id=@id", tbl("users"))
+	if _, err := db.Exec(query, sql.Named("step", step), sql.Named("id", userID)); err != nil {
+		log.Printf("setUserTOTPLastStep failed: %v", err)
+	}
+}
+
+// replaceRecoveryCodes invalidates old codes and stores new ones (bcrypt hashed).
+// The plain codes are returned once for display.
+func replaceRecoveryCodes(userID int) []string {
+	db := getDB()
+	defer db.Close()
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=@uid", tbl("user_recovery_codes")), sql.Named("uid", userID)); err != nil {
+		log.Printf("delete recovery codes failed: %v", err)
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 5)
+		_, _ = rand.Read(buf)
+		raw := strings.ToLower(b32NoPad.EncodeToString(buf)) // 8 chars
+		code := raw[:4] + "-" + raw[4:]
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("hash recovery code failed: %v", err)
+			continue
+		}
+		query := fmt.Sprintf("INSERT INTO %s (user_id, code_hash) VALUES (@uid, @hash)", tbl("user_recovery_codes"))
+		if _, err := db.Exec(query, sql.Named("uid", userID), sql.Named("hash", string(hash))); err != nil {
+			log.Printf("insert recovery code failed: %v", err)
+			continue
+		}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func deleteRecoveryCodes(userID int) {
+	db := getDB()
+	defer db.Close()
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=@uid", tbl("user_recovery_codes")), sql.Named("uid", userID)); err != nil {
+		log.Printf("delete recovery codes failed: %v", err)
+	}
+}
+
+// useRecoveryCode marks a matching unused recovery code as used
+func useRecoveryCode(userID int, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		return false
+	}
+	db := getDB()
+	defer db.Close()
+	rows, err := db.Query(fmt.Sprintf("SELECT id, code_hash FROM %s WHERE user_id=@uid AND used_at IS NULL", tbl("user_recovery_codes")), sql.Named("uid", userID))
+	if err != nil {
+		log.Printf("query recovery codes failed: %v", err)
+		return false
+	}
+	matched := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			matched = id
+			break
+		}
+	}
+	rows.Close()
+	if matched == 0 {
+		return false
+	}
+	// only the request that marks the code used may log in with it
+	query := fmt.Sprintf("UPDATE %s SET used_at=@now WHERE id=@id AND used_at IS NULL", tbl("user_recovery_codes"))
+	res, err := db.Exec(query, sql.Named("now", time.Now()), sql.Named("id", matched))
+	if err != nil {
+		log.Printf("mark recovery code failed: %v", err)
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1
+}
+
+func countRecoveryCodes(userID int) int {
+	db := getDB()
+	defer db.Close()
+	var n int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id=@uid AND used_at IS NULL", tbl("user_recovery_codes"))
+	if err := db.QueryRow(query, sql.Named("uid", userID)).Scan(&n); err != nil {
+		return 0
+	}
+	return n
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery code
+func checkSecondFactor(userID int, code string) bool {
+	secret, enabled, last := getUserTOTP(userID)
+	if !enabled {
+		return false
+	}
+	if step, ok := verifyTOTP(secret, code, time.Now(), last); ok {
+		return claimTOTPStep(userID, step)
+	}
+	return useRecoveryCode(userID, code)
+}
+
+//---------------------------------------------------------------------
+// Login integration
+//---------------------------------------------------------------------
+
+// twoFactorRequired reports whether u must pass the TOTP step: either the user
+// enrolled voluntarily or the tenant enforces 2FA for the user's role
+func twoFactorRequired(r *http.Request, u User) bool {
+	if _, enabled, _ := getUserTOTP(u.ID); enabled {
+		return true
+	}
+	return roleRequiresTwoFactor(r, u.Role)
+}
+
+// roleRequiresTwoFactor reports whether the tenant enforces 2FA for role
+func roleRequiresTwoFactor(r *http.Request, role string) bool {
+	for _, enforced := range tenantConfigFor(r).TwoFactorRoles {
+		if strings.EqualFold(strings.TrimSpace(enforced), role) {
+			return true
+		}
+	}
+	return false
+}
+
+// startUserSession logs a DB user in; role and identity only enter the session here
+func startUserSession(w http.ResponseWriter, r *http.Request, u User) {
+	session, _ := store.Get(r, "session")
+	delete(session.Values, "pending_2fa_user_id")
+	delete(session.Values, "pending_2fa_at")
+	delete(session.Values, "totp_pending_secret")
+	// prefer displaying the DB user's name
+	session.Values["username"] = u.Name
+	session.Values["role"] = u.Role
+	session.Values["db_user_id"] = u.ID
+	session.Values["db_user_email"] = u.Email
+	session.Options = &sessions.Options{Path: "/", MaxAge: sessionDuration * 60, HttpOnly: true}
+	session.Save(r, w)
+}
+
+// beginTwoFactor remembers a password-verified user without granting a role yet
+func beginTwoFactor(w http.ResponseWriter, r *http.Request, u User) {
+	session, _ := store.Get(r, "session")
+	session.Values = map[interface{}]interface{}{}
+	session.Values["pending_2fa_user_id"] = u.ID
+	session.Values["pending_2fa_at"] = time.Now().Unix()
+	session.Options = &sessions.Options{Path: "/", MaxAge: int(pendingLoginTTL.Seconds()), HttpOnly: true}
+	session.Save(r, w)
+}
+
+// pendingTwoFactorUser returns the user waiting for the second login step
+func pendingTwoFactorUser(r *http.Request) (User, bool) {
+	session, _ := store.Get(r, "session")
+	id, ok := session.Values["pending_2fa_user_id"].(int)
+	if !ok || id <= 0 {
+		return User{}, false
+	}
+	at, _ := session.Values["pending_2fa_at"].(int64)
+	if time.Since(time.Unix(at, 0)) > pendingLoginTTL {
+		return User{}, false
+	}
+	// a user deactivated since the password step must not finish the login
+	u := getUser(strconv.Itoa(id))
+	if u.ID == 0 || u.Active == 0 {
+		return User{}, false
+	}
+	return u, true
+}
+
+// pendingSecret returns the not yet confirmed enrollment secret kept in the session
+func pendingSecret(w http.ResponseWriter, r *http.Request) string {
+	session, _ := store.Get(r, "session")
+	if s, ok := session.Values["totp_pending_secret"].(string); ok && s != "" {
+		return s
+	}
+	s := newTOTPSecret()
+	session.Values["totp_pending_secret"] = s
+	session.Save(r, w)
+	return s
+}
+
+func enrollmentData(w http.ResponseWriter, r *http.Request, u User) map[string]any {
+	secret := pendingSecret(w, r)
+	issuer := "WorkingTime"
+	if host := requestHost(r); host != "" {
+		issuer += " (" + host + ")"
+	}
+	return map[string]any{
+		"Secret": secret,
+		"QR":     qrDataURL(totpURI(issuer, u.Email, secret), 220),
+	}
+}
+
+// loginTwoFactorHandler is the second login step after a successful password check.
+// Users that must use 2FA but have not enrolled yet are enrolled right here.
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := pendingTwoFactorUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	_, enabled, _ := getUserTOTP(u.ID)
+	data := map[string]any{"User": u, "Enrolled": enabled}
+	if !enabled {
+		data["Enroll"] = enrollmentData(w, r, u)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		renderTemplate(w, r, "loginTwoFactor", data)
+	case http.MethodPost:
+		if wait, blocked := loginBlocked(r, u.Email); blocked {
+			tooManyAttempts(w, wait)
+			return
+		}
+		code := r.FormValue("code")
+		if enabled {
+			if !checkSecondFactor(u.ID, code) {
+				recordLoginFailure(r, u.Email)
+				data["Error"] = "Code ungültig oder bereits verwendet."
+				renderTemplate(w, r, "loginTwoFactor", data)
+				return
+			}
+			recordLoginSuccess(u.Email)
+			startUserSession(w, r, u)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		secret := pendingSecret(w, r)
+		step, ok := verifyTOTP(secret, code, time.Now(), 0)
+		if !ok {
+			recordLoginFailure(r, u.Email)
+			data["Error"] = "Code ungültig. Bitte Uhrzeit des Geräts prüfen."
+			renderTemplate(w, r, "loginTwoFactor", data)
+			return
+		}
+		recordLoginSuccess(u.Email)
+		setUserTOTP(u.ID, secret, true)
+		setUserTOTPLastStep(u.ID, step)
+		codes := replaceRecoveryCodes(u.ID)
+		startUserSession(w, r, u)
+		renderTemplate(w, r, "twoFactor", map[string]any{"User": u, "Enabled": true, "RecoveryCodes": codes})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// twoFactorSettingsHandler lets a logged-in DB user enroll, disable 2FA or renew recovery codes
+func twoFactorSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := currentDBUserFromSession(r)
+	if !ok || u.ID == 0 {
+		renderTemplate(w, r, "twoFactor", map[string]any{"Error": "Zwei-Faktor-Anmeldung ist nur für Datenbank-Benutzer verfügbar."})
+		return
+	}
+	_, enabled, _ := getUserTOTP(u.ID)
+	data := map[string]any{"User": u, "Enabled": enabled, "Remaining": countRecoveryCodes(u.ID)}
+	if r.Method == http.MethodPost {
+		code := r.FormValue("code")
+		switch r.FormValue("action") {
+		case "enable":
+			secret := pendingSecret(w, r)
+			step, ok := verifyTOTP(secret, code, time.Now(), 0)
+			if !ok {
+				data["Error"] = "Code ungültig. Bitte Uhrzeit des Geräts prüfen."
+				break
+			}
+			setUserTOTP(u.ID, secret, true)
+			setUserTOTPLastStep(u.ID, step)
+			session, _ := store.Get(r, "session")
+			delete(session.Values, "totp_pending_secret")
+			session.Save(r, w)
+			data["Enabled"] = true
+			data["RecoveryCodes"] = replaceRecoveryCodes(u.ID)
+		case "disable":
+			if !checkSecondFactor(u.ID, code) {
+				data["Error"] = "Code ungültig oder bereits verwendet."
+				break
+			}
+			setUserTOTP(u.ID, "", false)
+			deleteRecoveryCodes(u.ID)
+			data["Enabled"] = false
+			data["Message"] = "Zwei-Faktor-Anmeldung deaktiviert."
+		case "recovery":
+			if !checkSecondFactor(u.ID, code) {
+				data["Error"] = "Code ungültig oder bereits verwendet."
+				break
+			}
+			data["RecoveryCodes"] = replaceRecoveryCodes(u.ID)
+		default:
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if en, _ := data["Enabled"].(bool); !en {
+		data["Enroll"] = enrollmentData(w, r, u)
+	}
+	renderTemplate(w, r, "twoFactor", data)
+}
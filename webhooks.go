@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outgoing webhooks. Events are written to webhook_deliveries (one row per
+// subscription) and sent by a background dispatcher, so a slow or unreachable
+// receiver never delays a stamp. Failed deliveries are retried with
+// exponential backoff. Every request is signed:
+//
+//	X-WTM-Signature: t=<unix time>,v1=<hex HMAC-SHA256(secret, "<unix time>.<body>")>
+const (
+	webhookMaxAttempts  = 10
+	webhookBaseBackoff  = 30 * time.Second
+	webhookMaxBackoff   = 6 * time.Hour
+	webhookPollInterval = 15 * time.Second
+	webhookTimeout      = 10 * time.Second
+	webhookKeepLog      = 30 * 24 * time.Hour
+	webhookBatchSize    = 50
+)
+
+// webhookEvents are the event types a subscription can select
+var webhookEvents = []string{
+	"entry.created", "entry.updated", "entry.deleted",
+	"user.created", "user.updated", "user.deleted",
+	"compliance.violation",
+}
+
+type Webhook struct {
+	ID          int
+	URL         string
+	Secret      string
+	Events      []string // "*" for all
+	Active      bool
+	Description string
+	CreatedAt   time.Time
+}
+
+func (wh Webhook) wants(event string) bool {
+	return event == "ping" || slices.Contains(wh.Events, "*") || slices.Contains(wh.Events, event)
+}
+
+type WebhookDelivery struct {
+	ID            int
+	WebhookID     int
+	URL           string
+	Event         string
+	Payload       string
+	Status        string // pending, delivered, failed
+	Attempts      int
+	NextAttemptAt time.Time
+	LastStatus    int
+	LastError     string
+	CreatedAt     time.Time
+	DeliveredAt   time.Time
+}
+
+// webhookEnvelope is the JSON body sent to receivers
+type webhookEnvelope struct {
+	ID         string `json:"id"`
+	Event      string `json:"event"`
+	Tenant     string `json:"tenant"`
+	OccurredAt string `json:"occurredAt"`
+	Data       any    `json:"data"`
+}
+
+var (
+	webhookWake   = make(chan struct{}, 1)
+	webhookClient = &http.Client{
+		Timeout: webhookTimeout,
+		// a redirect usually means a misconfigured URL; report it instead of following
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+)
+
+//---------------------------------------------------------------------
+// Emitting
+//---------------------------------------------------------------------
+
+// webhookSubscribed reports whether any active subscription wants event
+func webhookSubscribed(event string) bool {
+	return len(webhooksFor(event)) > 0
+}
+
+func webhooksFor(event string) []Webhook {
+	var list []Webhook
+	for _, wh := range getWebhooks() {
+		if wh.Active && wh.wants(event) {
+			list = append(list, wh)
+		}
+	}
+	return list
+}
+
+// emitEvent queues event for all matching subscriptions of the current tenant.
+// data is only evaluated when somebody is subscribed.
+func emitEvent(event string, data func() any) {
+	hooks := webhooksFor(event)
+	if len(hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(webhookEnvelope{
+		ID:         randomToken(16),
+		Event:      event,
+		Tenant:     boundHost(),
+		OccurredAt: time.Now().Format(time.RFC3339),
+		Data:       data(),
+	})
+	if err != nil {
+		log.Printf("webhook %s: encoding payload failed: %v", event, err)
+		return
+	}
+	for _, wh := range hooks {
+		enqueueWebhookDelivery(wh.ID, event, string(body))
+	}
+	wakeWebhookDispatcher()
+}
+
+func wakeWebhookDispatcher() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+func emitEntryEvent(event string, id int64) {
+	emitEvent(event, func() any { return apiEntry(getEntry(strconv.FormatInt(id, 10))) })
+}
+
+func emitUserEvent(event string, id string) {
+	emitEvent(event, func() any { return toAPIUser(getUser(id)) })
+}
+
+// complianceReported remembers host|user|day|rule so a violation is reported once
+var complianceReported sync.Map
+
+// checkDailyHours reports a compliance.violation when a user's recorded work
+// on the day of at exceeds the tenant's maxDailyHours (default 10, ArbZG §3)
+func checkDailyHours(userID string, at time.Time) {
+	if !webhookSubscribed("compliance.violation") {
+		return
+	}
+	limit := loadTenantConfig(boundHost()).MaxDailyHours
+	if limit <= 0 {
+		limit = 10
+	}
+	u := getUser(userID)
+	day := at.Format("2006-01-02")
+	hours := dailyWorkHours(u.Name, day)
+	key := boundHost() + "|" + userID + "|" + day + "|max_daily_hours"
+	if hours <= limit {
+		return
+	}
+	if _, seen := complianceReported.LoadOrStore(key, true); seen {
+		return
+	}
+	emitEvent("compliance.violation", func() any {
+		return map[string]any{
+			"rule":   "max_daily_hours",
+			"user":   toAPIUser(u),
+			"date":   day,
+			"hours":  hours,
+			"limit":  limit,
+			"detail": fmt.Sprintf("%.2f h recorded, maximum is %.2f h", hours, limit),
+		}
+	})
+}
+
+//---------------------------------------------------------------------
+// Dispatcher
+//---------------------------------------------------------------------
+
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	return min(webhookBaseBackoff<<uint(min(attempts-1, 20)), webhookMaxBackoff)
+}
+
+// sendWebhook posts one delivery; it returns the HTTP status (0 when no response)
+func sendWebhook(wh Webhook, d WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "WorkingTime-Webhook/1")
+	req.Header.Set("X-WTM-Event", d.Event)
+	req.Header.Set("X-WTM-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-WTM-Signature", signWebhook(wh.Secret, time.Now().Unix(), body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliverDueWebhooks sends all due deliveries of the current tenant
+func deliverDueWebhooks() {
+	hooks := map[int]Webhook{}
+	for _, wh := range getWebhooks() {
+		hooks[wh.ID] = wh
+	}
+	for _, d := range dueWebhookDeliveries(webhookBatchSize) {
+		wh, ok := hooks[d.WebhookID]
+		if !ok || !wh.Active {
+			finishWebhookDelivery(d, "failed", 0, "subscription removed or disabled")
+			continue
+		}
+		status, err := sendWebhook(wh, d)
+		d.Attempts++
+		switch {
+		case err == nil:
+			finishWebhookDelivery(d, "delivered", status, "")
+		case d.Attempts >= webhookMaxAttempts:
+			log.Printf("webhook delivery %d to %s failed permanently: %v", d.ID, wh.URL, err)
+			finishWebhookDelivery(d, "failed", status, err.Error())
+		default:
+			d.NextAttemptAt = time.Now().Add(webhookBackoff(d.Attempts))
+			finishWebhookDelivery(d, "pending", status, err.Error())
+		}
+	}
+}
+
+// startWebhookDispatcher delivers queued events for all tenants, on a timer
+// and whenever an event was queued
+func startWebhookDispatcher() {
+	go func() {
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		lastPrune := time.Time{}
+		for {
+			select {
+			case <-ticker.C:
+			case <-webhookWake:
+			}
+			prune := time.Since(lastPrune) > time.Hour
+			forEachTenantDB(func() {
+				deliverDueWebhooks()
+				if prune {
+					pruneWebhookDeliveries()
+				}
+			})
+			if prune {
+				lastPrune = time.Now()
+			}
+		}
+	}()
+}
+
+// forEachTenantDB runs fn once per existing SQLite tenant database under
+// tenantRoot (goroutine bound to the host) or once for the shared MSSQL
+// database; tenants without a database are skipped, never created
+func forEachTenantDB(fn func()) {
+	if dbBackend != "sqlite" {
+		fn()
+		return
+	}
+	for _, host := range tenantHosts() {
+		SetRequestHost(host)
+		EnsureSchemaCurrent()
+		fn()
+		ClearRequestHost()
+	}
+}
+
+//---------------------------------------------------------------------
+// Storage
+//---------------------------------------------------------------------
+
+func getWebhooks() []Webhook {
+	db := getDB()
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT id, url, secret, events, active, COALESCE(description, ''), created_at FROM %s ORDER BY id", tbl("webhooks"))
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Printf("getWebhooks query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []Webhook
+	for rows.Next() {
+		var wh Webhook
+		var events string
+		var active int
+		var created int64
+		if err := rows.Scan(&wh.ID, &wh.URL, &wh.Secret, &events, &active, &wh.Description, &created); err != nil {
+			log.Printf("getWebhooks scan failed: %v", err)
+			continue
+		}
+		wh.Events, wh.Active, wh.CreatedAt = strings.Fields(events), active != 0, time.Unix(created, 0)
+		list = append(list, wh)
+	}
+	return list
+}
+
+func getWebhook(id string) (Webhook, bool) {
+	for _, wh := range getWebhooks() {
+		if strconv.Itoa(wh.ID) == id {
+			return wh, true
+		}
+	}
+	return Webhook{}, false
+}
+
+func createWebhook(wh Webhook) error {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("INSERT INTO %s (url, secret, events, active, description, created_at) VALUES (@url,@secret,@events,1,@desc,@now)", tbl("webhooks"))
+	_, err := db.Exec(query, sql.Named("url", wh.URL), sql.Named("secret", wh.Secret), sql.Named("events", strings.Join(wh.Events, " ")),
+		sql.Named("desc", wh.Description), sql.Named("now", time.Now().Unix()))
+	if err != nil {
+		log.Printf("createWebhook failed: %v", err)
+	}
+	return err
+}
+
+func setWebhookActive(id string, active bool) {
+	db := getDB()
+	defer db.Close()
+	v := 0
+	if active {
+		v = 1
+	}
+	if _, err := db.Exec(fmt.Sprintf("UPDATE %s SET active=@active WHERE id=@id", tbl("webhooks")), sql.Named("active", v), sql.Named("id", id)); err != nil {
+		log.Printf("setWebhookActive failed: %v", err)
+	}
+}
+
+func deleteWebhook(id string) {
+	db := getDB()
+	defer db.Close()
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE webhook_id=@id", tbl("webhook_deliveries")), sql.Named("id", id)); err != nil {
+		log.Printf("deleteWebhook deliveries failed: %v", err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id=@id", tbl("webhooks")), sql.Named("id", id)); err != nil {
+		log.Printf("deleteWebhook failed: %v", err)
+	}
+}
+
+func enqueueWebhookDelivery(webhookID int, event, payload string) {
+	db := getDB()
+	defer db.Close()
+	now := time.Now().Unix()
+	query := fmt.Sprintf(`INSERT INTO %s (webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+	                      VALUES (@wid,@event,@payload,'pending',0,@now,@now)`, tbl("webhook_deliveries"))
+	if _, err := db.Exec(query, sql.Named("wid", webhookID), sql.Named("event", event), sql.Named("payload", payload), sql.Named("now", now)); err != nil {
+		log.Printf("enqueueWebhookDelivery failed: %v", err)
+	}
+}
+
+const webhookDeliveryColumns = "d.id, d.webhook_id, COALESCE(w.url, ''), d.event, d.payload, d.status, d.attempts, d.next_attempt_at, COALESCE(d.last_status, 0), COALESCE(d.last_error, ''), d.created_at, d.delivered_at"
+
+func queryWebhookDeliveries(where string, limit int, args ...any) []WebhookDelivery {
+	db := getDB()
+	defer db.Close()
+
+	var query string
+	if dbBackend == "mssql" {
+		query = fmt.Sprintf("SELECT TOP (%d) %s FROM %s d LEFT JOIN %s w ON w.id = d.webhook_id WHERE %s", limit, webhookDeliveryColumns, tbl("webhook_deliveries"), tbl("webhooks"), where)
+	} else {
+		query = fmt.Sprintf("SELECT %s FROM %s d LEFT JOIN %s w ON w.id = d.webhook_id WHERE %s LIMIT %d", webhookDeliveryColumns, tbl("webhook_deliveries"), tbl("webhooks"), where, limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("webhook deliveries query failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var next, created int64
+		var delivered sql.NullInt64
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Event, &d.Payload, &d.Status, &d.Attempts, &next, &d.LastStatus, &d.LastError, &created, &delivered); err != nil {
+			log.Printf("webhook deliveries scan failed: %v", err)
+			continue
+		}
+		d.NextAttemptAt, d.CreatedAt, d.DeliveredAt = time.Unix(next, 0), time.Unix(created, 0), fromUnix(delivered)
+		list = append(list, d)
+	}
+	return list
+}
+
+func dueWebhookDeliveries(limit int) []WebhookDelivery {
+	return queryWebhookDeliveries("d.status='pending' AND d.next_attempt_at <= @now ORDER BY d.id", limit, sql.Named("now", time.Now().Unix()))
+}
+
+// recentWebhookDeliveries lists the delivery log, newest first; status filters when set
+func recentWebhookDeliveries(status string, limit int) []WebhookDelivery {
+	if status != "" {
+		return queryWebhookDeliveries("d.status=@status ORDER BY d.id DESC", limit, sql.Named("status", status))
+	}
+	return queryWebhookDeliveries("1=1 ORDER BY d.id DESC", limit)
+}
+
+func finishWebhookDelivery(d WebhookDelivery, status string, httpStatus int, errText string) {
+	db := getDB()
+	defer db.Close()
+	if len(errText) > 1000 {
+		errText = errText[:1000]
+	}
+	var delivered any
+	if status == "delivered" {
+		delivered = time.Now().Unix()
+	}
+	query := fmt.Sprintf(`UPDATE %s SET status=@status, attempts=@attempts, next_attempt_at=@next, last_status=@code, last_error=@err, delivered_at=@delivered
+	                      WHERE id=@id`, tbl("webhook_deliveries"))
+	if _, err := db.Exec(query, sql.Named("status", status), sql.Named("attempts", d.Attempts), sql.Named("next", d.NextAttemptAt.Unix()),
+		sql.Named("code", httpStatus), sql.Named("err", errText), sql.Named("delivered", delivered), sql.Named("id", d.ID)); err != nil {
+		log.Printf("finishWebhookDelivery failed: %v", err)
+	}
+}
+
+// retryWebhookDelivery puts a delivery back into the queue for an immediate attempt
+func retryWebhookDelivery(id string) {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("UPDATE %s SET status='pending', attempts=0, next_attempt_at=@now WHERE id=@id", tbl("webhook_deliveries"))
+	if _, err := db.Exec(query, sql.Named("now", time.Now().Unix()), sql.Named("id", id)); err != nil {
+		log.Printf("retryWebhookDelivery failed: %v", err)
+	}
+}
+
+// pruneWebhookDeliveries drops finished deliveries older than webhookKeepLog
+func pruneWebhookDeliveries() {
+	db := getDB()
+	defer db.Close()
+	query := fmt.Sprintf("DELETE FROM %s WHERE status <> 'pending' AND created_at < @before", tbl("webhook_deliveries"))
+	if _, err := db.Exec(query, sql.Named("before", time.Now().Add(-webhookKeepLog).Unix())); err != nil {
+		log.Printf("pruneWebhookDeliveries failed: %v", err)
+	}
+}
+
+//---------------------------------------------------------------------
+// Admin page
+//---------------------------------------------------------------------
+
+// webhooksHandler manages subscriptions and shows the delivery log
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{"Events": webhookEvents}
+	if r.Method == http.MethodPost {
+		id := r.FormValue("id")
+		switch r.FormValue("action") {
+		case "create":
+			wh, err := webhookFromForm(r)
+			if err == nil {
+				err = createWebhook(wh)
+			}
+			if err != nil {
+				data["Error"] = err.Error()
+				break
+			}
+			http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+			return
+		case "enable", "disable":
+			setWebhookActive(id, r.FormValue("action") == "enable")
+		case "delete":
+			deleteWebhook(id)
+		case "test":
+			if wh, ok := getWebhook(id); ok {
+				body, _ := json.Marshal(webhookEnvelope{ID: randomToken(16), Event: "ping", Tenant: requestHost(r), OccurredAt: time.Now().Format(time.RFC3339), Data: map[string]any{"webhookId": wh.ID}})
+				enqueueWebhookDelivery(wh.ID, "ping", string(body))
+				wakeWebhookDispatcher()
+			}
+		case "retry":
+			retryWebhookDelivery(id)
+			wakeWebhookDispatcher()
+		}
+		if data["Error"] == nil {
+			http.Redirect(w, r, "/admin/webhooks?status="+url.QueryEscape(r.FormValue("status")), http.StatusSeeOther)
+			return
+		}
+	}
+	status := r.URL.Query().Get("status")
+	data["Status"] = status
+	data["Webhooks"] = getWebhooks()
+	data["Deliveries"] = recentWebhookDeliveries(status, 100)
+	renderTemplate(w, r, "webhooks", data)
+}
+
+func webhookFromForm(r *http.Request) (Webhook, error) {
+	wh := Webhook{
+		URL:         strings.TrimSpace(r.FormValue("url")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Secret:      strings.TrimSpace(r.FormValue("secret")),
+	}
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return wh, fmt.Errorf("Bitte eine gültige http(s)-URL angeben.")
+	}
+	if r.FormValue("all") == "on" {
+		wh.Events = []string{"*"}
+	} else {
+		for _, e := range r.Form["events"] {
+			if slices.Contains(webhookEvents, e) {
+				wh.Events = append(wh.Events, e)
+			}
+		}
+	}
+	if len(wh.Events) == 0 {
+		return wh, fmt.Errorf("Bitte mindestens ein Ereignis auswählen.")
+	}
+	if wh.Secret == "" {
+		wh.Secret = randomToken(32)
+	}
+	return wh, nil
+}